@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/Raihanki/Chirpy/internal/database"
+)
+
+type contextKey string
+
+const principalContextKey contextKey = "principal"
+
+const roleAdmin = "admin"
+
+const (
+	scopeChirpsRead  = "chirps:read"
+	scopeChirpsWrite = "chirps:write"
+	// scopeAccount covers account management. It can't be granted to
+	// personal access tokens or OAuth clients, so only session logins have
+	// it.
+	scopeAccount = "account"
+)
+
+// grantableScopes are the scopes a personal access token or an OAuth client
+// may be granted.
+var grantableScopes = []string{scopeChirpsRead, scopeChirpsWrite}
+
+// sessionScopes are the scopes of the access tokens issued to a session
+// login, which acts for the user in full.
+var sessionScopes = []string{scopeChirpsRead, scopeChirpsWrite, scopeAccount}
+
+// apiTokenPrefix marks personal access tokens so that the auth path can tell
+// them apart from JWTs.
+const apiTokenPrefix = "chirpy_pat_"
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	UserID    int
+	Roles     []string
+	Scopes    []string
+	TokenID   string
+	SessionID string
+	// ClientID is the OAuth client the token was issued to, if any.
+	ClientID string
+}
+
+func (p Principal) HasRole(role string) bool {
+	return slices.Contains(p.Roles, role)
+}
+
+// HasScope reports whether the principal may act within scope.
+func (p Principal) HasScope(scope string) bool {
+	return slices.Contains(p.Scopes, scope)
+}
+
+// rolesFor returns the roles to put in a user's access tokens. Accounts
+// listed in ADMIN_EMAILS are admins in addition to their stored roles.
+func (cfg *apiConfig) rolesFor(user database.User) []string {
+	roles := slices.Clone(user.Roles)
+	if _, ok := cfg.AdminEmails[user.Email]; ok && !slices.Contains(roles, roleAdmin) {
+		roles = append(roles, roleAdmin)
+	}
+	return roles
+}
+
+func withPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalContextKey, p)
+}
+
+func principalFromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalContextKey).(Principal)
+	return p, ok
+}
+
+var errMissingAuthorization = errors.New("authorization header is missing or improperly formatted")
+
+// getAuthorization returns the credentials from the Authorization header
+// when it uses the given scheme, e.g. "Bearer" or "ApiKey".
+func getAuthorization(r *http.Request, scheme string) (string, error) {
+	header := r.Header.Get("Authorization")
+	prefix, credentials, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(prefix, scheme) {
+		return "", errMissingAuthorization
+	}
+	credentials = strings.TrimSpace(credentials)
+	if credentials == "" {
+		return "", errMissingAuthorization
+	}
+	return credentials, nil
+}
+
+func getBearerToken(r *http.Request) (string, error) {
+	return getAuthorization(r, "Bearer")
+}
+
+// respondWithAuthError writes an RFC 6750 error response. An empty errCode
+// means no credentials were sent, in which case only the challenge is sent.
+func respondWithAuthError(w http.ResponseWriter, r *http.Request, code int, errCode, description string) {
+	challenge := `Bearer realm="chirpy"`
+	if errCode != "" {
+		challenge += fmt.Sprintf(`, error=%q`, errCode)
+		if description != "" {
+			challenge += fmt.Sprintf(`, error_description=%q`, description)
+		}
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+
+	msg := description
+	if msg == "" {
+		msg = http.StatusText(code)
+	}
+	respondWithError(w, r, code, msg)
+}
+
+// logSecurityEvent records a rejected request that may indicate an attack,
+// such as a forged webhook.
+func logSecurityEvent(r *http.Request, event, reason string) {
+	slog.WarnContext(r.Context(), "Security event", "event", event, "reason", reason, "ip", clientIP(r), "path", r.URL.Path)
+}
+
+func (cfg *apiConfig) authenticate(r *http.Request) (Principal, error) {
+	token, err := getBearerToken(r)
+	if err != nil {
+		return Principal{}, err
+	}
+
+	if strings.HasPrefix(token, apiTokenPrefix) {
+		apiToken, err := cfg.DB.WithContext(r.Context()).ValidateAPIToken(token)
+		if err != nil {
+			return Principal{}, err
+		}
+		return Principal{
+			UserID:  apiToken.UserID,
+			Scopes:  apiToken.Scopes,
+			TokenID: apiToken.ID,
+		}, nil
+	}
+
+	claims, err := ValidateToken(cfg.Keys, token)
+	if err != nil {
+		return Principal{}, err
+	}
+
+	userId, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return Principal{}, fmt.Errorf("invalid subject %q: %w", claims.Subject, err)
+	}
+
+	// Access tokens are only as good as their session, so that revoking it,
+	// or resetting the password, signs the session out at once.
+	if claims.SessionId != "" {
+		_, err = cfg.DB.WithContext(r.Context()).GetSession(userId, claims.SessionId)
+		if err != nil {
+			return Principal{}, err
+		}
+	}
+
+	// Session tokens issued before they carried scopes act for the user in
+	// full, like the ones issued now.
+	scopes := claims.scopes()
+	if len(scopes) == 0 && claims.ClientId == "" && claims.SessionId != "" {
+		scopes = sessionScopes
+	}
+
+	return Principal{
+		UserID:    userId,
+		Roles:     claims.Roles,
+		Scopes:    scopes,
+		TokenID:   claims.ID,
+		SessionID: claims.SessionId,
+		ClientID:  claims.ClientId,
+	}, nil
+}
+
+// middlewareAuth rejects requests without a valid access token and stores
+// the caller's Principal in the request context.
+func (cfg *apiConfig) middlewareAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, err := cfg.authenticate(r)
+		if errors.Is(err, errMissingAuthorization) {
+			respondWithAuthError(w, r, http.StatusUnauthorized, "", "")
+			return
+		}
+		if err != nil {
+			respondWithAuthError(w, r, http.StatusUnauthorized, "invalid_token", "The access token is invalid or expired")
+			return
+		}
+
+		next(w, r.WithContext(withPrincipal(r.Context(), principal)))
+	}
+}
+
+// middlewareOptionalAuth serves public routes. Anonymous requests are let
+// through, but a caller that presents a token is authenticated and held to
+// scope like on any other route.
+func (cfg *apiConfig) middlewareOptionalAuth(scope string, next http.HandlerFunc) http.HandlerFunc {
+	authenticated := cfg.middlewareAuth(requireScope(scope, next))
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			next(w, r)
+			return
+		}
+		authenticated(w, r)
+	}
+}
+
+// middlewareAdmin only lets authenticated admins through.
+func (cfg *apiConfig) middlewareAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return cfg.middlewareAuth(func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := principalFromContext(r.Context())
+		if !ok || !principal.HasRole(roleAdmin) {
+			respondWithError(w, r, http.StatusForbidden, "Admin access required")
+			return
+		}
+		next(w, r)
+	})
+}
+
+// requireScope wraps an authenticated handler and rejects principals that
+// lack the given scope.
+func requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := principalFromContext(r.Context())
+		if !ok {
+			respondWithAuthError(w, r, http.StatusUnauthorized, "", "")
+			return
+		}
+		if !principal.HasScope(scope) {
+			respondWithAuthError(w, r, http.StatusForbidden, "insufficient_scope", "The access token requires the "+scope+" scope")
+			return
+		}
+		next(w, r)
+	}
+}
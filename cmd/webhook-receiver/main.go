@@ -0,0 +1,40 @@
+// Command webhook-receiver runs a local endpoint for Chirpy's outbound
+// webhooks. It verifies and prints every delivery it receives.
+//
+//	go run ./cmd/webhook-receiver -secret whsec_... -addr localhost:9000
+//
+// Register http://localhost:9000/ as an endpoint with
+// WEBHOOK_ALLOW_PRIVATE_URLS=true, and pass -status 500 to watch the
+// server retry.
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"github.com/Raihanki/Chirpy/internal/webhook"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:9000", "address to listen on")
+	secret := flag.String("secret", os.Getenv("WEBHOOK_SECRET"), "endpoint signing secret, defaults to $WEBHOOK_SECRET")
+	status := flag.Int("status", http.StatusNoContent, "status code to answer verified deliveries with")
+	flag.Parse()
+
+	if *secret == "" {
+		slog.Error("A signing secret is required, pass -secret or set WEBHOOK_SECRET")
+		os.Exit(1)
+	}
+
+	receiver := &webhook.Receiver{
+		Secret: *secret,
+		Status: *status,
+	}
+
+	slog.Info("Receiving webhooks", "url", "http://"+*addr+"/")
+	err := http.ListenAndServe(*addr, receiver)
+	slog.Error("Couldn't run receiver", "error", err)
+	os.Exit(1)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Raihanki/Chirpy/internal/database"
+)
+
+// Entitlements are the features and limits that come with a plan.
+type Entitlements struct {
+	// MaxChirpLength is counted in characters, not bytes.
+	MaxChirpLength int  `json:"max_chirp_length"`
+	EditAllowed    bool `json:"edit_allowed"`
+}
+
+// planOrder lists plans from cheapest to most expensive. An upgrade
+// suggestion names the cheapest plan that unlocks a feature.
+var planOrder = []string{database.PlanFree, database.PlanRed}
+
+var planNames = map[string]string{
+	database.PlanFree: "Chirpy Free",
+	database.PlanRed:  "Chirpy Red",
+}
+
+// PlanEntitlements maps each plan to its entitlements.
+type PlanEntitlements map[string]Entitlements
+
+// loadPlanEntitlements reads ENTITLEMENTS_FREE and ENTITLEMENTS_RED, each a
+// comma-separated list such as
+// "max_chirp_length=280,edit=true".
+// Settings that are left out keep their defaults.
+func loadPlanEntitlements() (PlanEntitlements, error) {
+	plans := PlanEntitlements{
+		database.PlanFree: {MaxChirpLength: 140},
+		database.PlanRed:  {MaxChirpLength: 280, EditAllowed: true},
+	}
+
+	for _, plan := range planOrder {
+		key := "ENTITLEMENTS_" + strings.ToUpper(plan)
+		val := os.Getenv(key)
+		if val == "" {
+			continue
+		}
+
+		entitlements := plans[plan]
+		for _, setting := range strings.Split(val, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(setting), "=")
+			var err error
+			switch name {
+			case "max_chirp_length":
+				entitlements.MaxChirpLength, err = strconv.Atoi(value)
+				if err == nil && entitlements.MaxChirpLength < 1 {
+					err = fmt.Errorf("must be positive")
+				}
+			case "edit":
+				entitlements.EditAllowed, err = strconv.ParseBool(value)
+			default:
+				err = fmt.Errorf("unknown setting")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s setting %q: %v", key, setting, err)
+			}
+		}
+		plans[plan] = entitlements
+	}
+
+	return plans, nil
+}
+
+// For returns the plan a user is on and its entitlements.
+func (p PlanEntitlements) For(user database.User) (string, Entitlements) {
+	plan := database.PlanFree
+	if user.IsChirpyRed {
+		plan = database.PlanRed
+	}
+	return plan, p[plan]
+}
+
+// entitlementError is returned when a user's plan doesn't include a
+// feature.
+type entitlementError struct {
+	Message string
+	// UpgradePlan is the cheapest plan that includes the feature, or empty
+	// if no plan does.
+	UpgradePlan string
+}
+
+func (e *entitlementError) Error() string {
+	return e.Message
+}
+
+// check returns an *entitlementError if plan doesn't satisfy allowed.
+// feature describes the blocked action, e.g. "Editing chirps".
+func (p PlanEntitlements) check(plan string, feature string, allowed func(Entitlements) bool) error {
+	if allowed(p[plan]) {
+		return nil
+	}
+
+	for _, upgrade := range planOrder {
+		if allowed(p[upgrade]) {
+			return &entitlementError{
+				Message:     fmt.Sprintf("%s requires %s", feature, planNames[upgrade]),
+				UpgradePlan: upgrade,
+			}
+		}
+	}
+	return &entitlementError{Message: feature + " is not available"}
+}
+
+// respondWithEntitlementError responds with 402 if an upgrade would unlock
+// the feature, and 403 if nothing would.
+func respondWithEntitlementError(w http.ResponseWriter, r *http.Request, e *entitlementError) {
+	if e.UpgradePlan == "" {
+		respondWithError(w, r, http.StatusForbidden, e.Message)
+		return
+	}
+
+	type response struct {
+		Error       string `json:"error"`
+		UpgradePlan string `json:"upgrade_plan"`
+	}
+	respondWithJSON(w, r, http.StatusPaymentRequired, response{
+		Error:       e.Message,
+		UpgradePlan: e.UpgradePlan,
+	})
+}
+
+func (cfg *apiConfig) handlerEntitlements(w http.ResponseWriter, r *http.Request) {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		respondWithAuthError(w, r, http.StatusUnauthorized, "", "")
+		return
+	}
+
+	user, err := cfg.DB.WithContext(r.Context()).GetUserById(principal.UserID)
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't get user")
+		return
+	}
+
+	plan, entitlements := cfg.Entitlements.For(user)
+
+	type response struct {
+		Plan         string       `json:"plan"`
+		Entitlements Entitlements `json:"entitlements"`
+	}
+	respondWithJSON(w, r, http.StatusOK, response{
+		Plan:         plan,
+		Entitlements: entitlements,
+	})
+}
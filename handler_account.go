@@ -0,0 +1,204 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Raihanki/Chirpy/internal/database"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// StartAccountPurge purges accounts whose deletion grace period has ended,
+// checking every interval until stop is closed.
+func (cfg *apiConfig) StartAccountPurge(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				purged, err := cfg.DB.PurgeDeletedUsers(time.Now(), cfg.AnonymizeDeletedChirps)
+				if err != nil {
+					slog.Error("Couldn't purge deleted accounts", "error", err)
+					continue
+				}
+				if len(purged) > 0 {
+					slog.Info("Purged deleted accounts", "user_ids", purged)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// handlerUserExport responds with a zip archive of everything Chirpy stores
+// about the caller. Secrets such as password and token hashes are left out.
+func (cfg *apiConfig) handlerUserExport(w http.ResponseWriter, r *http.Request) {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		respondWithAuthError(w, r, http.StatusUnauthorized, "", "")
+		return
+	}
+
+	data, err := cfg.DB.WithContext(r.Context()).GetUserData(principal.UserID)
+	if errors.Is(err, database.ErrUserNotFound) {
+		respondWithError(w, r, http.StatusNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't collect account data")
+		return
+	}
+
+	user := cfg.userFromDB(data.User)
+
+	chirps := []Chirp{}
+	for _, c := range data.Chirps {
+		chirps = append(chirps, Chirp{ID: c.Id, Body: c.Body, AuthorId: c.AuthorId})
+	}
+	sessions := []Session{}
+	for _, s := range data.Sessions {
+		sessions = append(sessions, sessionFromDB(s, principal.SessionID))
+	}
+	apiTokens := []APIToken{}
+	for _, t := range data.APITokens {
+		apiTokens = append(apiTokens, apiTokenFromDB(t))
+	}
+	oauthClients := []OAuthClient{}
+	for _, c := range data.OAuthClients {
+		oauthClients = append(oauthClients, oauthClientFromDB(c))
+	}
+	webhookEndpoints := []WebhookEndpoint{}
+	for _, e := range data.WebhookEndpoints {
+		webhookEndpoints = append(webhookEndpoints, webhookEndpointFromDB(e))
+	}
+
+	files := []struct {
+		name    string
+		payload interface{}
+	}{
+		{"profile.json", user},
+		{"chirps.json", chirps},
+		{"sessions.json", sessions},
+		{"api_tokens.json", apiTokens},
+		{"oauth_clients.json", oauthClients},
+		{"webhook_endpoints.json", webhookEndpoints},
+	}
+
+	buf := &bytes.Buffer{}
+	archive := zip.NewWriter(buf)
+	for _, file := range files {
+		f, err := archive.Create(file.name)
+		if err == nil {
+			enc := json.NewEncoder(f)
+			enc.SetIndent("", "  ")
+			err = enc.Encode(file.payload)
+		}
+		if err != nil {
+			respondWithError(w, r, http.StatusInternalServerError, "Couldn't build export")
+			return
+		}
+	}
+	err = archive.Close()
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't build export")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="chirpy-export-`+strconv.Itoa(user.ID)+`.zip"`)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// handlerUserDelete schedules the caller's account for deletion once the
+// grace period has passed. The password, and the second factor if enabled,
+// must be confirmed.
+func (cfg *apiConfig) handlerUserDelete(w http.ResponseWriter, r *http.Request) {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		respondWithAuthError(w, r, http.StatusUnauthorized, "", "")
+		return
+	}
+
+	type parameters struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	user, err := cfg.DB.WithContext(r.Context()).GetUserById(principal.UserID)
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't get user")
+		return
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(params.Password))
+	if err != nil {
+		respondWithError(w, r, http.StatusForbidden, "Incorrect password")
+		return
+	}
+
+	if user.TOTPEnabled {
+		err = cfg.verifySecondFactor(r.Context(), user, params.Code)
+		if errors.Is(err, errSecondFactorInvalid) {
+			respondWithError(w, r, http.StatusForbidden, "Invalid two-factor code")
+			return
+		}
+		if err != nil {
+			respondWithError(w, r, http.StatusInternalServerError, "Couldn't verify two-factor code")
+			return
+		}
+	}
+
+	user, err = cfg.DB.WithContext(r.Context()).ScheduleUserDeletion(user.ID, time.Now().UTC().Add(cfg.AccountDeletionGracePeriod))
+	if errors.Is(err, database.ErrDeletionScheduled) {
+		respondWithError(w, r, http.StatusConflict, "Account deletion is already scheduled")
+		return
+	}
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't schedule account deletion")
+		return
+	}
+
+	type response struct {
+		DeletionScheduledAt time.Time `json:"deletion_scheduled_at"`
+	}
+	respondWithJSON(w, r, http.StatusAccepted, response{
+		DeletionScheduledAt: user.DeletionScheduledAt,
+	})
+}
+
+func (cfg *apiConfig) handlerUserDeleteCancel(w http.ResponseWriter, r *http.Request) {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		respondWithAuthError(w, r, http.StatusUnauthorized, "", "")
+		return
+	}
+
+	err := cfg.DB.WithContext(r.Context()).CancelUserDeletion(principal.UserID)
+	if errors.Is(err, database.ErrDeletionNotScheduled) {
+		respondWithError(w, r, http.StatusNotFound, "Account deletion is not scheduled")
+		return
+	}
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't cancel account deletion")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
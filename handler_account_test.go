@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Raihanki/Chirpy/internal/database"
+)
+
+func TestPurgeDeletedUserLeavesNoPersonalData(t *testing.T) {
+	cfg := newTestConfig(t)
+	h := cfg.routes(t.TempDir())
+
+	const email = "purged@example.com"
+	const body = "a chirp only its author should be tied to"
+	signUpAndLogin(t, h, email, "correct horse battery")
+	doJSON(t, h, http.MethodPost, "/api/login", "", map[string]string{"email": strings.ToUpper(email), "password": "wrong password"})
+
+	user, err := cfg.DB.GetUserByEmail(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cfg.DB.CreateWebhookEndpoint(999, true, "https://hooks.example.com", database.EventTypes, "whsec_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first chirp reaches the webhook queue; the second is still in the
+	// outbox when the user is purged.
+	_, err = cfg.DB.CreateChirp(body, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, err := cfg.DB.PendingEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range pending {
+		_, err := cfg.DB.EnqueueWebhookEvent(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = cfg.DB.CompleteEvent(event.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = cfg.DB.CreateChirp(body, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Polka's events about the user are kept in the inbound ledger.
+	polkaPayload := fmt.Sprintf(`{"id":"evt_purged","event":"user.upgraded","data":{"user_id":%d}}`, user.ID)
+	status, result, err := cfg.processPolkaEvent(context.Background(), []byte(polkaPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, _, err := cfg.DB.RecordWebhookEvent(polkaProvider, "evt_purged", "user.upgraded", []byte(polkaPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cfg.DB.CompleteWebhookEvent(event.Key, status, result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = cfg.DB.ScheduleUserDeletion(user.ID, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	purged, err := cfg.DB.PurgeDeletedUsers(time.Now(), false)
+	if err != nil || len(purged) != 1 {
+		t.Fatalf("PurgeDeletedUsers() = %v, %v, want the user purged", purged, err)
+	}
+
+	data, err := cfg.DB.LoadDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{email, body} {
+		if strings.Contains(strings.ToLower(string(stored)), s) {
+			t.Errorf("database still contains %q after the purge", s)
+		}
+	}
+
+	// The ledger entry still recognizes redeliveries, without the payload.
+	event, err = cfg.DB.GetWebhookEvent(event.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(event.Payload) != 0 || event.Result != "" {
+		t.Errorf("webhook event still identifies the user: payload %s, result %q", event.Payload, event.Result)
+	}
+	if !event.Final() {
+		t.Errorf("webhook event status %s is no longer final", event.Status)
+	}
+	_, err = cfg.DB.ClaimWebhookEvent(event.Key)
+	if !errors.Is(err, database.ErrWebhookEventScrubbed) {
+		t.Errorf("ClaimWebhookEvent() of a scrubbed event: %v, want %v", err, database.ErrWebhookEventScrubbed)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/Raihanki/Chirpy/internal/database"
+)
+
+func (cfg *apiConfig) handlerLockoutsList(w http.ResponseWriter, r *http.Request) {
+	type lockout struct {
+		Key           string     `json:"key"`
+		Failures      int        `json:"failures"`
+		LastFailureAt time.Time  `json:"last_failure_at"`
+		LockedUntil   *time.Time `json:"locked_until,omitempty"`
+		Locked        bool       `json:"locked"`
+	}
+
+	attempts, err := cfg.DB.WithContext(r.Context()).GetLoginAttempts()
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't retrieve login attempts")
+		return
+	}
+
+	now := time.Now()
+	lockouts := []lockout{}
+	for _, attempt := range attempts {
+		l := lockout{
+			Key:           attempt.Key,
+			Failures:      attempt.Failures,
+			LastFailureAt: attempt.LastFailureAt,
+			Locked:        attempt.LockedUntil.After(now),
+		}
+		if !attempt.LockedUntil.IsZero() {
+			l.LockedUntil = &attempt.LockedUntil
+		}
+		lockouts = append(lockouts, l)
+	}
+
+	respondWithJSON(w, r, http.StatusOK, lockouts)
+}
+
+func (cfg *apiConfig) handlerLockoutClear(w http.ResponseWriter, r *http.Request) {
+	err := cfg.DB.WithContext(r.Context()).ClearLoginFailures(r.PathValue("key"))
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't clear lockout")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type WebhookEvent struct {
+	Key         string          `json:"key"`
+	Provider    string          `json:"provider"`
+	EventID     string          `json:"event_id"`
+	Type        string          `json:"type"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Result      string          `json:"result"`
+	Attempts    int             `json:"attempts"`
+	ReceivedAt  time.Time       `json:"received_at"`
+	ProcessedAt *time.Time      `json:"processed_at"`
+}
+
+func webhookEventFromDB(e database.WebhookEvent) WebhookEvent {
+	event := WebhookEvent{
+		Key:        e.Key,
+		Provider:   e.Provider,
+		EventID:    e.EventID,
+		Type:       e.Type,
+		Payload:    e.Payload,
+		Status:     e.Status,
+		Result:     e.Result,
+		Attempts:   e.Attempts,
+		ReceivedAt: e.ReceivedAt,
+	}
+	if !e.ProcessedAt.IsZero() {
+		event.ProcessedAt = &e.ProcessedAt
+	}
+	return event
+}
+
+func (cfg *apiConfig) handlerWebhookEventsList(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	statuses := []string{
+		database.WebhookEventReceived,
+		database.WebhookEventProcessing,
+		database.WebhookEventProcessed,
+		database.WebhookEventIgnored,
+		database.WebhookEventFailed,
+	}
+	if status != "" && !slices.Contains(statuses, status) {
+		respondWithError(w, r, http.StatusBadRequest, "Unknown status "+status)
+		return
+	}
+
+	dbEvents, err := cfg.DB.WithContext(r.Context()).GetWebhookEvents(status)
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't retrieve webhook events")
+		return
+	}
+
+	events := []WebhookEvent{}
+	for _, dbEvent := range dbEvents {
+		events = append(events, webhookEventFromDB(dbEvent))
+	}
+
+	respondWithJSON(w, r, http.StatusOK, events)
+}
+
+func (cfg *apiConfig) handlerWebhookEventDetail(w http.ResponseWriter, r *http.Request) {
+	event, err := cfg.DB.WithContext(r.Context()).GetWebhookEvent(r.PathValue("key"))
+	if errors.Is(err, database.ErrWebhookEventNotFound) {
+		respondWithError(w, r, http.StatusNotFound, "Webhook event not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't retrieve webhook event")
+		return
+	}
+
+	respondWithJSON(w, r, http.StatusOK, webhookEventFromDB(event))
+}
+
+// handlerWebhookEventReplay processes a recorded event again, whatever its
+// status. The outcome is recorded in the ledger and returned, with the
+// status of the error if processing failed.
+func (cfg *apiConfig) handlerWebhookEventReplay(w http.ResponseWriter, r *http.Request) error {
+	event, err := cfg.DB.WithContext(r.Context()).ClaimWebhookEvent(r.PathValue("key"))
+	if errors.Is(err, database.ErrWebhookEventNotFound) {
+		return notFound("Webhook event not found", err)
+	}
+	if errors.Is(err, database.ErrWebhookEventClaimed) {
+		return conflict("Webhook event is being processed", err)
+	}
+	if errors.Is(err, database.ErrWebhookEventScrubbed) {
+		return conflict("Webhook event belonged to a deleted user", err)
+	}
+	if err != nil {
+		return internalError("Couldn't claim webhook event", err)
+	}
+
+	status, result, processErr := cfg.processPolkaEvent(r.Context(), event.Payload)
+	event, err = cfg.DB.WithContext(r.Context()).CompleteWebhookEvent(event.Key, status, result)
+	if err != nil {
+		return internalError("Couldn't record webhook event", err)
+	}
+	if processErr != nil {
+		return polkaProcessError(processErr)
+	}
+
+	respondWithJSON(w, r, http.StatusOK, webhookEventFromDB(event))
+	return nil
+}
+
+type Stats struct {
+	Users          int               `json:"users"`
+	Chirps         int               `json:"chirps"`
+	ChirpyRedUsers int               `json:"chirpy_red_users"`
+	ActiveSessions int               `json:"active_sessions"`
+	FileserverHits uint64            `json:"fileserver_hits"`
+	PathHits       map[string]uint64 `json:"path_hits"`
+}
+
+func (cfg *apiConfig) handlerStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := cfg.DB.WithContext(r.Context()).GetStats(time.Now())
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't retrieve stats")
+		return
+	}
+
+	respondWithJSON(w, r, http.StatusOK, Stats{
+		Users:          stats.Users,
+		Chirps:         stats.Chirps,
+		ChirpyRedUsers: stats.ChirpyRedUsers,
+		ActiveSessions: stats.ActiveSessions,
+		FileserverHits: cfg.Metrics.FileserverHits.Value(),
+		PathHits:       cfg.Metrics.PathHits.Values(),
+	})
+}
+
+type AuditEntry struct {
+	ID      int       `json:"id"`
+	At      time.Time `json:"at"`
+	ActorID int       `json:"actor_id"`
+	Action  string    `json:"action"`
+	Detail  string    `json:"detail,omitempty"`
+}
+
+func auditEntryFromDB(e database.AuditEntry) AuditEntry {
+	return AuditEntry{
+		ID:      e.ID,
+		At:      e.At,
+		ActorID: e.ActorID,
+		Action:  e.Action,
+		Detail:  e.Detail,
+	}
+}
+
+func (cfg *apiConfig) handlerAuditLog(w http.ResponseWriter, r *http.Request) {
+	dbEntries, err := cfg.DB.WithContext(r.Context()).GetAuditLog()
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't retrieve audit log")
+		return
+	}
+
+	entries := []AuditEntry{}
+	for _, dbEntry := range dbEntries {
+		entries = append(entries, auditEntryFromDB(dbEntry))
+	}
+
+	respondWithJSON(w, r, http.StatusOK, entries)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Raihanki/Chirpy/internal/database"
+)
+
+const maxAPITokenNameLength = 100
+
+type APIToken struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	// Token is only set in the response to creating the token.
+	Token string `json:"token,omitempty"`
+}
+
+func apiTokenFromDB(t database.APIToken) APIToken {
+	apiToken := APIToken{
+		ID:        t.ID,
+		Name:      t.Name,
+		Scopes:    t.Scopes,
+		CreatedAt: t.CreatedAt,
+	}
+	if !t.ExpiresAt.IsZero() {
+		apiToken.ExpiresAt = &t.ExpiresAt
+	}
+	if !t.LastUsedAt.IsZero() {
+		apiToken.LastUsedAt = &t.LastUsedAt
+	}
+	return apiToken
+}
+
+func (cfg *apiConfig) handlerAPITokenCreate(w http.ResponseWriter, r *http.Request) {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		respondWithAuthError(w, r, http.StatusUnauthorized, "", "")
+		return
+	}
+
+	type parameters struct {
+		Name             string   `json:"name"`
+		Scopes           []string `json:"scopes"`
+		ExpiresInSeconds *int     `json:"expires_in_seconds,omitempty"`
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	errs := []fieldError{}
+	name := strings.TrimSpace(params.Name)
+	if name == "" || len(name) > maxAPITokenNameLength {
+		errs = append(errs, fieldError{Field: "name", Message: "Name is required and must be at most 100 characters long"})
+	}
+
+	scopes := []string{}
+	for _, scope := range params.Scopes {
+		if !slices.Contains(grantableScopes, scope) {
+			errs = append(errs, fieldError{Field: "scopes", Message: "Unknown scope " + scope + ", expected one of " + strings.Join(grantableScopes, ", ")})
+			continue
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(params.Scopes) == 0 {
+		errs = append(errs, fieldError{Field: "scopes", Message: "At least one scope is required"})
+	}
+
+	var expiresAt time.Time
+	if params.ExpiresInSeconds != nil {
+		if *params.ExpiresInSeconds <= 0 {
+			errs = append(errs, fieldError{Field: "expires_in_seconds", Message: "Expiry must be positive"})
+		}
+		expiresAt = time.Now().UTC().Add(time.Duration(*params.ExpiresInSeconds) * time.Second)
+	}
+
+	if len(errs) > 0 {
+		respondWithValidationError(w, r, errs)
+		return
+	}
+
+	secret, err := generateSecureToken()
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't generate token")
+		return
+	}
+	token := apiTokenPrefix + secret
+
+	dbToken, err := cfg.DB.WithContext(r.Context()).CreateAPIToken(principal.UserID, name, scopes, token, expiresAt)
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't create token")
+		return
+	}
+
+	apiToken := apiTokenFromDB(dbToken)
+	apiToken.Token = token
+	respondWithJSON(w, r, http.StatusCreated, apiToken)
+}
+
+func (cfg *apiConfig) handlerAPITokensList(w http.ResponseWriter, r *http.Request) {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		respondWithAuthError(w, r, http.StatusUnauthorized, "", "")
+		return
+	}
+
+	dbTokens, err := cfg.DB.WithContext(r.Context()).GetAPITokens(principal.UserID)
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't retrieve tokens")
+		return
+	}
+
+	tokens := []APIToken{}
+	for _, dbToken := range dbTokens {
+		tokens = append(tokens, apiTokenFromDB(dbToken))
+	}
+
+	respondWithJSON(w, r, http.StatusOK, tokens)
+}
+
+func (cfg *apiConfig) handlerAPITokenRevoke(w http.ResponseWriter, r *http.Request) {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		respondWithAuthError(w, r, http.StatusUnauthorized, "", "")
+		return
+	}
+
+	err := cfg.DB.WithContext(r.Context()).DeleteAPIToken(principal.UserID, r.PathValue("tokenId"))
+	if errors.Is(err, database.ErrAPITokenNotFound) {
+		respondWithError(w, r, http.StatusNotFound, "Token not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't revoke token")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
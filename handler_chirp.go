@@ -3,11 +3,12 @@ package main
 import (
 	"encoding/json"
 	"errors"
-	"log"
+	"fmt"
 	"net/http"
 	"sort"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/Raihanki/Chirpy/internal/database"
 )
@@ -18,29 +19,20 @@ type Chirp struct {
 	AuthorId int    `json:"author_id"`
 }
 
-func (cfg *apiConfig) handlerChirpsCreate(w http.ResponseWriter, r *http.Request) {
-	header := r.Header.Get("Authorization")
-	if header == "" || !strings.HasPrefix(header, "Bearer ") {
-		log.Println("Authorization header is missing or improperly formatted")
-		w.WriteHeader(http.StatusUnauthorized)
-		return
+func (cfg *apiConfig) handlerChirpsCreate(w http.ResponseWriter, r *http.Request) error {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		return unauthorized("", nil)
 	}
-	token := strings.Split(header, " ")[1]
 
-	claims, err := ValidateToken(token)
+	user, err := cfg.DB.WithContext(r.Context()).GetUserById(principal.UserID)
 	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
+		return unauthorized("The account no longer exists", err)
 	}
-
-	userId, err := claims.GetSubject()
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't get subject from claims")
-		return
+	if !user.EmailVerified {
+		return forbidden("Verify your email address before posting chirps")
 	}
 
-	userIdInt, _ := strconv.Atoi(userId)
-
 	type parameters struct {
 		Body string `json:"body"`
 	}
@@ -49,34 +41,48 @@ func (cfg *apiConfig) handlerChirpsCreate(w http.ResponseWriter, r *http.Request
 	params := parameters{}
 	err = decoder.Decode(&params)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
-		return
+		return invalid("Couldn't decode parameters", err)
 	}
 
-	cleaned, err := validateChirp(params.Body)
+	plan, _ := cfg.Entitlements.For(user)
+	cleaned, err := validateChirp(params.Body, plan, cfg.Entitlements)
+	var entErr *entitlementError
+	if errors.As(err, &entErr) {
+		return err
+	}
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, err.Error())
-		return
+		return invalid(err.Error(), err)
 	}
 
-	chirp, err := cfg.DB.CreateChirp(cleaned, userIdInt)
+	chirp, err := cfg.DB.WithContext(r.Context()).CreateChirp(cleaned, principal.UserID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create chirp")
-		return
+		return internalError("Couldn't create chirp", err)
 	}
 
-	respondWithJSON(w, http.StatusCreated, Chirp{
+	respondWithJSON(w, r, http.StatusCreated, Chirp{
 		ID:       chirp.Id,
 		Body:     chirp.Body,
-		AuthorId: userIdInt,
+		AuthorId: principal.UserID,
 	})
+	return nil
 }
 
-func validateChirp(body string) (string, error) {
-	const maxChirpLength = 140
-	if len(body) > maxChirpLength {
+// validateChirp checks a chirp against the limits of the author's plan and
+// censors banned words. It returns an *entitlementError if a better plan
+// would allow the chirp.
+func validateChirp(body string, plan string, plans PlanEntitlements) (string, error) {
+	length := utf8.RuneCountInString(body)
+	fits := func(e Entitlements) bool {
+		return length <= e.MaxChirpLength
+	}
+	err := plans.check(plan, fmt.Sprintf("Posting chirps longer than %d characters", plans[plan].MaxChirpLength), fits)
+	var entErr *entitlementError
+	if errors.As(err, &entErr) && entErr.UpgradePlan == "" {
 		return "", errors.New("Chirp is too long")
 	}
+	if err != nil {
+		return "", err
+	}
 
 	badWords := map[string]struct{}{
 		"kerfuffle": {},
@@ -99,43 +105,24 @@ func getCleanedBody(body string, badWords map[string]struct{}) string {
 	return cleaned
 }
 
-func (cfg *apiConfig) handlerDetailChirp(w http.ResponseWriter, r *http.Request) {
-	id := r.PathValue("chirpId")
-	chirpId, err := strconv.Atoi(id)
+func (cfg *apiConfig) handlerDetailChirp(w http.ResponseWriter, r *http.Request) error {
+	chirpId, err := strconv.Atoi(r.PathValue("chirpId"))
 	if err != nil {
-		log.Printf("Error converting int to string: %v", err)
-		w.WriteHeader(500)
-		return
+		return invalid("Invalid chirp ID", err)
 	}
 
-	data, err := cfg.DB.LoadDB()
+	data, err := cfg.DB.WithContext(r.Context()).LoadDB()
 	if err != nil {
-		log.Printf("Error load DB: %v", err)
-		w.WriteHeader(500)
-		return
+		return internalError("Couldn't retrieve chirp", err)
 	}
 
-	var getChirp database.Chirp
-	for _, chirp := range data.Chirps {
-		if chirp.Id == chirpId {
-			getChirp = chirp
-		}
-	}
-
-	if getChirp == (database.Chirp{}) {
-		w.WriteHeader(404)
-		return
-	}
-
-	chirpJson, err := json.Marshal(getChirp)
-	if err != nil {
-		log.Printf("Error marshal chirp: %v", err)
-		w.WriteHeader(500)
-		return
+	chirp, exists := data.Chirps[chirpId]
+	if !exists {
+		return notFound("Chirp not found", nil)
 	}
 
-	w.WriteHeader(200)
-	w.Write(chirpJson)
+	respondWithJSON(w, r, http.StatusOK, chirp)
+	return nil
 }
 
 func (cfg *apiConfig) handlerChirpsRetrieve(w http.ResponseWriter, r *http.Request) {
@@ -146,9 +133,9 @@ func (cfg *apiConfig) handlerChirpsRetrieve(w http.ResponseWriter, r *http.Reque
 		sortFilter = "asc"
 	}
 
-	dbChirps, err := cfg.DB.GetChirps(author_id)
+	dbChirps, err := cfg.DB.WithContext(r.Context()).GetChirps(author_id)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve chirps")
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't retrieve chirps")
 		return
 	}
 
@@ -170,57 +157,102 @@ func (cfg *apiConfig) handlerChirpsRetrieve(w http.ResponseWriter, r *http.Reque
 		return chirps[i].ID < chirps[j].ID
 	})
 
-	respondWithJSON(w, http.StatusOK, chirps)
+	respondWithJSON(w, r, http.StatusOK, chirps)
 }
 
-func (cfg *apiConfig) handlerDeleteChirp(w http.ResponseWriter, r *http.Request) {
-	chirpIdVal := r.PathValue("chirpId")
-	chirpId, err := strconv.Atoi(chirpIdVal)
+func (cfg *apiConfig) handlerUpdateChirp(w http.ResponseWriter, r *http.Request) error {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		return unauthorized("", nil)
+	}
+
+	chirpId, err := strconv.Atoi(r.PathValue("chirpId"))
 	if err != nil {
-		log.Printf("Error converting int to string: %v", err)
-		w.WriteHeader(500)
-		return
+		return invalid("Invalid chirp ID", err)
 	}
 
-	header := r.Header.Get("Authorization")
-	if header == "" || !strings.HasPrefix(header, "Bearer ") {
-		log.Println("Authorization header is missing or improperly formatted")
-		w.WriteHeader(http.StatusUnauthorized)
-		return
+	user, err := cfg.DB.WithContext(r.Context()).GetUserById(principal.UserID)
+	if err != nil {
+		return unauthorized("The account no longer exists", err)
 	}
-	token := strings.Split(header, " ")[1]
 
-	claims, err := ValidateToken(token)
+	plan, _ := cfg.Entitlements.For(user)
+	err = cfg.Entitlements.check(plan, "Editing chirps", func(e Entitlements) bool {
+		return e.EditAllowed
+	})
 	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
+		return err
 	}
 
-	userId, err := claims.GetSubject()
+	type parameters struct {
+		Body string `json:"body"`
+	}
+
+	params := parameters{}
+	err = json.NewDecoder(r.Body).Decode(&params)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't get subject from claims")
-		return
+		return invalid("Couldn't decode parameters", err)
 	}
 
-	userIdInt, _ := strconv.Atoi(userId)
+	cleaned, err := validateChirp(params.Body, plan, cfg.Entitlements)
+	var entErr *entitlementError
+	if errors.As(err, &entErr) {
+		return err
+	}
+	if err != nil {
+		return invalid(err.Error(), err)
+	}
 
-	chirp, err := cfg.DB.GetChirpById(chirpId)
+	chirp, err := cfg.DB.WithContext(r.Context()).UpdateChirp(chirpId, principal.UserID, cleaned)
+	if errors.Is(err, database.ErrChirpNotFound) {
+		return notFound("Chirp not found", err)
+	}
+	if errors.Is(err, database.ErrNotChirpAuthor) {
+		return forbidden("You can only edit your own chirps")
+	}
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't get chirp")
-		return
+		return internalError("Couldn't update chirp", err)
 	}
 
-	if userIdInt != chirp.AuthorId {
-		w.WriteHeader(403)
-		return
+	respondWithJSON(w, r, http.StatusOK, Chirp{
+		ID:       chirp.Id,
+		Body:     chirp.Body,
+		AuthorId: chirp.AuthorId,
+	})
+	return nil
+}
+
+func (cfg *apiConfig) handlerDeleteChirp(w http.ResponseWriter, r *http.Request) error {
+	chirpId, err := strconv.Atoi(r.PathValue("chirpId"))
+	if err != nil {
+		return invalid("Invalid chirp ID", err)
+	}
+
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		return unauthorized("", nil)
+	}
+
+	chirp, err := cfg.DB.WithContext(r.Context()).GetChirpById(chirpId)
+	if errors.Is(err, database.ErrChirpNotFound) {
+		return notFound("Chirp not found", err)
+	}
+	if err != nil {
+		return internalError("Couldn't get chirp", err)
 	}
 
-	err = cfg.DB.DeleteChirp(chirp)
+	if principal.UserID != chirp.AuthorId {
+		return forbidden("You can only delete your own chirps")
+	}
+
+	err = cfg.DB.WithContext(r.Context()).DeleteChirp(chirp)
+	if errors.Is(err, database.ErrChirpNotFound) {
+		return notFound("Chirp not found", err)
+	}
 	if err != nil {
-		log.Fatalf("erro delete chirp: %v", err)
-		w.WriteHeader(500)
-		return
+		return internalError("Couldn't delete chirp", err)
 	}
 
-	w.WriteHeader(204)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
 }
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+)
+
+// errorKind classifies the errors that handlers return, which decides the
+// status code of the response.
+type errorKind int
+
+const (
+	kindInternal errorKind = iota
+	kindValidation
+	kindUnauthorized
+	kindForbidden
+	kindNotFound
+	kindConflict
+	kindTooLarge
+)
+
+var kindStatus = map[errorKind]int{
+	kindInternal:     http.StatusInternalServerError,
+	kindValidation:   http.StatusBadRequest,
+	kindUnauthorized: http.StatusUnauthorized,
+	kindForbidden:    http.StatusForbidden,
+	kindNotFound:     http.StatusNotFound,
+	kindConflict:     http.StatusConflict,
+	kindTooLarge:     http.StatusRequestEntityTooLarge,
+}
+
+// apiError is an error whose message can be shown to the client. The
+// wrapped error, if any, is only logged.
+type apiError struct {
+	kind    errorKind
+	msg     string
+	details []fieldError
+	err     error
+}
+
+func (e *apiError) Error() string {
+	if e.err == nil {
+		return e.msg
+	}
+	return fmt.Sprintf("%s: %v", e.msg, e.err)
+}
+
+func (e *apiError) Unwrap() error {
+	return e.err
+}
+
+func invalid(msg string, err error) error {
+	return &apiError{kind: kindValidation, msg: msg, err: err}
+}
+
+func invalidFields(errs []fieldError) error {
+	return &apiError{kind: kindValidation, msg: "Validation failed", details: errs}
+}
+
+// unauthorized means the request lacks valid credentials. An empty msg
+// means no credentials were sent.
+func unauthorized(msg string, err error) error {
+	return &apiError{kind: kindUnauthorized, msg: msg, err: err}
+}
+
+func forbidden(msg string) error {
+	return &apiError{kind: kindForbidden, msg: msg}
+}
+
+func notFound(msg string, err error) error {
+	return &apiError{kind: kindNotFound, msg: msg, err: err}
+}
+
+func conflict(msg string, err error) error {
+	return &apiError{kind: kindConflict, msg: msg, err: err}
+}
+
+// tooLarge means the request body exceeds a limit.
+func tooLarge(msg string, err error) error {
+	return &apiError{kind: kindTooLarge, msg: msg, err: err}
+}
+
+// internalError is a failure of the server. Only msg is shown to the
+// client; err is logged.
+func internalError(msg string, err error) error {
+	return &apiError{kind: kindInternal, msg: msg, err: err}
+}
+
+// apiHandler is a handler that returns its errors instead of writing them,
+// see handleErrors.
+type apiHandler func(w http.ResponseWriter, r *http.Request) error
+
+// handleErrors adapts h to an http.HandlerFunc that writes the errors
+// returned by h as responses. Errors that aren't an apiError are treated as
+// internal.
+func handleErrors(h apiHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := h(w, r)
+		if err != nil {
+			respondWithAPIError(w, r, err)
+		}
+	}
+}
+
+func respondWithAPIError(w http.ResponseWriter, r *http.Request, err error) {
+	// These errors carry more than a message and keep their own responses.
+	var entErr *entitlementError
+	if errors.As(err, &entErr) {
+		respondWithEntitlementError(w, r, entErr)
+		return
+	}
+	var locked *loginLockedError
+	if errors.As(err, &locked) {
+		respondWithLoginLocked(w, r, locked)
+		return
+	}
+
+	apiErr := &apiError{}
+	if !errors.As(err, &apiErr) {
+		apiErr = &apiError{kind: kindInternal, msg: "Something went wrong", err: err}
+	}
+
+	if apiErr.kind == kindInternal {
+		slog.ErrorContext(r.Context(), "Request failed", "error", err)
+	} else if apiErr.err != nil {
+		slog.DebugContext(r.Context(), "Request rejected", "error", err)
+	}
+
+	switch {
+	case apiErr.kind == kindUnauthorized && apiErr.msg == "":
+		respondWithAuthError(w, r, http.StatusUnauthorized, "", "")
+	case apiErr.kind == kindUnauthorized:
+		respondWithAuthError(w, r, http.StatusUnauthorized, "invalid_token", apiErr.msg)
+	case len(apiErr.details) > 0:
+		respondWithValidationError(w, r, apiErr.details)
+	default:
+		respondWithError(w, r, kindStatus[apiErr.kind], apiErr.msg)
+	}
+}
+
+// middlewareRecover turns a panic in a handler into a 500 response, so that
+// one bad request doesn't take the server down, and logs it with its stack.
+// If the handler had already started its response, the response is left as
+// it is.
+func middlewareRecover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			// Handlers panic with ErrAbortHandler to drop the connection.
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			slog.ErrorContext(r.Context(), "Handler panicked", "panic", fmt.Sprint(v), "stack", string(debug.Stack()))
+			if rec.status != 0 {
+				return
+			}
+			respondWithError(w, r, http.StatusInternalServerError, "Something went wrong")
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
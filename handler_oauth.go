@@ -0,0 +1,619 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Raihanki/Chirpy/internal/database"
+)
+
+const (
+	oauthCodeTTL             = 10 * time.Minute
+	maxOAuthClientNameLength = 100
+	maxOAuthRedirectURIs     = 10
+	pkceMethodS256           = "S256"
+)
+
+// scopeDescriptions are shown to the user on the consent page.
+var scopeDescriptions = map[string]string{
+	scopeChirpsRead:  "Read chirps",
+	scopeChirpsWrite: "Post and delete chirps on your behalf",
+}
+
+type OAuthClient struct {
+	ClientID     string    `json:"client_id"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Public       bool      `json:"public"`
+	CreatedAt    time.Time `json:"created_at"`
+	// ClientSecret is only set in the response to registering a
+	// confidential client.
+	ClientSecret string `json:"client_secret,omitempty"`
+}
+
+func oauthClientFromDB(c database.OAuthClient) OAuthClient {
+	return OAuthClient{
+		ClientID:     c.ID,
+		Name:         c.Name,
+		RedirectURIs: c.RedirectURIs,
+		Public:       c.Public(),
+		CreatedAt:    c.CreatedAt,
+	}
+}
+
+// validRedirectURI accepts absolute https URIs, and plain http only for
+// loopback addresses used by native apps.
+func validRedirectURI(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || u.Fragment != "" {
+		return false
+	}
+	switch u.Scheme {
+	case "https":
+		return true
+	case "http":
+		host := u.Hostname()
+		if host == "localhost" {
+			return true
+		}
+		ip := net.ParseIP(host)
+		return ip != nil && ip.IsLoopback()
+	}
+	return false
+}
+
+func (cfg *apiConfig) handlerOAuthClientCreate(w http.ResponseWriter, r *http.Request) {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		respondWithAuthError(w, r, http.StatusUnauthorized, "", "")
+		return
+	}
+
+	type parameters struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Public       bool     `json:"public"`
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	errs := []fieldError{}
+	name := strings.TrimSpace(params.Name)
+	if name == "" || len(name) > maxOAuthClientNameLength {
+		errs = append(errs, fieldError{Field: "name", Message: "Name is required and must be at most 100 characters long"})
+	}
+
+	if len(params.RedirectURIs) == 0 || len(params.RedirectURIs) > maxOAuthRedirectURIs {
+		errs = append(errs, fieldError{Field: "redirect_uris", Message: "Between 1 and 10 redirect URIs are required"})
+	}
+	for _, uri := range params.RedirectURIs {
+		if !validRedirectURI(uri) {
+			errs = append(errs, fieldError{Field: "redirect_uris", Message: "Redirect URI " + uri + " must be an absolute https URI, or http on a loopback address, without a fragment"})
+		}
+	}
+
+	if len(errs) > 0 {
+		respondWithValidationError(w, r, errs)
+		return
+	}
+
+	secret := ""
+	if !params.Public {
+		secret, err = generateSecureToken()
+		if err != nil {
+			respondWithError(w, r, http.StatusInternalServerError, "Couldn't generate client secret")
+			return
+		}
+	}
+
+	dbClient, err := cfg.DB.WithContext(r.Context()).CreateOAuthClient(principal.UserID, name, params.RedirectURIs, secret)
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't register client")
+		return
+	}
+
+	client := oauthClientFromDB(dbClient)
+	client.ClientSecret = secret
+	respondWithJSON(w, r, http.StatusCreated, client)
+}
+
+func (cfg *apiConfig) handlerOAuthClientsList(w http.ResponseWriter, r *http.Request) {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		respondWithAuthError(w, r, http.StatusUnauthorized, "", "")
+		return
+	}
+
+	dbClients, err := cfg.DB.WithContext(r.Context()).GetOAuthClients(principal.UserID)
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't retrieve clients")
+		return
+	}
+
+	clients := []OAuthClient{}
+	for _, dbClient := range dbClients {
+		clients = append(clients, oauthClientFromDB(dbClient))
+	}
+
+	respondWithJSON(w, r, http.StatusOK, clients)
+}
+
+func (cfg *apiConfig) handlerOAuthClientDelete(w http.ResponseWriter, r *http.Request) {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		respondWithAuthError(w, r, http.StatusUnauthorized, "", "")
+		return
+	}
+
+	err := cfg.DB.WithContext(r.Context()).DeleteOAuthClient(principal.UserID, r.PathValue("clientId"))
+	if errors.Is(err, database.ErrOAuthClientNotFound) {
+		respondWithError(w, r, http.StatusNotFound, "Client not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't delete client")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// oauthError is an error response as defined by RFC 6749, section 5.2.
+type oauthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func respondWithOAuthError(w http.ResponseWriter, r *http.Request, code int, e oauthError) {
+	if code == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="chirpy"`)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, r, code, e)
+}
+
+// authorizationRequest holds the parameters of an authorization request. They
+// are carried from the query string through the consent form.
+type authorizationRequest struct {
+	ResponseType        string
+	ClientID            string
+	RedirectURI         string
+	Scope               string
+	State               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+func authorizationRequestFrom(values url.Values) authorizationRequest {
+	return authorizationRequest{
+		ResponseType:        values.Get("response_type"),
+		ClientID:            values.Get("client_id"),
+		RedirectURI:         values.Get("redirect_uri"),
+		Scope:               values.Get("scope"),
+		State:               values.Get("state"),
+		CodeChallenge:       values.Get("code_challenge"),
+		CodeChallengeMethod: values.Get("code_challenge_method"),
+	}
+}
+
+// scopes returns the requested scopes, defaulting to read access.
+func (req authorizationRequest) scopes() ([]string, *oauthError) {
+	requested := strings.Fields(req.Scope)
+	if len(requested) == 0 {
+		return []string{scopeChirpsRead}, nil
+	}
+
+	scopes := []string{}
+	for _, scope := range requested {
+		if !slices.Contains(grantableScopes, scope) {
+			return nil, &oauthError{Code: "invalid_scope", Description: "Unknown scope " + scope}
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes, nil
+}
+
+func (req authorizationRequest) validate() ([]string, *oauthError) {
+	if req.ResponseType != "code" {
+		return nil, &oauthError{Code: "unsupported_response_type", Description: "Only the code response type is supported"}
+	}
+	// A SHA-256 challenge is 32 bytes, base64url encoded without padding.
+	if req.CodeChallengeMethod != pkceMethodS256 || len(req.CodeChallenge) != 43 {
+		return nil, &oauthError{Code: "invalid_request", Description: "A PKCE code_challenge with method S256 is required"}
+	}
+	return req.scopes()
+}
+
+// redirectToClient sends the user agent back to the client's redirect URI
+// with params added to its query. Empty params, such as a missing state, are
+// left out.
+func redirectToClient(w http.ResponseWriter, r *http.Request, redirectURI string, params url.Values) {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't build redirect")
+		return
+	}
+	query := u.Query()
+	for key := range params {
+		if params.Get(key) != "" {
+			query.Set(key, params.Get(key))
+		}
+	}
+	u.RawQuery = query.Encode()
+	http.Redirect(w, r, u.String(), http.StatusSeeOther)
+}
+
+// resolveAuthorizationRequest looks up the client and validates the request.
+// A bad client or redirect URI is reported to the user, since redirecting to
+// an unregistered URI would make Chirpy an open redirector; other errors are
+// returned to the client. It returns false once it has responded.
+func (cfg *apiConfig) resolveAuthorizationRequest(w http.ResponseWriter, r *http.Request, req authorizationRequest) (database.OAuthClient, []string, bool) {
+	client, err := cfg.DB.WithContext(r.Context()).GetOAuthClient(req.ClientID)
+	if err != nil && !errors.Is(err, database.ErrOAuthClientNotFound) {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't get client")
+		return database.OAuthClient{}, nil, false
+	}
+	if err != nil || !slices.Contains(client.RedirectURIs, req.RedirectURI) {
+		respondWithError(w, r, http.StatusBadRequest, "Unknown client or redirect URI")
+		return database.OAuthClient{}, nil, false
+	}
+
+	scopes, oauthErr := req.validate()
+	if oauthErr != nil {
+		redirectToClient(w, r, req.RedirectURI, url.Values{
+			"error":             {oauthErr.Code},
+			"error_description": {oauthErr.Description},
+			"state":             {req.State},
+		})
+		return database.OAuthClient{}, nil, false
+	}
+
+	return client, scopes, true
+}
+
+// consentPage is the data rendered into consent.html.
+type consentPage struct {
+	ClientName string
+	Scopes     []string
+	Request    authorizationRequest
+	Email      string
+	Error      string
+}
+
+func (cfg *apiConfig) renderConsent(w http.ResponseWriter, r *http.Request, code int, page consentPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	// The page takes the user's password, so it must not be framed.
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	w.WriteHeader(code)
+
+	err := cfg.ConsentTemplate.Execute(w, page)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Couldn't render consent page", "error", err)
+	}
+}
+
+func newConsentPage(client database.OAuthClient, scopes []string, req authorizationRequest) consentPage {
+	descriptions := []string{}
+	for _, scope := range scopes {
+		descriptions = append(descriptions, scopeDescriptions[scope])
+	}
+	return consentPage{
+		ClientName: client.Name,
+		Scopes:     descriptions,
+		Request:    req,
+	}
+}
+
+func (cfg *apiConfig) handlerOAuthAuthorize(w http.ResponseWriter, r *http.Request) {
+	req := authorizationRequestFrom(r.URL.Query())
+	client, scopes, ok := cfg.resolveAuthorizationRequest(w, r, req)
+	if !ok {
+		return
+	}
+
+	cfg.renderConsent(w, r, http.StatusOK, newConsentPage(client, scopes, req))
+}
+
+// handlerOAuthConsent handles the consent form. The user signs in on the
+// form itself, so no Chirpy credentials ever reach the client.
+func (cfg *apiConfig) handlerOAuthConsent(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, "Couldn't decode form")
+		return
+	}
+
+	req := authorizationRequestFrom(r.PostForm)
+	client, scopes, ok := cfg.resolveAuthorizationRequest(w, r, req)
+	if !ok {
+		return
+	}
+
+	if r.PostForm.Get("decision") != "approve" {
+		redirectToClient(w, r, req.RedirectURI, url.Values{
+			"error":             {"access_denied"},
+			"error_description": {"The user denied the request"},
+			"state":             {req.State},
+		})
+		return
+	}
+
+	page := newConsentPage(client, scopes, req)
+	page.Email = r.PostForm.Get("email")
+
+	user, err := cfg.verifyPassword(r, page.Email, r.PostForm.Get("password"))
+	var locked *loginLockedError
+	if errors.As(err, &locked) {
+		page.Error = "Too many failed login attempts, try again later."
+		cfg.renderConsent(w, r, http.StatusTooManyRequests, page)
+		return
+	}
+	if errors.Is(err, errInvalidCredentials) {
+		page.Error = "Incorrect email or password."
+		cfg.renderConsent(w, r, http.StatusUnauthorized, page)
+		return
+	}
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't sign in")
+		return
+	}
+
+	if user.TOTPEnabled {
+		err = cfg.beginLoginAttempt(r, user.Email)
+		if errors.As(err, &locked) {
+			page.Error = "Too many failed login attempts, try again later."
+			cfg.renderConsent(w, r, http.StatusTooManyRequests, page)
+			return
+		}
+		if err != nil {
+			respondWithError(w, r, http.StatusInternalServerError, "Couldn't sign in")
+			return
+		}
+
+		err = cfg.verifySecondFactor(r.Context(), user, r.PostForm.Get("code"))
+		if errors.Is(err, errSecondFactorInvalid) {
+			page.Error = "Enter a valid two-factor code."
+			cfg.renderConsent(w, r, http.StatusUnauthorized, page)
+			return
+		}
+		if err != nil {
+			respondWithError(w, r, http.StatusInternalServerError, "Couldn't verify two-factor code")
+			return
+		}
+		cfg.loginSucceeded(r, user.Email)
+	}
+
+	code, err := generateSecureToken()
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't generate authorization code")
+		return
+	}
+
+	err = cfg.DB.WithContext(r.Context()).CreateAuthorizationCode(code, database.AuthorizationCode{
+		ClientID:      client.ID,
+		UserID:        user.ID,
+		RedirectURI:   req.RedirectURI,
+		Scopes:        scopes,
+		CodeChallenge: req.CodeChallenge,
+		ExpiresAt:     time.Now().UTC().Add(oauthCodeTTL),
+	})
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't create authorization code")
+		return
+	}
+
+	redirectToClient(w, r, req.RedirectURI, url.Values{
+		"code":  {code},
+		"state": {req.State},
+	})
+}
+
+// verifyCodeVerifier checks a PKCE code verifier against its S256 challenge.
+func verifyCodeVerifier(challenge, verifier string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// authenticateOAuthClient reads client credentials from HTTP Basic auth or,
+// failing that, from the client_id and client_secret form fields.
+func (cfg *apiConfig) authenticateOAuthClient(r *http.Request) (database.OAuthClient, error) {
+	id, secret, ok := r.BasicAuth()
+	if ok {
+		var err error
+		id, err = url.QueryUnescape(id)
+		if err != nil {
+			return database.OAuthClient{}, err
+		}
+		secret, err = url.QueryUnescape(secret)
+		if err != nil {
+			return database.OAuthClient{}, err
+		}
+	} else {
+		id = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+
+	return cfg.DB.WithContext(r.Context()).AuthenticateOAuthClient(id, secret)
+}
+
+func (cfg *apiConfig) handlerOAuthToken(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		respondWithOAuthError(w, r, http.StatusBadRequest, oauthError{Code: "invalid_request", Description: "Couldn't decode form"})
+		return
+	}
+
+	client, err := cfg.authenticateOAuthClient(r)
+	if err != nil {
+		respondWithOAuthError(w, r, http.StatusUnauthorized, oauthError{Code: "invalid_client", Description: "Client authentication failed"})
+		return
+	}
+
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		cfg.exchangeAuthorizationCode(w, r, client)
+	case "refresh_token":
+		cfg.refreshOAuthToken(w, r, client)
+	default:
+		respondWithOAuthError(w, r, http.StatusBadRequest, oauthError{Code: "unsupported_grant_type"})
+	}
+}
+
+func (cfg *apiConfig) exchangeAuthorizationCode(w http.ResponseWriter, r *http.Request, client database.OAuthClient) {
+	invalidGrant := oauthError{Code: "invalid_grant", Description: "The authorization code is invalid or expired"}
+
+	grant, err := cfg.DB.WithContext(r.Context()).ConsumeAuthorizationCode(r.PostForm.Get("code"))
+	if errors.Is(err, database.ErrAuthorizationInvalid) {
+		respondWithOAuthError(w, r, http.StatusBadRequest, invalidGrant)
+		return
+	}
+	if err != nil {
+		respondWithOAuthError(w, r, http.StatusInternalServerError, oauthError{Code: "server_error"})
+		return
+	}
+
+	if grant.ClientID != client.ID || grant.RedirectURI != r.PostForm.Get("redirect_uri") {
+		respondWithOAuthError(w, r, http.StatusBadRequest, invalidGrant)
+		return
+	}
+	if !verifyCodeVerifier(grant.CodeChallenge, r.PostForm.Get("code_verifier")) {
+		respondWithOAuthError(w, r, http.StatusBadRequest, oauthError{Code: "invalid_grant", Description: "The code verifier doesn't match the code challenge"})
+		return
+	}
+
+	_, err = cfg.DB.WithContext(r.Context()).GetUserById(grant.UserID)
+	if errors.Is(err, database.ErrUserNotFound) {
+		respondWithOAuthError(w, r, http.StatusBadRequest, invalidGrant)
+		return
+	}
+	if err != nil {
+		respondWithOAuthError(w, r, http.StatusInternalServerError, oauthError{Code: "server_error"})
+		return
+	}
+
+	refreshToken, err := generateSecureToken()
+	if err != nil {
+		respondWithOAuthError(w, r, http.StatusInternalServerError, oauthError{Code: "server_error"})
+		return
+	}
+
+	session, err := cfg.DB.WithContext(r.Context()).CreateClientSession(grant.UserID, client, grant.Scopes, clientIP(r), r.UserAgent(), refreshToken, cfg.TokenPolicy.RefreshExpiresAt())
+	if err != nil {
+		respondWithOAuthError(w, r, http.StatusInternalServerError, oauthError{Code: "server_error"})
+		return
+	}
+
+	cfg.respondWithOAuthTokens(w, r, session, refreshToken)
+}
+
+func (cfg *apiConfig) refreshOAuthToken(w http.ResponseWriter, r *http.Request, client database.OAuthClient) {
+	refreshToken, err := generateSecureToken()
+	if err != nil {
+		respondWithOAuthError(w, r, http.StatusInternalServerError, oauthError{Code: "server_error"})
+		return
+	}
+
+	session, err := cfg.DB.WithContext(r.Context()).RotateRefreshToken(client.ID, r.PostForm.Get("refresh_token"), refreshToken, cfg.TokenPolicy.RefreshExpiresAt())
+	if errors.Is(err, database.ErrRefreshTokenReused) {
+		slog.WarnContext(r.Context(), "Refresh token reuse detected, session revoked", "client_id", client.ID)
+	}
+	if errors.Is(err, database.ErrRefreshTokenNotFound) || errors.Is(err, database.ErrRefreshTokenExpired) || errors.Is(err, database.ErrRefreshTokenReused) {
+		respondWithOAuthError(w, r, http.StatusBadRequest, oauthError{Code: "invalid_grant", Description: "The refresh token is invalid or expired"})
+		return
+	}
+	if err != nil {
+		respondWithOAuthError(w, r, http.StatusInternalServerError, oauthError{Code: "server_error"})
+		return
+	}
+
+	cfg.respondWithOAuthTokens(w, r, session, refreshToken)
+}
+
+// respondWithOAuthTokens issues an access token limited to the scopes the
+// user granted to the session's client.
+func (cfg *apiConfig) respondWithOAuthTokens(w http.ResponseWriter, r *http.Request, session database.Session, refreshToken string) {
+	exp := cfg.TokenPolicy.ExpiresIn(nil)
+	jwtConfig := JwtConfig{
+		Issuer:    "chirpy",
+		ExpiresAt: exp,
+		Subject:   strconv.Itoa(session.UserID),
+		Scopes:    session.Scopes,
+		SessionId: session.ID,
+		ClientId:  session.ClientID,
+	}
+	token, err := jwtConfig.generateToken(cfg.Keys)
+	if err != nil {
+		respondWithOAuthError(w, r, http.StatusInternalServerError, oauthError{Code: "server_error"})
+		return
+	}
+
+	type response struct {
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		ExpiresIn    int    `json:"expires_in"`
+		RefreshToken string `json:"refresh_token"`
+		Scope        string `json:"scope"`
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, r, http.StatusOK, response{
+		AccessToken:  token,
+		TokenType:    "Bearer",
+		ExpiresIn:    exp,
+		RefreshToken: refreshToken,
+		Scope:        strings.Join(session.Scopes, " "),
+	})
+}
+
+// handlerOAuthRevoke implements RFC 7009. Revoking either token ends the
+// grant's session; access tokens themselves stay valid until they expire.
+func (cfg *apiConfig) handlerOAuthRevoke(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		respondWithOAuthError(w, r, http.StatusBadRequest, oauthError{Code: "invalid_request", Description: "Couldn't decode form"})
+		return
+	}
+
+	client, err := cfg.authenticateOAuthClient(r)
+	if err != nil {
+		respondWithOAuthError(w, r, http.StatusUnauthorized, oauthError{Code: "invalid_client", Description: "Client authentication failed"})
+		return
+	}
+
+	token := r.PostForm.Get("token")
+	claims, err := ValidateToken(cfg.Keys, token)
+	if err == nil && claims.ClientId == client.ID {
+		err = cfg.DB.WithContext(r.Context()).RevokeClientSession(client.ID, claims.SessionId)
+	} else {
+		err = cfg.DB.WithContext(r.Context()).RevokeClientRefreshToken(client.ID, token)
+	}
+	if err != nil {
+		respondWithOAuthError(w, r, http.StatusInternalServerError, oauthError{Code: "server_error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
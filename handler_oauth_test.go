@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+const (
+	oauthTestEmail    = "oauth@example.com"
+	oauthTestPassword = "correct horse battery"
+	oauthRedirectURI  = "https://client.example.com/callback"
+	oauthVerifier     = "verifier-verifier-verifier-verifier-verifier"
+)
+
+// oauthTest is a registered confidential client and its owner.
+type oauthTest struct {
+	t            *testing.T
+	h            http.Handler
+	clientId     string
+	clientSecret string
+}
+
+func newOAuthTest(t *testing.T) *oauthTest {
+	t.Helper()
+
+	cfg := newTestConfig(t)
+	h := cfg.routes(t.TempDir())
+	token, _ := signUpAndLogin(t, h, oauthTestEmail, oauthTestPassword)
+
+	res, body := doJSON(t, h, http.MethodPost, "/api/oauth/clients", token, map[string]any{
+		"name":          "Test client",
+		"redirect_uris": []string{oauthRedirectURI},
+	})
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("register client: status %d: %s", res.StatusCode, body)
+	}
+	client := OAuthClient{}
+	err := json.Unmarshal(body, &client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &oauthTest{t: t, h: h, clientId: client.ClientID, clientSecret: client.ClientSecret}
+}
+
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// authorizeForm is the consent form as submitted by the user approving
+// scope for redirectURI.
+func (o *oauthTest) authorizeForm(redirectURI, scope string) url.Values {
+	return url.Values{
+		"response_type":         {"code"},
+		"client_id":             {o.clientId},
+		"redirect_uri":          {redirectURI},
+		"scope":                 {scope},
+		"state":                 {"xyz"},
+		"code_challenge":        {codeChallenge(oauthVerifier)},
+		"code_challenge_method": {pkceMethodS256},
+		"email":                 {oauthTestEmail},
+		"password":              {oauthTestPassword},
+		"decision":              {"approve"},
+	}
+}
+
+// authorize approves a request for scope and returns the authorization code.
+func (o *oauthTest) authorize(scope string) string {
+	o.t.Helper()
+
+	res, body := doForm(o.t, o.h, "/oauth/authorize", o.authorizeForm(oauthRedirectURI, scope))
+	if res.StatusCode != http.StatusSeeOther {
+		o.t.Fatalf("authorize: status %d: %s", res.StatusCode, body)
+	}
+	location, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		o.t.Fatal(err)
+	}
+	if location.Query().Get("state") != "xyz" {
+		o.t.Errorf("redirect %s doesn't carry the state", location)
+	}
+	code := location.Query().Get("code")
+	if code == "" {
+		o.t.Fatalf("redirect %s has no code", location)
+	}
+	return code
+}
+
+type oauthTokens struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+	Error        string `json:"error"`
+}
+
+// token posts a token request with the client's credentials.
+func (o *oauthTest) token(form url.Values) (int, oauthTokens) {
+	o.t.Helper()
+
+	form.Set("client_id", o.clientId)
+	form.Set("client_secret", o.clientSecret)
+	res, body := doForm(o.t, o.h, "/oauth/token", form)
+	tokens := oauthTokens{}
+	err := json.Unmarshal(body, &tokens)
+	if err != nil {
+		o.t.Fatalf("token response is not JSON: %q", body)
+	}
+	return res.StatusCode, tokens
+}
+
+func (o *oauthTest) exchange(code, redirectURI, verifier string) (int, oauthTokens) {
+	return o.token(url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"code_verifier": {verifier},
+	})
+}
+
+func TestOAuthCodeExchange(t *testing.T) {
+	o := newOAuthTest(t)
+
+	tests := []struct {
+		name        string
+		redirectURI string
+		verifier    string
+		status      int
+	}{
+		{"valid", oauthRedirectURI, oauthVerifier, http.StatusOK},
+		{"wrong verifier", oauthRedirectURI, oauthVerifier + "x", http.StatusBadRequest},
+		{"missing verifier", oauthRedirectURI, "", http.StatusBadRequest},
+		{"challenge as verifier", oauthRedirectURI, codeChallenge(oauthVerifier), http.StatusBadRequest},
+		{"different redirect URI", "https://client.example.com/other", oauthVerifier, http.StatusBadRequest},
+		{"redirect URI with trailing slash", oauthRedirectURI + "/", oauthVerifier, http.StatusBadRequest},
+		{"missing redirect URI", "", oauthVerifier, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code := o.authorize(scopeChirpsRead)
+
+			status, tokens := o.exchange(code, tt.redirectURI, tt.verifier)
+			if status != tt.status {
+				t.Fatalf("status %d, want %d: %+v", status, tt.status, tokens)
+			}
+			if status != http.StatusOK {
+				if tokens.Error != "invalid_grant" {
+					t.Errorf("error = %q, want invalid_grant", tokens.Error)
+				}
+				return
+			}
+			if tokens.AccessToken == "" || tokens.RefreshToken == "" {
+				t.Errorf("missing tokens in %+v", tokens)
+			}
+
+			// Codes are single use.
+			status, tokens = o.exchange(code, tt.redirectURI, tt.verifier)
+			if status != http.StatusBadRequest || tokens.Error != "invalid_grant" {
+				t.Errorf("second exchange: status %d, error %q, want %d invalid_grant", status, tokens.Error, http.StatusBadRequest)
+			}
+		})
+	}
+
+	// A failed exchange uses the code up as well.
+	code := o.authorize(scopeChirpsRead)
+	o.exchange(code, oauthRedirectURI, "wrong-verifier-wrong-verifier-wrong-verifier")
+	status, _ := o.exchange(code, oauthRedirectURI, oauthVerifier)
+	if status != http.StatusBadRequest {
+		t.Errorf("exchange after a failed attempt: status %d, want %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestOAuthAuthorizeRequiresExactRedirectURI(t *testing.T) {
+	o := newOAuthTest(t)
+
+	for _, redirectURI := range []string{
+		"https://client.example.com/callback/",
+		"https://client.example.com/callback?next=/",
+		"https://CLIENT.example.com/callback",
+		"http://client.example.com/callback",
+		"https://evil.example.com/callback",
+	} {
+		t.Run(redirectURI, func(t *testing.T) {
+			form := o.authorizeForm(redirectURI, scopeChirpsRead)
+
+			// Neither the consent page nor the form redirects to an
+			// unregistered URI.
+			res, body := doJSON(t, o.h, http.MethodGet, "/oauth/authorize?"+form.Encode(), "", nil)
+			if res.StatusCode != http.StatusBadRequest || res.Header.Get("Location") != "" {
+				t.Errorf("GET: status %d, Location %q: %s", res.StatusCode, res.Header.Get("Location"), body)
+			}
+			res, body = doForm(t, o.h, "/oauth/authorize", form)
+			if res.StatusCode != http.StatusBadRequest || res.Header.Get("Location") != "" {
+				t.Errorf("POST: status %d, Location %q: %s", res.StatusCode, res.Header.Get("Location"), body)
+			}
+		})
+	}
+}
+
+func TestOAuthRefreshKeepsGrantedScopes(t *testing.T) {
+	o := newOAuthTest(t)
+
+	status, tokens := o.exchange(o.authorize(scopeChirpsRead), oauthRedirectURI, oauthVerifier)
+	if status != http.StatusOK {
+		t.Fatalf("exchange: status %d: %+v", status, tokens)
+	}
+
+	for i := 1; i <= 2; i++ {
+		status, tokens = o.token(url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {tokens.RefreshToken},
+			"scope":         {scopeChirpsRead + " " + scopeChirpsWrite},
+		})
+		if status != http.StatusOK {
+			t.Fatalf("refresh %d: status %d: %+v", i, status, tokens)
+		}
+		if tokens.Scope != scopeChirpsRead {
+			t.Errorf("refresh %d: scope %q, want %q", i, tokens.Scope, scopeChirpsRead)
+		}
+
+		res, body := doJSON(t, o.h, http.MethodPost, "/api/chirps", tokens.AccessToken, map[string]string{"body": "hello"})
+		if res.StatusCode != http.StatusForbidden {
+			t.Errorf("refresh %d: posting a chirp with a read-only token: status %d: %s", i, res.StatusCode, body)
+		}
+		res, body = doJSON(t, o.h, http.MethodGet, "/api/sessions", tokens.AccessToken, nil)
+		if res.StatusCode != http.StatusForbidden {
+			t.Errorf("refresh %d: account access with a client token: status %d: %s", i, res.StatusCode, body)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/Raihanki/Chirpy/internal/database"
+	"github.com/Raihanki/Chirpy/internal/mail"
+)
+
+func (cfg *apiConfig) handlerPasswordForgot(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Email string `json:"email"`
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	// Respond the same way whether or not the account exists so that this
+	// endpoint can't be used to discover registered emails.
+	email, fieldErr := normalizeEmail(params.Email)
+	if fieldErr != nil {
+		respondWithValidationError(w, r, []fieldError{*fieldErr})
+		return
+	}
+
+	// Requests count against the same limits as failed logins, so that
+	// this endpoint can't be used to flood an inbox.
+	until, err := cfg.DB.WithContext(r.Context()).BeginLoginAttempt(cfg.passwordResetPolicies(r, email))
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't check password reset requests")
+		return
+	}
+	if !until.IsZero() {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(until).Seconds()))))
+		respondWithError(w, r, http.StatusTooManyRequests, "Too many password reset requests, try again later")
+		return
+	}
+
+	user, err := cfg.DB.WithContext(r.Context()).GetUserByEmail(email)
+	if errors.Is(err, database.ErrUserNotFound) {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't look up user")
+		return
+	}
+
+	token, err := generateSecureToken()
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't generate reset token")
+		return
+	}
+
+	err = cfg.DB.WithContext(r.Context()).CreatePasswordReset(user.ID, token, time.Now().UTC().Add(cfg.PasswordResetTTL))
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't create password reset")
+		return
+	}
+
+	msg := mail.Message{
+		To:      user.Email,
+		Subject: "Reset your Chirpy password",
+		Body: fmt.Sprintf(
+			"Someone asked to reset the password for your Chirpy account.\n\n"+
+				"Use this link within %s to choose a new password:\n%s\n\n"+
+				"If this wasn't you, you can ignore this email.\n",
+			cfg.PasswordResetTTL, cfg.BaseURL+"/app/reset-password?token="+url.QueryEscape(token),
+		),
+	}
+	cfg.sendMail(r.Context(), msg)
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (cfg *apiConfig) handlerPasswordReset(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	fieldErr := cfg.PasswordPolicy.Validate(params.Password)
+	if fieldErr != nil {
+		respondWithValidationError(w, r, []fieldError{*fieldErr})
+		return
+	}
+
+	_, err = cfg.DB.WithContext(r.Context()).ResetPassword(params.Token, params.Password)
+	if errors.Is(err, database.ErrResetTokenInvalid) {
+		respondWithError(w, r, http.StatusBadRequest, "Reset token is invalid or expired")
+		return
+	}
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't reset password")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// passwordResetPage is the page a password reset email links to. It posts
+// the token and the new password back to handlerPasswordResetForm.
+type passwordResetPage struct {
+	Token string
+	Error string
+	Done  bool
+}
+
+func (cfg *apiConfig) renderPasswordReset(w http.ResponseWriter, r *http.Request, code int, page passwordResetPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	// The link carries the token, which must not leak to other sites.
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	// The page takes the user's password, so it must not be framed.
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	w.WriteHeader(code)
+
+	err := cfg.PasswordResetTemplate.Execute(w, page)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Couldn't render password reset page", "error", err)
+	}
+}
+
+func (cfg *apiConfig) handlerPasswordResetPage(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		cfg.renderPasswordReset(w, r, http.StatusBadRequest, passwordResetPage{Error: "This link is missing its reset token."})
+		return
+	}
+	cfg.renderPasswordReset(w, r, http.StatusOK, passwordResetPage{Token: token})
+}
+
+func (cfg *apiConfig) handlerPasswordResetForm(w http.ResponseWriter, r *http.Request) {
+	token := r.PostFormValue("token")
+	password := r.PostFormValue("password")
+
+	fieldErr := cfg.PasswordPolicy.Validate(password)
+	if fieldErr != nil {
+		cfg.renderPasswordReset(w, r, http.StatusBadRequest, passwordResetPage{Token: token, Error: fieldErr.Message})
+		return
+	}
+
+	_, err := cfg.DB.WithContext(r.Context()).ResetPassword(token, password)
+	if errors.Is(err, database.ErrResetTokenInvalid) {
+		cfg.renderPasswordReset(w, r, http.StatusBadRequest, passwordResetPage{Error: "This reset link is invalid or has expired. Request a new one."})
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Couldn't reset password", "error", err)
+		cfg.renderPasswordReset(w, r, http.StatusInternalServerError, passwordResetPage{Token: token, Error: "Something went wrong, try again."})
+		return
+	}
+
+	cfg.renderPasswordReset(w, r, http.StatusOK, passwordResetPage{Done: true})
+}
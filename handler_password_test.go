@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var resetLink = regexp.MustCompile(`http://chirpy\.test(/app/reset-password\?token=(\S+))`)
+
+func TestPasswordResetPage(t *testing.T) {
+	cfg := newTestConfig(t)
+	h := cfg.routes(t.TempDir())
+
+	const email = "reset@example.com"
+	signUpAndLogin(t, h, email, "correct horse battery")
+
+	res, body := doJSON(t, h, http.MethodPost, "/api/password/forgot", "", map[string]string{"email": email})
+	if res.StatusCode != http.StatusAccepted {
+		t.Fatalf("forgot: status %d: %s", res.StatusCode, body)
+	}
+	link := waitForMail(t, cfg, resetLink)
+	token, err := url.QueryUnescape(link[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The emailed link opens a form that posts the token back.
+	res, body = doJSON(t, h, http.MethodGet, link[1], "", nil)
+	if res.StatusCode != http.StatusOK || !strings.Contains(string(body), `action="/app/reset-password"`) {
+		t.Fatalf("GET reset page: status %d: %s", res.StatusCode, body)
+	}
+
+	res, body = doForm(t, h, "/app/reset-password", url.Values{"token": {token}, "password": {"short"}})
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("weak password: status %d: %s", res.StatusCode, body)
+	}
+
+	res, body = doForm(t, h, "/app/reset-password", url.Values{"token": {token}, "password": {"a brand new password"}})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("reset: status %d: %s", res.StatusCode, body)
+	}
+	res, _ = doJSON(t, h, http.MethodPost, "/api/login", "", map[string]string{"email": email, "password": "a brand new password"})
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("login with the new password: status %d", res.StatusCode)
+	}
+
+	// The token is single use.
+	res, _ = doForm(t, h, "/app/reset-password", url.Values{"token": {token}, "password": {"another new password"}})
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("reused token: status %d", res.StatusCode)
+	}
+}
+
+func TestPasswordForgotIsRateLimited(t *testing.T) {
+	cfg := newTestConfig(t)
+	h := cfg.routes(t.TempDir())
+
+	const email = "flood@example.com"
+	signUpAndLogin(t, h, email, "correct horse battery")
+
+	// The request that exceeds MaxFailures is still sent, and locks the
+	// address.
+	limit := cfg.LoginProtection.Account.MaxFailures + 1
+	for i := 0; i < limit; i++ {
+		res, body := doJSON(t, h, http.MethodPost, "/api/password/forgot", "", map[string]string{"email": email})
+		if res.StatusCode != http.StatusAccepted {
+			t.Fatalf("request %d: status %d: %s", i+1, res.StatusCode, body)
+		}
+	}
+
+	// The limit applies however the address is written.
+	for _, target := range []string{email, strings.ToUpper(email)} {
+		res, _ := doJSON(t, h, http.MethodPost, "/api/password/forgot", "", map[string]string{"email": target})
+		if res.StatusCode != http.StatusTooManyRequests {
+			t.Errorf("%s over the limit: status %d, want %d", target, res.StatusCode, http.StatusTooManyRequests)
+		}
+		if res.Header.Get("Retry-After") == "" {
+			t.Errorf("%s over the limit: no Retry-After", target)
+		}
+	}
+
+	// Reset requests don't lock the account out of logging in.
+	res, _ := doJSON(t, h, http.MethodPost, "/api/login", "", map[string]string{"email": email, "password": "correct horse battery"})
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("login after reset requests: status %d", res.StatusCode)
+	}
+}
+
+func TestPasswordResetRevokesAPITokens(t *testing.T) {
+	cfg := newTestConfig(t)
+	h := cfg.routes(t.TempDir())
+
+	const email = "pat@example.com"
+	token, _ := signUpAndLogin(t, h, email, "correct horse battery")
+
+	res, body := doJSON(t, h, http.MethodPost, "/api/tokens", token, map[string]any{"name": "ci", "scopes": []string{scopeChirpsRead}})
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("create token: status %d: %s", res.StatusCode, body)
+	}
+	created := struct {
+		Token string `json:"token"`
+	}{}
+	err := json.Unmarshal(body, &created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _ = doJSON(t, h, http.MethodGet, "/api/chirps", created.Token, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("token before the reset: status %d", res.StatusCode)
+	}
+
+	doJSON(t, h, http.MethodPost, "/api/password/forgot", "", map[string]string{"email": email})
+	resetToken, err := url.QueryUnescape(waitForMail(t, cfg, resetLink)[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _ = doJSON(t, h, http.MethodPost, "/api/password/reset", "", map[string]string{"token": resetToken, "password": "a brand new password"})
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("reset: status %d", res.StatusCode)
+	}
+
+	res, _ = doJSON(t, h, http.MethodGet, "/api/chirps", created.Token, nil)
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("token after the reset: status %d, want %d", res.StatusCode, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Raihanki/Chirpy/internal/database"
+)
+
+type Session struct {
+	ID         string    `json:"id"`
+	DeviceName string    `json:"device_name"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	Current    bool      `json:"current"`
+	// ClientID is set for grants to OAuth clients.
+	ClientID string `json:"client_id,omitempty"`
+}
+
+func sessionFromDB(s database.Session, currentSessionId string) Session {
+	return Session{
+		ID:         s.ID,
+		DeviceName: s.DeviceName,
+		IP:         s.IP,
+		UserAgent:  s.UserAgent,
+		CreatedAt:  s.CreatedAt,
+		LastUsedAt: s.LastUsedAt,
+		Current:    s.ID == currentSessionId,
+		ClientID:   s.ClientID,
+	}
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (cfg *apiConfig) handlerSessionsList(w http.ResponseWriter, r *http.Request) {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		respondWithAuthError(w, r, http.StatusUnauthorized, "", "")
+		return
+	}
+
+	dbSessions, err := cfg.DB.WithContext(r.Context()).GetSessions(principal.UserID)
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't retrieve sessions")
+		return
+	}
+
+	sessions := []Session{}
+	for _, dbSession := range dbSessions {
+		sessions = append(sessions, sessionFromDB(dbSession, principal.SessionID))
+	}
+
+	respondWithJSON(w, r, http.StatusOK, sessions)
+}
+
+func (cfg *apiConfig) handlerSessionRevoke(w http.ResponseWriter, r *http.Request) {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		respondWithAuthError(w, r, http.StatusUnauthorized, "", "")
+		return
+	}
+
+	err := cfg.DB.WithContext(r.Context()).DeleteSession(principal.UserID, r.PathValue("sessionId"))
+	if errors.Is(err, database.ErrSessionNotFound) {
+		respondWithError(w, r, http.StatusNotFound, "Session not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't revoke session")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Raihanki/Chirpy/internal/database"
+)
+
+func TestAccessTokensDieWithTheirSession(t *testing.T) {
+	const email, password = "sessions@example.com", "correct horse battery"
+
+	tests := []struct {
+		name   string
+		revoke func(t *testing.T, cfg *apiConfig, h http.Handler, token, refreshToken string)
+	}{
+		{
+			name: "session revoked",
+			revoke: func(t *testing.T, cfg *apiConfig, h http.Handler, token, refreshToken string) {
+				other, _ := login(t, h, email, password)
+				_, body := doJSON(t, h, http.MethodGet, "/api/sessions", other, nil)
+				sessions := []Session{}
+				err := json.Unmarshal(body, &sessions)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, s := range sessions {
+					if s.Current {
+						continue
+					}
+					res, _ := doJSON(t, h, http.MethodDelete, "/api/sessions/"+s.ID, other, nil)
+					if res.StatusCode != http.StatusNoContent {
+						t.Fatalf("revoke session: status %d", res.StatusCode)
+					}
+				}
+			},
+		},
+		{
+			name: "refresh token reused",
+			revoke: func(t *testing.T, cfg *apiConfig, h http.Handler, token, refreshToken string) {
+				doJSON(t, h, http.MethodPost, "/api/refresh", refreshToken, nil)
+				res, _ := doJSON(t, h, http.MethodPost, "/api/refresh", refreshToken, nil)
+				if res.StatusCode != http.StatusUnauthorized {
+					t.Fatalf("reused refresh token: status %d", res.StatusCode)
+				}
+			},
+		},
+		{
+			name: "password reset",
+			revoke: func(t *testing.T, cfg *apiConfig, h http.Handler, token, refreshToken string) {
+				doJSON(t, h, http.MethodPost, "/api/password/forgot", "", map[string]string{"email": email})
+				link := waitForMail(t, cfg, resetLink)
+				resetToken, err := url.QueryUnescape(link[2])
+				if err != nil {
+					t.Fatal(err)
+				}
+				res, _ := doJSON(t, h, http.MethodPost, "/api/password/reset", "", map[string]string{"token": resetToken, "password": "a brand new password"})
+				if res.StatusCode != http.StatusNoContent {
+					t.Fatalf("reset password: status %d", res.StatusCode)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			h := cfg.routes(t.TempDir())
+			token, refreshToken := signUpAndLogin(t, h, email, password)
+
+			res, _ := doJSON(t, h, http.MethodGet, "/api/users/me", token, nil)
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("before revoking: status %d", res.StatusCode)
+			}
+
+			tt.revoke(t, cfg, h, token, refreshToken)
+
+			res, _ = doJSON(t, h, http.MethodGet, "/api/users/me", token, nil)
+			if res.StatusCode != http.StatusUnauthorized {
+				t.Errorf("after revoking: status %d, want %d", res.StatusCode, http.StatusUnauthorized)
+			}
+		})
+	}
+}
+
+func TestBaselineRefreshTokensAreMigrated(t *testing.T) {
+	cfg := newTestConfig(t)
+
+	// Before sessions, the plaintext refresh token was stored on the user.
+	const refreshToken = "5f2b6c1e0d9a4b3c8e7f6a5b4c3d2e1f0a9b8c7d6e5f4a3b2c1d0e9f8a7b6c5d"
+	path := filepath.Join(t.TempDir(), "database.json")
+	baseline := `{"chirps":{},"users":{"1":{"id":1,"email":"old@example.com","password":"x","refresh_token":"` + refreshToken + `","is_chirpy_red":false}}}`
+	err := os.WriteFile(path, []byte(baseline), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.DB, err = database.NewDB(path, []byte("test-hash-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := cfg.routes(t.TempDir())
+
+	stored, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(stored), refreshToken) {
+		t.Error("the refresh token is still stored in plaintext")
+	}
+
+	res, body := doJSON(t, h, http.MethodPost, "/api/refresh", refreshToken, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("refresh with a baseline token: status %d: %s", res.StatusCode, body)
+	}
+	tokens := struct {
+		Token string `json:"token"`
+	}{}
+	err = json.Unmarshal(body, &tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _ = doJSON(t, h, http.MethodGet, "/api/users/me", tokens.Token, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("access token from a migrated session: status %d", res.StatusCode)
+	}
+}
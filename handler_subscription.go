@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/Raihanki/Chirpy/internal/database"
+)
+
+// SubscriptionPolicy sets how paid plans lapse.
+type SubscriptionPolicy struct {
+	// Period is the billing period assumed when Polka doesn't send one.
+	Period time.Duration
+	// Grace is how long a plan stays usable after a failed payment, or
+	// after its period ends without a renewal.
+	Grace time.Duration
+}
+
+func loadSubscriptionPolicy() (SubscriptionPolicy, error) {
+	period, err := durationFromEnv("SUBSCRIPTION_PERIOD", 30*24*time.Hour)
+	if err != nil {
+		return SubscriptionPolicy{}, err
+	}
+	grace, err := durationFromEnv("SUBSCRIPTION_GRACE_PERIOD", 3*24*time.Hour)
+	if err != nil {
+		return SubscriptionPolicy{}, err
+	}
+
+	if period <= 0 || grace < 0 {
+		return SubscriptionPolicy{}, fmt.Errorf("invalid subscription policy: period %s, grace %s", period, grace)
+	}
+
+	return SubscriptionPolicy{Period: period, Grace: grace}, nil
+}
+
+// StartSubscriptionExpiry expires lapsed subscriptions every interval until
+// stop is closed.
+func (cfg *apiConfig) StartSubscriptionExpiry(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				expired, err := cfg.DB.ExpireSubscriptions(time.Now().UTC(), cfg.Subscriptions.Grace)
+				if err != nil {
+					slog.Error("Couldn't expire subscriptions", "error", err)
+					continue
+				}
+				if len(expired) > 0 {
+					slog.Info("Expired subscriptions", "user_ids", expired)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+type Subscription struct {
+	Plan             string     `json:"plan"`
+	Status           string     `json:"status"`
+	StartedAt        *time.Time `json:"started_at"`
+	CurrentPeriodEnd *time.Time `json:"current_period_end"`
+	CanceledAt       *time.Time `json:"canceled_at"`
+	GraceUntil       *time.Time `json:"grace_until"`
+	EndedAt          *time.Time `json:"ended_at"`
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// subscriptionFromDB returns nil for users who never subscribed.
+func subscriptionFromDB(s *database.Subscription) *Subscription {
+	if s == nil {
+		return nil
+	}
+	return &Subscription{
+		Plan:             s.Plan,
+		Status:           s.Status,
+		StartedAt:        optionalTime(s.StartedAt),
+		CurrentPeriodEnd: optionalTime(s.CurrentPeriodEnd),
+		CanceledAt:       optionalTime(s.CanceledAt),
+		GraceUntil:       optionalTime(s.GraceUntil),
+		EndedAt:          optionalTime(s.EndedAt),
+	}
+}
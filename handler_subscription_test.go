@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Raihanki/Chirpy/internal/database"
+)
+
+func TestCancelingLegacySubscriptionEndsAccess(t *testing.T) {
+	cfg := newTestConfig(t)
+
+	// A Chirpy Red user from before subscriptions were tracked is migrated
+	// to an active subscription without a billing period.
+	path := filepath.Join(t.TempDir(), "database.json")
+	legacy := `{"users":{"1":{"id":1,"email":"red@example.com","is_chirpy_red":true}}}`
+	err := os.WriteFile(path, []byte(legacy), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.DB, err = database.NewDB(path, []byte("test-hash-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := cfg.DB.GetUserById(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.IsChirpyRed || user.Subscription == nil || !user.Subscription.CurrentPeriodEnd.IsZero() {
+		t.Fatalf("migrated user has subscription %+v", user.Subscription)
+	}
+
+	status, result, err := cfg.processPolkaEvent(context.Background(), []byte(`{"event":"user.canceled","data":{"user_id":1}}`))
+	if err != nil || status != database.WebhookEventProcessed {
+		t.Fatalf("processPolkaEvent() = %s, %s, %v", status, result, err)
+	}
+
+	// The subscription must not outlive the expiry job.
+	_, err = cfg.DB.ExpireSubscriptions(time.Now().Add(365*24*time.Hour), cfg.Subscriptions.Grace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err = cfg.DB.GetUserById(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.IsChirpyRed || user.Subscription.HasAccess() {
+		t.Errorf("canceled legacy subscription still gives access: %+v", user.Subscription)
+	}
+	if user.Subscription.Status != database.SubscriptionExpired {
+		t.Errorf("status = %s, want %s", user.Subscription.Status, database.SubscriptionExpired)
+	}
+}
+
+func TestEntitlementsRequireAccountScope(t *testing.T) {
+	cfg := newTestConfig(t)
+	h := cfg.routes(t.TempDir())
+	token, _ := signUpAndLogin(t, h, "entitlements@example.com", "correct horse battery")
+
+	res, body := doJSON(t, h, http.MethodPost, "/api/tokens", token, map[string]any{"name": "ci", "scopes": []string{scopeChirpsRead}})
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("create token: status %d: %s", res.StatusCode, body)
+	}
+	created := struct {
+		Token string `json:"token"`
+	}{}
+	err := json.Unmarshal(body, &created)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, body = doJSON(t, h, http.MethodGet, "/api/users/me/entitlements", token, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("session token: status %d: %s", res.StatusCode, body)
+	}
+	res, body = doJSON(t, h, http.MethodGet, "/api/users/me/entitlements", created.Token, nil)
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("chirps:read token: status %d, want %d: %s", res.StatusCode, http.StatusForbidden, body)
+	}
+}
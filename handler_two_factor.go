@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Raihanki/Chirpy/internal/database"
+	"github.com/Raihanki/Chirpy/internal/totp"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	tokenUseTwoFactorChallenge = "2fa_challenge"
+	twoFactorChallengeTTL      = 5 * time.Minute
+	recoveryCodeCount          = 10
+)
+
+var errSecondFactorInvalid = errors.New("invalid two-factor code")
+
+// generateRecoveryCodes returns one-time codes of the form "a1b2c-3d4e5".
+func generateRecoveryCodes() ([]string, error) {
+	codes := []string{}
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		code := hex.EncodeToString(b)
+		codes = append(codes, code[:5]+"-"+code[5:])
+	}
+	return codes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), " ", ""))
+}
+
+// verifySecondFactor accepts either a current TOTP code, which can be used
+// only once, or one of the user's unused recovery codes.
+func (cfg *apiConfig) verifySecondFactor(ctx context.Context, user database.User, code string) error {
+	secret, err := cfg.DB.TOTPSecret(user)
+	if err != nil {
+		return err
+	}
+	counter, ok := totp.Validate(secret, code, time.Now())
+	if ok {
+		err := cfg.DB.WithContext(ctx).UseTOTPCounter(user.ID, counter)
+		if errors.Is(err, database.ErrTOTPCodeReused) {
+			return errSecondFactorInvalid
+		}
+		return err
+	}
+
+	err = cfg.DB.WithContext(ctx).UseRecoveryCode(user.ID, normalizeRecoveryCode(code))
+	if errors.Is(err, database.ErrRecoveryCodeInvalid) {
+		return errSecondFactorInvalid
+	}
+	return err
+}
+
+// respondWithTwoFactorChallenge answers a login with a correct password for
+// an account with two-factor authentication enabled. The challenge token is
+// exchanged for real tokens at /api/login/2fa.
+func (cfg *apiConfig) respondWithTwoFactorChallenge(w http.ResponseWriter, r *http.Request, user database.User) {
+	tokenId, err := newTokenId()
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't create challenge")
+		return
+	}
+
+	now := time.Now()
+	challenge, err := cfg.Keys.Sign(ChirpyClaims{
+		TokenUse: tokenUseTwoFactorChallenge,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        tokenId,
+			Issuer:    "chirpy",
+			Subject:   strconv.Itoa(user.ID),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(twoFactorChallengeTTL)),
+		},
+	})
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't create challenge")
+		return
+	}
+
+	type response struct {
+		TwoFactorRequired bool   `json:"two_factor_required"`
+		ChallengeToken    string `json:"challenge_token"`
+		ExpiresIn         int    `json:"expires_in"`
+	}
+	respondWithJSON(w, r, http.StatusOK, response{
+		TwoFactorRequired: true,
+		ChallengeToken:    challenge,
+		ExpiresIn:         int(twoFactorChallengeTTL / time.Second),
+	})
+}
+
+func (cfg *apiConfig) handlerLoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		ChallengeToken   string `json:"challenge_token"`
+		Code             string `json:"code"`
+		DeviceName       string `json:"device_name"`
+		ExpiresInSeconds *int   `json:"expires_in_seconds,omitempty"`
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	claims := ChirpyClaims{}
+	err = parseToken(cfg.Keys, params.ChallengeToken, &claims)
+	if err != nil || claims.TokenUse != tokenUseTwoFactorChallenge {
+		respondWithError(w, r, http.StatusUnauthorized, "Challenge is invalid or expired")
+		return
+	}
+
+	userId, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		respondWithError(w, r, http.StatusUnauthorized, "Challenge is invalid or expired")
+		return
+	}
+
+	user, err := cfg.DB.WithContext(r.Context()).GetUserById(userId)
+	if err != nil || !user.TOTPEnabled {
+		respondWithError(w, r, http.StatusUnauthorized, "Challenge is invalid or expired")
+		return
+	}
+
+	if !cfg.checkLoginLock(w, r, user.Email) {
+		return
+	}
+
+	err = cfg.verifySecondFactor(r.Context(), user, params.Code)
+	if errors.Is(err, errSecondFactorInvalid) {
+		respondWithError(w, r, http.StatusUnauthorized, "Invalid two-factor code")
+		return
+	}
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't verify two-factor code")
+		return
+	}
+	cfg.loginSucceeded(r, user.Email)
+
+	err = cfg.completeLogin(w, r, user, params.DeviceName, params.ExpiresInSeconds)
+	if err != nil {
+		respondWithAPIError(w, r, err)
+	}
+}
+
+func (cfg *apiConfig) handlerTwoFactorEnroll(w http.ResponseWriter, r *http.Request) {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		respondWithAuthError(w, r, http.StatusUnauthorized, "", "")
+		return
+	}
+
+	user, err := cfg.DB.WithContext(r.Context()).GetUserById(principal.UserID)
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't get user")
+		return
+	}
+	if user.TOTPEnabled {
+		respondWithError(w, r, http.StatusConflict, "Two-factor authentication is already enabled")
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't generate secret")
+		return
+	}
+
+	err = cfg.DB.WithContext(r.Context()).SetPendingTOTPSecret(user.ID, secret)
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't start enrollment")
+		return
+	}
+
+	type response struct {
+		Secret          string `json:"secret"`
+		ProvisioningURI string `json:"provisioning_uri"`
+	}
+	respondWithJSON(w, r, http.StatusOK, response{
+		Secret:          secret,
+		ProvisioningURI: totp.ProvisioningURI("Chirpy", user.Email, secret),
+	})
+}
+
+func (cfg *apiConfig) handlerTwoFactorConfirm(w http.ResponseWriter, r *http.Request) {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		respondWithAuthError(w, r, http.StatusUnauthorized, "", "")
+		return
+	}
+
+	type parameters struct {
+		Code string `json:"code"`
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	user, err := cfg.DB.WithContext(r.Context()).GetUserById(principal.UserID)
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't get user")
+		return
+	}
+	secret, err := cfg.DB.PendingTOTPSecret(user)
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't get user")
+		return
+	}
+	if secret == "" {
+		respondWithError(w, r, http.StatusConflict, "Two-factor enrollment has not been started")
+		return
+	}
+
+	counter, ok := totp.Validate(secret, params.Code, time.Now())
+	if !ok {
+		respondWithError(w, r, http.StatusBadRequest, "Invalid two-factor code")
+		return
+	}
+
+	recoveryCodes, err := generateRecoveryCodes()
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't generate recovery codes")
+		return
+	}
+
+	err = cfg.DB.WithContext(r.Context()).EnableTOTP(user.ID, counter, recoveryCodes)
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't enable two-factor authentication")
+		return
+	}
+
+	type response struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	respondWithJSON(w, r, http.StatusOK, response{
+		RecoveryCodes: recoveryCodes,
+	})
+}
+
+func (cfg *apiConfig) handlerTwoFactorDisable(w http.ResponseWriter, r *http.Request) {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		respondWithAuthError(w, r, http.StatusUnauthorized, "", "")
+		return
+	}
+
+	type parameters struct {
+		Code string `json:"code"`
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	user, err := cfg.DB.WithContext(r.Context()).GetUserById(principal.UserID)
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't get user")
+		return
+	}
+	if !user.TOTPEnabled {
+		respondWithError(w, r, http.StatusConflict, "Two-factor authentication is not enabled")
+		return
+	}
+
+	err = cfg.verifySecondFactor(r.Context(), user, params.Code)
+	if errors.Is(err, errSecondFactorInvalid) {
+		respondWithError(w, r, http.StatusBadRequest, "Invalid two-factor code")
+		return
+	}
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't verify two-factor code")
+		return
+	}
+
+	err = cfg.DB.WithContext(r.Context()).DisableTOTP(user.ID)
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't disable two-factor authentication")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Raihanki/Chirpy/internal/totp"
+)
+
+func TestTOTPCodesCannotBeReplayed(t *testing.T) {
+	cfg := newTestConfig(t)
+
+	user, err := cfg.DB.CreateUser("replay@example.com", "correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cfg.DB.SetPendingTOTPSecret(user.ID, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := totp.Counter(time.Now())
+	err = cfg.DB.EnableTOTP(user.ID, current-2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err = cfg.DB.GetUserById(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code := func(counter int64) string {
+		code, err := totp.Code(secret, counter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+
+	ctx := context.Background()
+	err = cfg.verifySecondFactor(ctx, user, code(current))
+	if err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	// Neither the same code nor one from an earlier step in the skew
+	// window is accepted again.
+	for _, counter := range []int64{current, current - 1} {
+		err = cfg.verifySecondFactor(ctx, user, code(counter))
+		if !errors.Is(err, errSecondFactorInvalid) {
+			t.Errorf("replay of step %d: error %v, want %v", counter-current, err, errSecondFactorInvalid)
+		}
+	}
+}
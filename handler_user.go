@@ -1,28 +1,64 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
-	"os"
 	"strconv"
-	"strings"
+	"time"
 
 	"github.com/Raihanki/Chirpy/internal/database"
-	"golang.org/x/crypto/bcrypt"
 )
 
+// PublicUser is what anyone may see about an account.
+type PublicUser struct {
+	ID          int  `json:"id"`
+	IsChirpyRed bool `json:"is_chirpy_red"`
+}
+
+// User is an account as shown to its owner. Both DTOs are copied from
+// database.User field by field, so that password hashes, TOTP secrets and
+// other stored secrets can never reach a response.
 type User struct {
-	ID          int    `json:"id"`
-	Email       string `json:"email"`
-	Password    string `json:"password"`
-	IsChirpyRed bool   `json:"is_chirpy_red"`
+	ID                  int           `json:"id"`
+	Email               string        `json:"email"`
+	EmailVerified       bool          `json:"email_verified"`
+	IsChirpyRed         bool          `json:"is_chirpy_red"`
+	Subscription        *Subscription `json:"subscription"`
+	Roles               []string      `json:"roles"`
+	TwoFactorEnabled    bool          `json:"two_factor_enabled"`
+	DeletionScheduledAt *time.Time    `json:"deletion_scheduled_at"`
 }
 
-func (cfg *apiConfig) handlerCreateUser(w http.ResponseWriter, r *http.Request) {
+func publicUserFromDB(u database.User) PublicUser {
+	return PublicUser{
+		ID:          u.ID,
+		IsChirpyRed: u.IsChirpyRed,
+	}
+}
+
+func (cfg *apiConfig) userFromDB(u database.User) User {
+	user := User{
+		ID:               u.ID,
+		Email:            u.Email,
+		EmailVerified:    u.EmailVerified,
+		IsChirpyRed:      u.IsChirpyRed,
+		Subscription:     subscriptionFromDB(u.Subscription),
+		Roles:            cfg.rolesFor(u),
+		TwoFactorEnabled: u.TOTPEnabled,
+	}
+	if user.Roles == nil {
+		user.Roles = []string{}
+	}
+	if !u.DeletionScheduledAt.IsZero() {
+		user.DeletionScheduledAt = &u.DeletionScheduledAt
+	}
+	return user
+}
+
+func (cfg *apiConfig) handlerCreateUser(w http.ResponseWriter, r *http.Request) error {
 	type UserRequest struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
@@ -31,292 +67,285 @@ func (cfg *apiConfig) handlerCreateUser(w http.ResponseWriter, r *http.Request)
 	request := UserRequest{}
 	err := json.NewDecoder(r.Body).Decode(&request)
 	if err != nil {
-		log.Printf("Error while decode request body: %v", err)
-		w.WriteHeader(500)
-		return
+		return invalidFields([]fieldError{errMalformedBody})
+	}
+
+	email, errs := cfg.validateCredentials(request.Email, request.Password)
+	if len(errs) > 0 {
+		return invalidFields(errs)
 	}
 
-	newUser, err := cfg.DB.CreateUser(request.Email, request.Password)
+	newUser, err := cfg.DB.WithContext(r.Context()).CreateUser(email, request.Password)
+	if errors.Is(err, database.ErrEmailTaken) {
+		return conflict("Email is already registered", err)
+	}
 	if err != nil {
-		log.Printf("Error while creating user: %v", err)
-		w.WriteHeader(500)
-		return
+		return internalError("Couldn't create user", err)
 	}
 
-	jsonUser, err := json.Marshal(newUser)
+	err = cfg.sendVerificationEmail(r.Context(), newUser)
 	if err != nil {
-		log.Printf("Error while mrshal user: %v", err)
-		w.WriteHeader(500)
-		return
+		slog.ErrorContext(r.Context(), "Couldn't send verification email", "error", err)
 	}
 
-	w.WriteHeader(201)
-	w.Write(jsonUser)
+	respondWithJSON(w, r, http.StatusCreated, cfg.userFromDB(newUser))
+	return nil
 }
 
-func (cfg *apiConfig) handlerUserLogin(w http.ResponseWriter, r *http.Request) {
+func (cfg *apiConfig) handlerUserLogin(w http.ResponseWriter, r *http.Request) error {
 	type LoginRequest struct {
 		Email            string `json:"email"`
 		Password         string `json:"password"`
+		DeviceName       string `json:"device_name"`
 		ExpiresInSeconds *int   `json:"expires_in_seconds,omitempty"`
 	}
 
 	request := LoginRequest{}
 	err := json.NewDecoder(r.Body).Decode(&request)
 	if err != nil {
-		log.Printf("Error while decoding request: %v", err)
-		w.WriteHeader(500)
-		return
+		return invalidFields([]fieldError{errMalformedBody})
 	}
 
-	data, err := cfg.DB.LoadDB()
+	user, err := cfg.verifyPassword(r, request.Email, request.Password)
+	if errors.Is(err, errInvalidCredentials) {
+		return unauthorized("Incorrect email or password", err)
+	}
 	if err != nil {
-		log.Printf("Error while load database: %v", err)
-		w.WriteHeader(500)
-		return
+		return err
 	}
 
-	var user database.User
-	for _, u := range data.Users {
-		if u.Email == request.Email {
-			user = u
-		}
+	if user.TOTPEnabled {
+		cfg.respondWithTwoFactorChallenge(w, r, user)
+		return nil
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(request.Password))
-	if err != nil {
-		w.WriteHeader(401)
-		return
-	}
+	return cfg.completeLogin(w, r, user, request.DeviceName, request.ExpiresInSeconds)
+}
 
+// completeLogin opens a session for an authenticated user and responds with
+// its access and refresh tokens.
+func (cfg *apiConfig) completeLogin(w http.ResponseWriter, r *http.Request, user database.User, deviceName string, expiresInSeconds *int) error {
 	type UserResponse struct {
-		ID           int    `json:"id"`
-		Email        string `json:"email"`
-		Password     string `json:"-"`
+		User
 		Token        string `json:"token"`
 		RefreshToken string `json:"refresh_token"`
-		IsChirpyRed  bool   `json:"is_chirpy_red"`
+		ExpiresIn    int    `json:"expires_in"`
 	}
 
-	exp := 0
-	if request.ExpiresInSeconds == nil {
-		exp = 86400
-	} else {
-		exp = *request.ExpiresInSeconds
+	rToken, err := generateSecureToken()
+	if err != nil {
+		return internalError("Couldn't generate refresh token", err)
 	}
 
+	session, err := cfg.DB.WithContext(r.Context()).CreateSession(user.ID, deviceName, clientIP(r), r.UserAgent(), rToken, cfg.TokenPolicy.RefreshExpiresAt())
+	if err != nil {
+		return internalError("Couldn't create session", err)
+	}
+
+	exp := cfg.TokenPolicy.ExpiresIn(expiresInSeconds)
+
 	strUserId := strconv.Itoa(user.ID)
 	jwtConfig := JwtConfig{
 		Issuer:    "chirpy",
 		ExpiresAt: exp,
 		Subject:   strUserId,
+		Roles:     cfg.rolesFor(user),
+		Scopes:    sessionScopes,
+		SessionId: session.ID,
 	}
 
-	token, err := jwtConfig.generateToken()
+	token, err := jwtConfig.generateToken(cfg.Keys)
 	if err != nil {
-		log.Printf("error generat token: %v", err)
-		w.WriteHeader(500)
-		return
+		return internalError("Couldn't create access token", err)
 	}
 
-	// Create a byte slice to hold the random data (32 bytes for 256 bits)
-	refreshToken := make([]byte, 32)
-
-	// Read random bytes using crypto/rand's rand.Read function
-	_, err = rand.Read(refreshToken)
-	if err != nil {
-		log.Printf("error generat refresh token: %v", err)
-		w.WriteHeader(500)
-		return
-	}
-	rToken := hex.EncodeToString(refreshToken)
-	cfg.DB.SaveRefreshToken(user.ID, rToken)
-
-	jsonUser, err := json.Marshal(UserResponse{
-		ID:           user.ID,
-		Email:        user.Email,
-		Password:     user.Password,
+	respondWithJSON(w, r, http.StatusOK, UserResponse{
+		User:         cfg.userFromDB(user),
 		Token:        token,
 		RefreshToken: rToken,
-		IsChirpyRed:  user.IsChirpyRed,
+		ExpiresIn:    exp,
 	})
+	return nil
+}
+
+func (cfg *apiConfig) handlerUserMe(w http.ResponseWriter, r *http.Request) {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		respondWithAuthError(w, r, http.StatusUnauthorized, "", "")
+		return
+	}
 
+	user, err := cfg.DB.WithContext(r.Context()).GetUserById(principal.UserID)
+	if errors.Is(err, database.ErrUserNotFound) {
+		respondWithError(w, r, http.StatusNotFound, "User not found")
+		return
+	}
 	if err != nil {
-		log.Printf("error marshaling user data")
-		w.WriteHeader(500)
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't get user")
 		return
 	}
 
-	w.WriteHeader(200)
-	w.Write(jsonUser)
+	respondWithJSON(w, r, http.StatusOK, cfg.userFromDB(user))
 }
 
-func (cfg *apiConfig) handlerUpdateUser(w http.ResponseWriter, r *http.Request) {
-	header := r.Header.Get("Authorization")
-	if header == "" || !strings.HasPrefix(header, "Bearer ") {
-		log.Println("Authorization header is missing or improperly formatted")
-		w.WriteHeader(http.StatusUnauthorized)
+func (cfg *apiConfig) handlerUserDetail(w http.ResponseWriter, r *http.Request) {
+	userId, err := strconv.Atoi(r.PathValue("userId"))
+	if err != nil {
+		respondWithError(w, r, http.StatusNotFound, "User not found")
 		return
 	}
-	token := strings.Split(header, " ")[1]
 
-	claims, err := ValidateToken(token)
+	user, err := cfg.DB.WithContext(r.Context()).GetUserById(userId)
+	if errors.Is(err, database.ErrUserNotFound) {
+		respondWithError(w, r, http.StatusNotFound, "User not found")
+		return
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't get user")
 		return
 	}
 
+	respondWithJSON(w, r, http.StatusOK, publicUserFromDB(user))
+}
+
+func (cfg *apiConfig) handlerUpdateUser(w http.ResponseWriter, r *http.Request) error {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		return unauthorized("", nil)
+	}
+
 	type UserRequest struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
 	}
 
 	request := UserRequest{}
-	err = json.NewDecoder(r.Body).Decode(&request)
+	err := json.NewDecoder(r.Body).Decode(&request)
 	if err != nil {
-		log.Fatalf("error decode body: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return invalidFields([]fieldError{errMalformedBody})
 	}
 
-	userId, err := claims.GetSubject()
-	if err != nil {
-		log.Fatalf("error get subject: %v", err)
-		w.WriteHeader(http.StatusUnauthorized)
-		return
+	email, errs := cfg.validateCredentials(request.Email, request.Password)
+	if len(errs) > 0 {
+		return invalidFields(errs)
 	}
 
-	userIdInt, _ := strconv.Atoi(userId)
-
-	updatedUser, err := cfg.DB.UpdateUser(request.Email, request.Password, userIdInt)
+	updatedUser, err := cfg.DB.WithContext(r.Context()).UpdateUser(email, request.Password, principal.UserID)
+	if errors.Is(err, database.ErrEmailTaken) {
+		return conflict("Email is already registered", err)
+	}
+	if errors.Is(err, database.ErrUserNotFound) {
+		return notFound("User not found", err)
+	}
 	if err != nil {
-		log.Fatalf("error updating user %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return internalError("Couldn't update user", err)
 	}
 
-	jsonUser, err := json.Marshal(updatedUser)
-	if err != nil {
-		log.Fatalf("error updating user %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+	if !updatedUser.EmailVerified {
+		err = cfg.sendVerificationEmail(r.Context(), updatedUser)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Couldn't send verification email", "error", err)
+		}
 	}
 
-	w.WriteHeader(200)
-	w.Write(jsonUser)
+	respondWithJSON(w, r, http.StatusOK, cfg.userFromDB(updatedUser))
+	return nil
 }
 
-func (cfg *apiConfig) handlerRefreshToken(w http.ResponseWriter, r *http.Request) {
-	header := r.Header.Get("Authorization")
-	if header == "" || !strings.HasPrefix(header, "Bearer ") {
-		log.Println("Authorization header is missing or improperly formatted")
-		w.WriteHeader(http.StatusUnauthorized)
-		return
+func (cfg *apiConfig) handlerRefreshToken(w http.ResponseWriter, r *http.Request) error {
+	token, err := getBearerToken(r)
+	if err != nil {
+		return unauthorized("", err)
 	}
-	token := strings.Split(header, " ")[1]
 
-	user, err := cfg.DB.ValidateRefreshToken(token)
-	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
+	// The body is decoded before the token is rotated, so that a malformed
+	// request doesn't consume the token and make the client's retry look
+	// like reuse.
+	type RefreshRequest struct {
+		ExpiresInSeconds *int `json:"expires_in_seconds,omitempty"`
 	}
 
-	strUserId := strconv.Itoa(user.ID)
-	jwtConfig := JwtConfig{
-		Issuer:    "chirpy",
-		ExpiresAt: 100,
-		Subject:   strUserId,
+	// The body is optional; clients that send none get the default lifetime.
+	request := RefreshRequest{}
+	err = json.NewDecoder(r.Body).Decode(&request)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return invalid("Couldn't decode parameters", err)
 	}
-	newToken, err := jwtConfig.generateToken()
+
+	newRefreshToken, err := generateSecureToken()
 	if err != nil {
-		log.Fatalf("Error create token: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return internalError("Couldn't generate refresh token", err)
 	}
 
-	type Response struct {
-		Token string `json:"token"`
+	session, err := cfg.DB.WithContext(r.Context()).RotateRefreshToken("", token, newRefreshToken, cfg.TokenPolicy.RefreshExpiresAt())
+	if errors.Is(err, database.ErrRefreshTokenReused) {
+		slog.WarnContext(r.Context(), "Refresh token reuse detected, session revoked")
 	}
-	response := Response{
-		Token: newToken,
+	if errors.Is(err, database.ErrRefreshTokenNotFound) || errors.Is(err, database.ErrRefreshTokenExpired) || errors.Is(err, database.ErrRefreshTokenReused) {
+		return unauthorized("Refresh token is invalid or expired", err)
 	}
-	tokenResponse, err := json.Marshal(response)
 	if err != nil {
-		log.Fatalf("Error marshal data: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return internalError("Couldn't rotate refresh token", err)
 	}
 
-	w.WriteHeader(200)
-	w.Write(tokenResponse)
-}
-
-func (cfg *apiConfig) handlerRevokeToken(w http.ResponseWriter, r *http.Request) {
-	header := r.Header.Get("Authorization")
-	if header == "" || !strings.HasPrefix(header, "Bearer ") {
-		log.Println("Authorization header is missing or improperly formatted")
-		w.WriteHeader(http.StatusUnauthorized)
-		return
+	user, err := cfg.DB.WithContext(r.Context()).GetUserById(session.UserID)
+	if errors.Is(err, database.ErrUserNotFound) {
+		return unauthorized("Refresh token is invalid or expired", err)
 	}
-	token := strings.Split(header, " ")[1]
-
-	user, err := cfg.DB.ValidateRefreshToken(token)
 	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
+		return internalError("Couldn't retrieve user", err)
 	}
 
-	err = cfg.DB.DeleteRefreshToken(user)
-	if err != nil {
-		log.Fatalf("error delete refresh token : %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+	exp := cfg.TokenPolicy.ExpiresIn(request.ExpiresInSeconds)
+	strUserId := strconv.Itoa(user.ID)
+	jwtConfig := JwtConfig{
+		Issuer:    "chirpy",
+		ExpiresAt: exp,
+		Subject:   strUserId,
+		Roles:     cfg.rolesFor(user),
+		Scopes:    sessionScopes,
+		SessionId: session.ID,
 	}
-
-	w.WriteHeader(204)
-}
-
-func (cfg *apiConfig) handlerPolkaWebhook(w http.ResponseWriter, r *http.Request) {
-	type UserInfo struct {
-		UserId int `json:"user_id"`
+	newToken, err := jwtConfig.generateToken(cfg.Keys)
+	if err != nil {
+		return internalError("Couldn't create access token", err)
 	}
 
-	type RequestBody struct {
-		Event string   `json:"event"`
-		Data  UserInfo `json:"data"`
+	type Response struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int    `json:"expires_in"`
 	}
+	respondWithJSON(w, r, http.StatusOK, Response{
+		Token:        newToken,
+		RefreshToken: newRefreshToken,
+		ExpiresIn:    exp,
+	})
+	return nil
+}
 
-	header := r.Header.Get("Authorization")
-	if header == "" || !strings.HasPrefix(header, "ApiKey ") {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
+func (cfg *apiConfig) handlerRevokeToken(w http.ResponseWriter, r *http.Request) error {
+	token, err := getBearerToken(r)
+	if err != nil {
+		return unauthorized("", err)
 	}
-	token := strings.Split(header, " ")[1]
 
-	if token != os.Getenv("POLKA_API_KEY") {
-		w.WriteHeader(401)
+	session, err := cfg.DB.WithContext(r.Context()).ValidateRefreshToken(token)
+	if errors.Is(err, database.ErrRefreshTokenNotFound) || errors.Is(err, database.ErrRefreshTokenExpired) {
+		return unauthorized("Refresh token is invalid or expired", err)
 	}
-
-	request := RequestBody{}
-	err := json.NewDecoder(r.Body).Decode(&request)
 	if err != nil {
-		log.Fatalf("error encoding request body : %v", err)
-		w.WriteHeader(500)
-		return
+		return internalError("Couldn't validate refresh token", err)
 	}
 
-	if request.Event != "user.upgraded" {
-		w.WriteHeader(204)
-		return
+	err = cfg.DB.WithContext(r.Context()).DeleteSession(session.UserID, session.ID)
+	if errors.Is(err, database.ErrSessionNotFound) {
+		return unauthorized("Refresh token is invalid or expired", err)
 	}
-
-	err = cfg.DB.UpgradeChirpy(request.Data.UserId)
 	if err != nil {
-		if errors.Is(err, errors.New("notfound")) {
-			w.WriteHeader(404)
-		}
-		log.Printf("LOGGG:: eror: %v", err)
+		return internalError("Couldn't revoke session", err)
 	}
 
-	w.WriteHeader(204)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
 }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLoginResponses(t *testing.T) {
+	cfg := newTestConfig(t)
+	h := cfg.routes(t.TempDir())
+
+	const email, password = "login@example.com", "correct horse battery"
+	signUpAndLogin(t, h, email, password)
+
+	tests := []struct {
+		name     string
+		password string
+		status   int
+	}{
+		{"valid credentials", password, http.StatusOK},
+		{"wrong password", "wrong password", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, body := doJSON(t, h, http.MethodPost, "/api/login", "", map[string]string{"email": email, "password": tt.password})
+			if res.StatusCode != tt.status {
+				t.Fatalf("status %d, want %d: %s", res.StatusCode, tt.status, body)
+			}
+			if got := res.Header.Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", got)
+			}
+
+			fields := map[string]any{}
+			err := json.Unmarshal(body, &fields)
+			if err != nil {
+				t.Fatalf("body is not JSON: %q", body)
+			}
+			if tt.status == http.StatusOK && fields["token"] == nil {
+				t.Errorf("no token in %s", body)
+			}
+			if tt.status != http.StatusOK && fields["error"] != "Incorrect email or password" {
+				t.Errorf("error = %v, want %q", fields["error"], "Incorrect email or password")
+			}
+		})
+	}
+}
+
+func TestLegacyEmailsCanStillLogIn(t *testing.T) {
+	cfg := newTestConfig(t)
+	h := cfg.routes(t.TempDir())
+
+	// Accounts created before strict validation may have addresses that
+	// signup would now reject.
+	const email, password = "Legacy.User@localhost", "correct horse battery"
+	_, err := cfg.DB.CreateUser(email, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, fieldErr := normalizeEmail(email); fieldErr == nil {
+		t.Fatalf("%q passes strict validation", email)
+	}
+
+	login(t, h, email, password)
+	login(t, h, " legacy.user@LOCALHOST ", password)
+}
+
+func TestUpdateUserRejectsMalformedBody(t *testing.T) {
+	cfg := newTestConfig(t)
+	h := cfg.routes(t.TempDir())
+	token, _ := signUpAndLogin(t, h, "update@example.com", "correct horse battery")
+
+	req := httptest.NewRequest(http.MethodPut, "/api/users", strings.NewReader("{"))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want %d: %s", rec.Code, http.StatusBadRequest, rec.Body)
+	}
+	response := struct {
+		Error   string       `json:"error"`
+		Details []fieldError `json:"details"`
+	}{}
+	err := json.Unmarshal(rec.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Details) != 1 || response.Details[0] != errMalformedBody {
+		t.Errorf("details = %+v, want %+v", response.Details, errMalformedBody)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/Raihanki/Chirpy/internal/database"
+	"github.com/Raihanki/Chirpy/internal/mail"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const tokenUseEmailVerification = "email_verification"
+
+type emailVerificationClaims struct {
+	Email    string `json:"email"`
+	TokenUse string `json:"token_use"`
+	jwt.RegisteredClaims
+}
+
+// sendVerificationEmail mails the user a signed verification link. It fails
+// with database.ErrVerificationRateLimited if one was sent too recently.
+func (cfg *apiConfig) sendVerificationEmail(ctx context.Context, user database.User) error {
+	err := cfg.DB.WithContext(ctx).RecordVerificationSent(user.ID, cfg.VerificationResendInterval)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	token, err := cfg.Keys.Sign(emailVerificationClaims{
+		Email:    user.Email,
+		TokenUse: tokenUseEmailVerification,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "chirpy",
+			Subject:   strconv.Itoa(user.ID),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(cfg.EmailVerificationTTL)),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	cfg.sendMail(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "Verify your Chirpy email address",
+		Body: fmt.Sprintf(
+			"Welcome to Chirpy!\n\n"+
+				"Confirm your email address within %s by opening this link:\n%s\n",
+			cfg.EmailVerificationTTL, cfg.BaseURL+"/api/users/verify?token="+url.QueryEscape(token),
+		),
+	})
+	return nil
+}
+
+func (cfg *apiConfig) handlerVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	claims := emailVerificationClaims{}
+	err := parseToken(cfg.Keys, r.URL.Query().Get("token"), &claims)
+	if err != nil || claims.TokenUse != tokenUseEmailVerification {
+		respondWithError(w, r, http.StatusBadRequest, "Verification link is invalid or expired")
+		return
+	}
+
+	userId, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, "Verification link is invalid or expired")
+		return
+	}
+
+	err = cfg.DB.WithContext(r.Context()).MarkEmailVerified(userId, claims.Email)
+	if errors.Is(err, database.ErrUserNotFound) || errors.Is(err, database.ErrEmailChanged) {
+		respondWithError(w, r, http.StatusBadRequest, "Verification link is invalid or expired")
+		return
+	}
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't verify email")
+		return
+	}
+
+	type response struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	respondWithJSON(w, r, http.StatusOK, response{
+		Email:         claims.Email,
+		EmailVerified: true,
+	})
+}
+
+func (cfg *apiConfig) handlerResendVerification(w http.ResponseWriter, r *http.Request) {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		respondWithAuthError(w, r, http.StatusUnauthorized, "", "")
+		return
+	}
+
+	user, err := cfg.DB.WithContext(r.Context()).GetUserById(principal.UserID)
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't get user")
+		return
+	}
+
+	if user.EmailVerified {
+		respondWithError(w, r, http.StatusConflict, "Email is already verified")
+		return
+	}
+
+	err = cfg.sendVerificationEmail(r.Context(), user)
+	if errors.Is(err, database.ErrVerificationRateLimited) {
+		retryAfter := time.Until(user.VerificationSentAt.Add(cfg.VerificationResendInterval))
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		respondWithError(w, r, http.StatusTooManyRequests, "Verification email was sent recently, try again later")
+		return
+	}
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't send verification email")
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
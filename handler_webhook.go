@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Raihanki/Chirpy/internal/database"
+	"github.com/Raihanki/Chirpy/internal/webhook"
+)
+
+const (
+	polkaTimestampHeader = "X-Polka-Timestamp"
+	// polkaSignatureHeader holds one or more comma-separated signatures,
+	// e.g. "v1=5257a869...".
+	polkaSignatureHeader = "X-Polka-Signature"
+	maxWebhookBodyBytes  = 1 << 20
+)
+
+// PolkaWebhookConfig verifies that webhooks were sent by Polka. Polka signs
+// "<timestamp>.<body>" with HMAC-SHA256. Several secrets can be active at
+// once so that they can be rotated without dropping events.
+type PolkaWebhookConfig struct {
+	Secrets [][]byte
+	// Tolerance is how far the signed timestamp may be from now. Older
+	// deliveries are rejected as possible replays.
+	Tolerance time.Duration
+	// LegacyAPIKey is accepted in an "Authorization: ApiKey" header while no
+	// signing secrets are configured, if AllowUnsigned is set.
+	LegacyAPIKey string
+	// AllowUnsigned opts into the unsigned ApiKey webhooks. Without it, and
+	// without signing secrets, every webhook is rejected.
+	AllowUnsigned bool
+}
+
+// loadPolkaWebhookConfig reads POLKA_WEBHOOK_SECRETS, a comma-separated list
+// of signing secrets, POLKA_WEBHOOK_TOLERANCE, and the legacy POLKA_API_KEY
+// with the POLKA_ALLOW_UNSIGNED_WEBHOOKS opt-in that enables it.
+func loadPolkaWebhookConfig() (PolkaWebhookConfig, error) {
+	tolerance, err := durationFromEnv("POLKA_WEBHOOK_TOLERANCE", 5*time.Minute)
+	if err != nil {
+		return PolkaWebhookConfig{}, err
+	}
+	if tolerance <= 0 {
+		return PolkaWebhookConfig{}, fmt.Errorf("invalid POLKA_WEBHOOK_TOLERANCE %s", tolerance)
+	}
+
+	config := PolkaWebhookConfig{
+		Tolerance:    tolerance,
+		LegacyAPIKey: os.Getenv("POLKA_API_KEY"),
+	}
+	for _, secret := range strings.Split(os.Getenv("POLKA_WEBHOOK_SECRETS"), ",") {
+		secret = strings.TrimSpace(secret)
+		if secret != "" {
+			config.Secrets = append(config.Secrets, []byte(secret))
+		}
+	}
+
+	if val := os.Getenv("POLKA_ALLOW_UNSIGNED_WEBHOOKS"); val != "" {
+		config.AllowUnsigned, err = strconv.ParseBool(val)
+		if err != nil {
+			return PolkaWebhookConfig{}, fmt.Errorf("invalid POLKA_ALLOW_UNSIGNED_WEBHOOKS %q", val)
+		}
+	}
+
+	switch {
+	case len(config.Secrets) > 0:
+	case config.AllowUnsigned:
+		slog.Warn("POLKA_WEBHOOK_SECRETS is not set, accepting unsigned ApiKey webhooks")
+	default:
+		slog.Warn("POLKA_WEBHOOK_SECRETS is not set, rejecting all webhooks")
+	}
+	return config, nil
+}
+
+// verify checks the signature headers of a webhook against body.
+func (p PolkaWebhookConfig) verify(header http.Header, body []byte, now time.Time) error {
+	return webhook.Verify(header, polkaTimestampHeader, polkaSignatureHeader, body, p.Secrets, now, p.Tolerance)
+}
+
+// authenticatePolkaWebhook reads the body of a webhook and checks that it
+// came from Polka. Failures are logged as security events.
+func (cfg *apiConfig) authenticatePolkaWebhook(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBodyBytes))
+	if err != nil {
+		logSecurityEvent(r, "polka_webhook_rejected", "body too large")
+		return nil, tooLarge("Webhook body is too large", err)
+	}
+
+	if len(cfg.PolkaWebhook.Secrets) == 0 {
+		if !cfg.PolkaWebhook.AllowUnsigned {
+			logSecurityEvent(r, "polka_webhook_rejected", "no signing secrets configured")
+			return nil, unauthorized("Webhook signing is not configured", nil)
+		}
+
+		key, err := getAuthorization(r, "ApiKey")
+		if err != nil || cfg.PolkaWebhook.LegacyAPIKey == "" ||
+			subtle.ConstantTimeCompare([]byte(key), []byte(cfg.PolkaWebhook.LegacyAPIKey)) != 1 {
+			logSecurityEvent(r, "polka_webhook_rejected", "invalid api key")
+			return nil, unauthorized("Invalid API key", err)
+		}
+		return body, nil
+	}
+
+	err = cfg.PolkaWebhook.verify(r.Header, body, time.Now())
+	if err != nil {
+		logSecurityEvent(r, "polka_webhook_rejected", err.Error())
+		return nil, unauthorized("Invalid webhook signature", err)
+	}
+	return body, nil
+}
+
+const polkaProvider = "polka"
+
+// polkaEvent is the body of a Polka webhook. PeriodEnd is sent with
+// upgrades and renewals; without it a standard billing period is assumed.
+type polkaEvent struct {
+	ID    string `json:"id"`
+	Event string `json:"event"`
+	Data  struct {
+		UserId    int        `json:"user_id"`
+		PeriodEnd *time.Time `json:"period_end,omitempty"`
+	} `json:"data"`
+}
+
+// polkaEventID returns Polka's event ID. Deliveries without one are
+// identified by a hash of their body, so that identical redeliveries are
+// still recognized.
+func polkaEventID(event polkaEvent, body []byte) string {
+	if event.ID != "" {
+		return event.ID
+	}
+	sum := sha256.Sum256(body)
+	return "sha256-" + hex.EncodeToString(sum[:])
+}
+
+// processPolkaEvent applies a Polka event and returns the ledger status and
+// result to record for it.
+func (cfg *apiConfig) processPolkaEvent(ctx context.Context, payload []byte) (string, string, error) {
+	event := polkaEvent{}
+	err := json.Unmarshal(payload, &event)
+	if err != nil {
+		return database.WebhookEventFailed, "invalid payload", err
+	}
+
+	now := time.Now().UTC()
+	var update func(*database.Subscription) error
+	switch event.Event {
+	case "user.upgraded", "user.renewed":
+		periodEnd := now.Add(cfg.Subscriptions.Period)
+		if event.Data.PeriodEnd != nil {
+			periodEnd = event.Data.PeriodEnd.UTC()
+		}
+		update = func(s *database.Subscription) error {
+			s.Start(database.PlanRed, now, periodEnd)
+			return nil
+		}
+	case "user.canceled":
+		update = requireSubscription(func(s *database.Subscription) {
+			s.Cancel(now)
+		})
+	case "user.payment_failed":
+		update = requireSubscription(func(s *database.Subscription) {
+			s.PaymentFailed(now, cfg.Subscriptions.Grace)
+		})
+	case "user.downgraded":
+		update = requireSubscription(func(s *database.Subscription) {
+			s.End(database.SubscriptionExpired, now)
+		})
+	case "user.refunded":
+		update = requireSubscription(func(s *database.Subscription) {
+			s.End(database.SubscriptionRefunded, now)
+		})
+	default:
+		return database.WebhookEventIgnored, "unhandled event type", nil
+	}
+
+	user, err := cfg.DB.WithContext(ctx).UpdateSubscription(event.Data.UserId, update)
+	if err != nil {
+		return database.WebhookEventFailed, err.Error(), err
+	}
+	return database.WebhookEventProcessed, fmt.Sprintf("user %d subscription is %s", user.ID, user.Subscription.Status), nil
+}
+
+// polkaProcessError maps an error from processPolkaEvent to the response
+// for it.
+func polkaProcessError(err error) error {
+	if errors.Is(err, database.ErrUserNotFound) {
+		return notFound("User not found", err)
+	}
+	if errors.Is(err, database.ErrSubscriptionNotFound) {
+		return conflict("User has no active subscription", err)
+	}
+	return internalError("Couldn't process webhook", err)
+}
+
+// requireSubscription wraps a transition that only applies to a
+// subscription that currently gives access.
+func requireSubscription(transition func(*database.Subscription)) func(*database.Subscription) error {
+	return func(s *database.Subscription) error {
+		if !s.HasAccess() {
+			return database.ErrSubscriptionNotFound
+		}
+		transition(s)
+		return nil
+	}
+}
+
+func (cfg *apiConfig) handlerPolkaWebhook(w http.ResponseWriter, r *http.Request) error {
+	body, err := cfg.authenticatePolkaWebhook(w, r)
+	if err != nil {
+		return err
+	}
+
+	request := polkaEvent{}
+	err = json.Unmarshal(body, &request)
+	if err != nil {
+		return invalid("Couldn't decode webhook", err)
+	}
+
+	event, claimed, err := cfg.DB.WithContext(r.Context()).RecordWebhookEvent(polkaProvider, polkaEventID(request, body), request.Event, body)
+	if err != nil {
+		return internalError("Couldn't record webhook", err)
+	}
+
+	// Redeliveries of handled events are acknowledged without side effects.
+	// A redelivery that arrives while the event is being handled is refused,
+	// so that Polka retries it once the outcome is known.
+	if !claimed && event.Final() {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	if !claimed {
+		return conflict("Webhook is being processed", database.ErrWebhookEventClaimed)
+	}
+
+	status, result, processErr := cfg.processPolkaEvent(r.Context(), body)
+	_, err = cfg.DB.WithContext(r.Context()).CompleteWebhookEvent(event.Key, status, result)
+	if err != nil {
+		return internalError("Couldn't record webhook", err)
+	}
+	if processErr != nil {
+		return polkaProcessError(processErr)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
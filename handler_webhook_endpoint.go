@@ -0,0 +1,504 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Raihanki/Chirpy/internal/database"
+	"github.com/Raihanki/Chirpy/internal/webhook"
+)
+
+const (
+	maxWebhookEndpoints = 10
+	webhookSecretPrefix = "whsec_"
+	maxWebhookURLLength = 2048
+	// webhookPruneInterval is how often old deliveries are pruned.
+	webhookPruneInterval = time.Hour
+)
+
+// webhookEventsMessage describes the events that endpoints can receive,
+// which are all domain events.
+var webhookEventsMessage = "Events must be one or more of " + strings.Join(database.EventTypes, ", ")
+
+// OutboundWebhookConfig controls the delivery of events to registered
+// endpoints.
+type OutboundWebhookConfig struct {
+	Retry database.RetryPolicy
+	// AllowPrivateURLs lets endpoints use plain http and loopback or
+	// private addresses, for local development.
+	AllowPrivateURLs bool
+	Sender           *webhook.Sender
+	// Retention is how long finished deliveries are kept after their last
+	// attempt. Zero keeps them forever.
+	Retention time.Duration
+	// Workers is how many endpoints are sent deliveries at once.
+	Workers int
+}
+
+func loadOutboundWebhookConfig() (OutboundWebhookConfig, error) {
+	maxAttempts, err := intFromEnv("WEBHOOK_MAX_ATTEMPTS", 8)
+	if err != nil {
+		return OutboundWebhookConfig{}, err
+	}
+	baseDelay, err := durationFromEnv("WEBHOOK_RETRY_BASE", 30*time.Second)
+	if err != nil {
+		return OutboundWebhookConfig{}, err
+	}
+	maxDelay, err := durationFromEnv("WEBHOOK_RETRY_MAX", 6*time.Hour)
+	if err != nil {
+		return OutboundWebhookConfig{}, err
+	}
+	timeout, err := durationFromEnv("WEBHOOK_TIMEOUT", 10*time.Second)
+	if err != nil {
+		return OutboundWebhookConfig{}, err
+	}
+	retention, err := durationFromEnv("WEBHOOK_DELIVERY_RETENTION", 30*24*time.Hour)
+	if err != nil {
+		return OutboundWebhookConfig{}, err
+	}
+	workers, err := intFromEnv("WEBHOOK_WORKERS", 4)
+	if err != nil {
+		return OutboundWebhookConfig{}, err
+	}
+
+	allowPrivate := false
+	if val := os.Getenv("WEBHOOK_ALLOW_PRIVATE_URLS"); val != "" {
+		allowPrivate, err = strconv.ParseBool(val)
+		if err != nil {
+			return OutboundWebhookConfig{}, fmt.Errorf("invalid WEBHOOK_ALLOW_PRIVATE_URLS %q", val)
+		}
+	}
+
+	if maxAttempts < 1 || baseDelay <= 0 || maxDelay < baseDelay || timeout <= 0 || retention < 0 || workers < 1 {
+		return OutboundWebhookConfig{}, fmt.Errorf("invalid webhook delivery policy: %d attempts, base %s, max %s, timeout %s, retention %s, %d workers", maxAttempts, baseDelay, maxDelay, timeout, retention, workers)
+	}
+
+	return OutboundWebhookConfig{
+		Retry:            database.RetryPolicy{MaxAttempts: maxAttempts, BaseDelay: baseDelay, MaxDelay: maxDelay},
+		AllowPrivateURLs: allowPrivate,
+		Sender:           webhook.NewSender(timeout, allowPrivate),
+		Retention:        retention,
+		Workers:          workers,
+	}, nil
+}
+
+// StartWebhookDelivery sends due webhook deliveries every interval until
+// stop is closed. Deliveries past their retention are pruned every
+// webhookPruneInterval.
+func (cfg *apiConfig) StartWebhookDelivery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		var lastPruned time.Time
+		for {
+			select {
+			case <-ticker.C:
+				cfg.deliverWebhooks()
+				if time.Since(lastPruned) >= webhookPruneInterval {
+					cfg.pruneWebhookDeliveries()
+					lastPruned = time.Now()
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// deliverWebhooks attempts the due deliveries. Each endpoint's deliveries
+// are sent in order by one of Workers workers, so that a slow endpoint only
+// holds up its own deliveries. Once an attempt at an endpoint fails, the rest
+// of its deliveries wait for the next round.
+func (cfg *apiConfig) deliverWebhooks() {
+	due, err := cfg.DB.DueWebhookDeliveries(time.Now())
+	if err != nil {
+		slog.Error("Couldn't load webhook deliveries", "error", err)
+		return
+	}
+
+	byEndpoint := map[string][]database.DueWebhookDelivery{}
+	endpoints := []string{}
+	for _, d := range due {
+		if _, seen := byEndpoint[d.Endpoint.ID]; !seen {
+			endpoints = append(endpoints, d.Endpoint.ID)
+		}
+		byEndpoint[d.Endpoint.ID] = append(byEndpoint[d.Endpoint.ID], d)
+	}
+
+	queue := make(chan []database.DueWebhookDelivery)
+	var wg sync.WaitGroup
+	for range min(max(cfg.OutboundWebhooks.Workers, 1), len(endpoints)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for deliveries := range queue {
+				for _, d := range deliveries {
+					if !cfg.deliverWebhook(d) {
+						break
+					}
+				}
+			}
+		}()
+	}
+	for _, id := range endpoints {
+		queue <- byEndpoint[id]
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// deliverWebhook makes one attempt at a delivery and records it. It reports
+// whether the endpoint accepted the delivery.
+func (cfg *apiConfig) deliverWebhook(d database.DueWebhookDelivery) bool {
+	secret, err := cfg.DB.WebhookEndpointSecret(d.Endpoint)
+	if err != nil {
+		slog.Error("Couldn't decrypt webhook secret", "endpoint_id", d.Endpoint.ID, "error", err)
+		return false
+	}
+
+	now := time.Now().UTC()
+	resp, sendErr := cfg.OutboundWebhooks.Sender.Send(context.Background(), webhook.Delivery{
+		ID:     d.Delivery.ID,
+		Event:  d.Delivery.Event,
+		URL:    d.Endpoint.URL,
+		Secret: secret,
+		Body:   d.Delivery.Payload,
+	}, now)
+
+	attempt := database.WebhookAttempt{
+		At:         now,
+		StatusCode: resp.StatusCode,
+		Response:   resp.Body,
+		DurationMs: resp.Duration.Milliseconds(),
+	}
+	if sendErr != nil {
+		attempt.Error = sendErr.Error()
+	}
+	succeeded := sendErr == nil && resp.Succeeded()
+
+	delivery, err := cfg.DB.RecordWebhookAttempt(d.Delivery.ID, attempt, succeeded, cfg.OutboundWebhooks.Retry)
+	if err != nil {
+		slog.Error("Couldn't record webhook delivery", "delivery_id", d.Delivery.ID, "error", err)
+		return succeeded
+	}
+	if delivery.Status == database.WebhookDeliveryDead {
+		slog.Warn("Webhook delivery is dead", "delivery_id", delivery.ID, "endpoint_id", delivery.EndpointID, "attempts", delivery.Attempts)
+	}
+	return succeeded
+}
+
+// pruneWebhookDeliveries deletes finished deliveries that are past their
+// retention.
+func (cfg *apiConfig) pruneWebhookDeliveries() {
+	if cfg.OutboundWebhooks.Retention == 0 {
+		return
+	}
+	pruned, err := cfg.DB.PruneWebhookDeliveries(time.Now().Add(-cfg.OutboundWebhooks.Retention))
+	if err != nil {
+		slog.Error("Couldn't prune webhook deliveries", "error", err)
+		return
+	}
+	if pruned > 0 {
+		slog.Info("Pruned webhook deliveries", "count", pruned)
+	}
+}
+
+// enqueueWebhooks is the event bus subscriber that queues deliveries of
+// domain events to webhook endpoints.
+func (cfg *apiConfig) enqueueWebhooks(ctx context.Context, event database.Event) error {
+	_, err := cfg.DB.WithContext(ctx).EnqueueWebhookEvent(event)
+	return err
+}
+
+type WebhookEndpoint struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	AllUsers  bool      `json:"all_users"`
+	CreatedAt time.Time `json:"created_at"`
+	// Secret is only set in the response to creating the endpoint.
+	Secret string `json:"secret,omitempty"`
+}
+
+func webhookEndpointFromDB(e database.WebhookEndpoint) WebhookEndpoint {
+	return WebhookEndpoint{
+		ID:        e.ID,
+		URL:       e.URL,
+		Events:    e.Events,
+		AllUsers:  e.AllUsers,
+		CreatedAt: e.CreatedAt,
+	}
+}
+
+type WebhookDelivery struct {
+	ID            string                    `json:"id"`
+	EndpointID    string                    `json:"endpoint_id"`
+	EventID       string                    `json:"event_id"`
+	Event         string                    `json:"event"`
+	Payload       json.RawMessage           `json:"payload"`
+	Status        string                    `json:"status"`
+	Attempts      int                       `json:"attempts"`
+	NextAttemptAt *time.Time                `json:"next_attempt_at"`
+	CreatedAt     time.Time                 `json:"created_at"`
+	Log           []database.WebhookAttempt `json:"log"`
+}
+
+func webhookDeliveryFromDB(d database.WebhookDelivery) WebhookDelivery {
+	delivery := WebhookDelivery{
+		ID:         d.ID,
+		EndpointID: d.EndpointID,
+		EventID:    d.EventID,
+		Event:      d.Event,
+		Payload:    d.Payload,
+		Status:     d.Status,
+		Attempts:   d.Attempts,
+		CreatedAt:  d.CreatedAt,
+		Log:        d.Log,
+	}
+	if !d.NextAttemptAt.IsZero() {
+		delivery.NextAttemptAt = &d.NextAttemptAt
+	}
+	return delivery
+}
+
+// validWebhookURL reports whether rawURL can be registered. Plain http is
+// only accepted while private URLs are allowed; the sender separately
+// refuses to connect to private addresses.
+func (cfg *apiConfig) validWebhookURL(rawURL string) bool {
+	if len(rawURL) > maxWebhookURLLength {
+		return false
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" || u.User != nil || u.Fragment != "" {
+		return false
+	}
+	return u.Scheme == "https" || (u.Scheme == "http" && cfg.OutboundWebhooks.AllowPrivateURLs)
+}
+
+func (cfg *apiConfig) handlerWebhookEndpointCreate(w http.ResponseWriter, r *http.Request) {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		respondWithAuthError(w, r, http.StatusUnauthorized, "", "")
+		return
+	}
+
+	type parameters struct {
+		URL      string   `json:"url"`
+		Events   []string `json:"events"`
+		AllUsers bool     `json:"all_users"`
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	if params.AllUsers && !principal.HasRole(roleAdmin) {
+		respondWithError(w, r, http.StatusForbidden, "Only admins can register endpoints for all users")
+		return
+	}
+
+	errs := []fieldError{}
+	endpointURL := strings.TrimSpace(params.URL)
+	if !cfg.validWebhookURL(endpointURL) {
+		errs = append(errs, fieldError{Field: "url", Message: "URL must be an absolute https URL without credentials or fragment"})
+	}
+
+	events := []string{}
+	for _, event := range params.Events {
+		if !slices.Contains(database.EventTypes, event) {
+			errs = append(errs, fieldError{Field: "events", Message: "Unknown event " + event + ". " + webhookEventsMessage})
+			continue
+		}
+		if !slices.Contains(events, event) {
+			events = append(events, event)
+		}
+	}
+	if len(params.Events) == 0 {
+		errs = append(errs, fieldError{Field: "events", Message: webhookEventsMessage})
+	}
+
+	if len(errs) > 0 {
+		respondWithValidationError(w, r, errs)
+		return
+	}
+
+	existing, err := cfg.DB.WithContext(r.Context()).GetWebhookEndpoints(principal.UserID)
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't retrieve webhook endpoints")
+		return
+	}
+	if len(existing) >= maxWebhookEndpoints {
+		respondWithError(w, r, http.StatusConflict, fmt.Sprintf("At most %d webhook endpoints can be registered", maxWebhookEndpoints))
+		return
+	}
+
+	secret, err := generateSecureToken()
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't generate secret")
+		return
+	}
+	secret = webhookSecretPrefix + secret
+
+	dbEndpoint, err := cfg.DB.WithContext(r.Context()).CreateWebhookEndpoint(principal.UserID, params.AllUsers, endpointURL, events, secret)
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't create webhook endpoint")
+		return
+	}
+
+	endpoint := webhookEndpointFromDB(dbEndpoint)
+	endpoint.Secret = secret
+	respondWithJSON(w, r, http.StatusCreated, endpoint)
+}
+
+func (cfg *apiConfig) handlerWebhookEndpointsList(w http.ResponseWriter, r *http.Request) {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		respondWithAuthError(w, r, http.StatusUnauthorized, "", "")
+		return
+	}
+
+	dbEndpoints, err := cfg.DB.WithContext(r.Context()).GetWebhookEndpoints(principal.UserID)
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't retrieve webhook endpoints")
+		return
+	}
+
+	endpoints := []WebhookEndpoint{}
+	for _, dbEndpoint := range dbEndpoints {
+		endpoints = append(endpoints, webhookEndpointFromDB(dbEndpoint))
+	}
+
+	respondWithJSON(w, r, http.StatusOK, endpoints)
+}
+
+func (cfg *apiConfig) handlerWebhookEndpointDelete(w http.ResponseWriter, r *http.Request) {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		respondWithAuthError(w, r, http.StatusUnauthorized, "", "")
+		return
+	}
+
+	err := cfg.DB.WithContext(r.Context()).DeleteWebhookEndpoint(principal.UserID, r.PathValue("endpointId"))
+	if errors.Is(err, database.ErrWebhookEndpointNotFound) {
+		respondWithError(w, r, http.StatusNotFound, "Webhook endpoint not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't delete webhook endpoint")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseDeliveryStatus reads the optional ?status filter of a delivery list.
+func parseDeliveryStatus(r *http.Request) (string, bool) {
+	status := r.URL.Query().Get("status")
+	statuses := []string{
+		database.WebhookDeliveryPending,
+		database.WebhookDeliverySucceeded,
+		database.WebhookDeliveryDead,
+	}
+	return status, status == "" || slices.Contains(statuses, status)
+}
+
+// handlerWebhookDeliveriesList responds with the delivery log of one of the
+// caller's endpoints. ?status=dead lists its dead letters.
+func (cfg *apiConfig) handlerWebhookDeliveriesList(w http.ResponseWriter, r *http.Request) {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		respondWithAuthError(w, r, http.StatusUnauthorized, "", "")
+		return
+	}
+
+	status, ok := parseDeliveryStatus(r)
+	if !ok {
+		respondWithError(w, r, http.StatusBadRequest, "Unknown status "+status)
+		return
+	}
+
+	endpoint, err := cfg.DB.WithContext(r.Context()).GetWebhookEndpoint(principal.UserID, r.PathValue("endpointId"))
+	if errors.Is(err, database.ErrWebhookEndpointNotFound) {
+		respondWithError(w, r, http.StatusNotFound, "Webhook endpoint not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't retrieve webhook endpoint")
+		return
+	}
+
+	cfg.respondWithDeliveries(w, r, endpoint.ID, status)
+}
+
+func (cfg *apiConfig) respondWithDeliveries(w http.ResponseWriter, r *http.Request, endpointId, status string) {
+	dbDeliveries, err := cfg.DB.WithContext(r.Context()).GetWebhookDeliveries(endpointId, status)
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't retrieve webhook deliveries")
+		return
+	}
+
+	deliveries := []WebhookDelivery{}
+	for _, dbDelivery := range dbDeliveries {
+		deliveries = append(deliveries, webhookDeliveryFromDB(dbDelivery))
+	}
+
+	respondWithJSON(w, r, http.StatusOK, deliveries)
+}
+
+// handlerWebhookDeliveryRetry queues a delivery again, typically a dead
+// letter once the receiver has been fixed.
+func (cfg *apiConfig) handlerWebhookDeliveryRetry(w http.ResponseWriter, r *http.Request) {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		respondWithAuthError(w, r, http.StatusUnauthorized, "", "")
+		return
+	}
+
+	endpoint, err := cfg.DB.WithContext(r.Context()).GetWebhookEndpoint(principal.UserID, r.PathValue("endpointId"))
+	if errors.Is(err, database.ErrWebhookEndpointNotFound) {
+		respondWithError(w, r, http.StatusNotFound, "Webhook endpoint not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't retrieve webhook endpoint")
+		return
+	}
+
+	delivery, err := cfg.DB.WithContext(r.Context()).RetryWebhookDelivery(endpoint.ID, r.PathValue("deliveryId"))
+	if errors.Is(err, database.ErrWebhookDeliveryNotFound) {
+		respondWithError(w, r, http.StatusNotFound, "Webhook delivery not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't retry webhook delivery")
+		return
+	}
+
+	respondWithJSON(w, r, http.StatusAccepted, webhookDeliveryFromDB(delivery))
+}
+
+// handlerWebhookDeliveriesAdmin lists deliveries to every endpoint, such as
+// the whole dead-letter list with ?status=dead.
+func (cfg *apiConfig) handlerWebhookDeliveriesAdmin(w http.ResponseWriter, r *http.Request) {
+	status, ok := parseDeliveryStatus(r)
+	if !ok {
+		respondWithError(w, r, http.StatusBadRequest, "Unknown status "+status)
+		return
+	}
+
+	cfg.respondWithDeliveries(w, r, "", status)
+}
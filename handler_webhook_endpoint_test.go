@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Raihanki/Chirpy/internal/database"
+	"github.com/Raihanki/Chirpy/internal/webhook"
+)
+
+// webhookReceiver is a test endpoint that answers deliveries with the given
+// statuses in turn, repeating the last one, and checks their signatures.
+type webhookReceiver struct {
+	t        *testing.T
+	secret   string
+	statuses []int
+
+	mu       sync.Mutex
+	received int
+}
+
+func (rcv *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		rcv.t.Error(err)
+	}
+	err = webhook.Verify(r.Header, webhook.TimestampHeader, webhook.SignatureHeader, body, [][]byte{[]byte(rcv.secret)}, time.Now(), time.Minute)
+	if err != nil {
+		rcv.t.Errorf("delivery signature: %v", err)
+	}
+
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	status := rcv.statuses[min(rcv.received, len(rcv.statuses)-1)]
+	rcv.received++
+	w.WriteHeader(status)
+}
+
+// newWebhookTest registers an endpoint for rcv and queues one delivery to
+// it under policy. It returns the config and the endpoint's ID.
+func newWebhookTest(t *testing.T, rcv *webhookReceiver, policy database.RetryPolicy) (*apiConfig, string) {
+	t.Helper()
+
+	server := httptest.NewServer(rcv)
+	t.Cleanup(server.Close)
+
+	cfg := newTestConfig(t)
+	cfg.OutboundWebhooks = OutboundWebhookConfig{
+		Retry:            policy,
+		AllowPrivateURLs: true,
+		Sender:           webhook.NewSender(time.Second, true),
+	}
+
+	endpoint, err := cfg.DB.CreateWebhookEndpoint(1, false, server.URL, []string{database.EventChirpCreated}, rcv.secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued, err := cfg.DB.EnqueueWebhookEvent(database.Event{
+		ID:        1,
+		Type:      database.EventChirpCreated,
+		UserID:    1,
+		Data:      json.RawMessage(`{"chirp":{"id":1,"body":"hello","author_id":1}}`),
+		CreatedAt: time.Now().UTC(),
+	})
+	if err != nil || queued != 1 {
+		t.Fatalf("EnqueueWebhookEvent() = %d, %v, want 1 delivery", queued, err)
+	}
+	return cfg, endpoint.ID
+}
+
+func getDelivery(t *testing.T, cfg *apiConfig, endpointId string) database.WebhookDelivery {
+	t.Helper()
+
+	deliveries, err := cfg.DB.GetWebhookDeliveries(endpointId, "")
+	if err != nil || len(deliveries) != 1 {
+		t.Fatalf("GetWebhookDeliveries() = %d deliveries, %v, want 1", len(deliveries), err)
+	}
+	return deliveries[0]
+}
+
+// deliverWhenDue waits for the delivery's next attempt and runs the worker.
+func deliverWhenDue(t *testing.T, cfg *apiConfig, delivery database.WebhookDelivery) {
+	t.Helper()
+	time.Sleep(time.Until(delivery.NextAttemptAt))
+	cfg.deliverWebhooks()
+}
+
+func TestWebhookDeliveryBacksOffUntilDead(t *testing.T) {
+	rcv := &webhookReceiver{t: t, secret: "whsec_test", statuses: []int{http.StatusInternalServerError}}
+	policy := database.RetryPolicy{MaxAttempts: 3, BaseDelay: 20 * time.Millisecond, MaxDelay: 30 * time.Millisecond}
+	cfg, endpointId := newWebhookTest(t, rcv, policy)
+
+	// Each retry waits twice as long as the one before, up to MaxDelay.
+	wantDelays := []time.Duration{20 * time.Millisecond, 30 * time.Millisecond}
+
+	cfg.deliverWebhooks()
+	for attempt, want := range wantDelays {
+		delivery := getDelivery(t, cfg, endpointId)
+		if delivery.Status != database.WebhookDeliveryPending || delivery.Attempts != attempt+1 {
+			t.Fatalf("after attempt %d: status %s with %d attempts", attempt+1, delivery.Status, delivery.Attempts)
+		}
+		last := delivery.Log[len(delivery.Log)-1]
+		if last.StatusCode != http.StatusInternalServerError {
+			t.Errorf("attempt %d: logged status %d", attempt+1, last.StatusCode)
+		}
+		if got := delivery.NextAttemptAt.Sub(last.At); got != want {
+			t.Errorf("attempt %d: retry after %s, want %s", attempt+1, got, want)
+		}
+
+		// The worker leaves deliveries alone until they are due.
+		cfg.deliverWebhooks()
+		if got := getDelivery(t, cfg, endpointId).Attempts; got != attempt+1 {
+			t.Fatalf("delivery was retried early: %d attempts", got)
+		}
+
+		deliverWhenDue(t, cfg, delivery)
+	}
+
+	delivery := getDelivery(t, cfg, endpointId)
+	if delivery.Status != database.WebhookDeliveryDead || delivery.Attempts != policy.MaxAttempts {
+		t.Errorf("final status %s with %d attempts, want %s with %d", delivery.Status, delivery.Attempts, database.WebhookDeliveryDead, policy.MaxAttempts)
+	}
+	if !delivery.NextAttemptAt.IsZero() {
+		t.Errorf("dead delivery is scheduled for %s", delivery.NextAttemptAt)
+	}
+	if rcv.received != policy.MaxAttempts {
+		t.Errorf("receiver got %d requests, want %d", rcv.received, policy.MaxAttempts)
+	}
+}
+
+func TestWebhookDeliverySucceedsOnRetry(t *testing.T) {
+	rcv := &webhookReceiver{t: t, secret: "whsec_test", statuses: []int{http.StatusServiceUnavailable, http.StatusNoContent}}
+	policy := database.RetryPolicy{MaxAttempts: 5, BaseDelay: 10 * time.Millisecond, MaxDelay: time.Second}
+	cfg, endpointId := newWebhookTest(t, rcv, policy)
+
+	cfg.deliverWebhooks()
+	deliverWhenDue(t, cfg, getDelivery(t, cfg, endpointId))
+
+	delivery := getDelivery(t, cfg, endpointId)
+	if delivery.Status != database.WebhookDeliverySucceeded || delivery.Attempts != 2 {
+		t.Fatalf("status %s with %d attempts, want %s with 2", delivery.Status, delivery.Attempts, database.WebhookDeliverySucceeded)
+	}
+
+	// Succeeded deliveries are no longer sent.
+	cfg.deliverWebhooks()
+	if rcv.received != 2 {
+		t.Errorf("receiver got %d requests, want 2", rcv.received)
+	}
+}
+
+func TestPruneWebhookDeliveries(t *testing.T) {
+	rcv := &webhookReceiver{t: t, secret: "whsec_test", statuses: []int{http.StatusNoContent}}
+	policy := database.RetryPolicy{MaxAttempts: 1, BaseDelay: time.Second, MaxDelay: time.Second}
+	cfg, endpointId := newWebhookTest(t, rcv, policy)
+	cfg.OutboundWebhooks.Retention = time.Hour
+
+	// Pending deliveries are never pruned.
+	pruned, err := cfg.DB.PruneWebhookDeliveries(time.Now().Add(time.Hour))
+	if err != nil || pruned != 0 {
+		t.Fatalf("PruneWebhookDeliveries() of a pending delivery = %d, %v", pruned, err)
+	}
+
+	cfg.deliverWebhooks()
+	cfg.pruneWebhookDeliveries()
+	getDelivery(t, cfg, endpointId)
+
+	pruned, err = cfg.DB.PruneWebhookDeliveries(time.Now().Add(time.Minute))
+	if err != nil || pruned != 1 {
+		t.Fatalf("PruneWebhookDeliveries() = %d, %v, want 1", pruned, err)
+	}
+}
+
+func TestSlowEndpointDoesNotHoldUpOthers(t *testing.T) {
+	blackhole := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-blackhole
+	}))
+	t.Cleanup(slow.Close)
+	t.Cleanup(func() { close(blackhole) })
+
+	rcv := &webhookReceiver{t: t, secret: "whsec_fast", statuses: []int{http.StatusNoContent}}
+	fast := httptest.NewServer(rcv)
+	t.Cleanup(fast.Close)
+
+	const timeout = 200 * time.Millisecond
+	cfg := newTestConfig(t)
+	cfg.OutboundWebhooks = OutboundWebhookConfig{
+		Retry:            database.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Minute, MaxDelay: time.Minute},
+		AllowPrivateURLs: true,
+		Sender:           webhook.NewSender(timeout, true),
+		Workers:          2,
+	}
+	slowEndpoint, err := cfg.DB.CreateWebhookEndpoint(1, false, slow.URL, []string{database.EventChirpCreated}, "whsec_slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fastEndpoint, err := cfg.DB.CreateWebhookEndpoint(1, false, fast.URL, []string{database.EventChirpCreated}, rcv.secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const events = 3
+	for id := 1; id <= events; id++ {
+		_, err := cfg.DB.EnqueueWebhookEvent(database.Event{ID: id, Type: database.EventChirpCreated, UserID: 1, Data: json.RawMessage(`{}`), CreatedAt: time.Now().UTC()})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := time.Now()
+	cfg.deliverWebhooks()
+	if elapsed := time.Since(start); elapsed >= 2*timeout {
+		t.Errorf("delivery took %s, want less than %s", elapsed, 2*timeout)
+	}
+
+	succeeded, err := cfg.DB.GetWebhookDeliveries(fastEndpoint.ID, database.WebhookDeliverySucceeded)
+	if err != nil || len(succeeded) != events {
+		t.Errorf("fast endpoint: %d deliveries succeeded, %v, want %d", len(succeeded), err, events)
+	}
+
+	// Only the first delivery to the unresponsive endpoint is attempted.
+	attempted := 0
+	deliveries, err := cfg.DB.GetWebhookDeliveries(slowEndpoint.ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range deliveries {
+		attempted += d.Attempts
+	}
+	if attempted != 1 {
+		t.Errorf("slow endpoint: %d attempts, want 1", attempted)
+	}
+}
+
+func TestWebhookSecretsAreEncrypted(t *testing.T) {
+	cfg := newTestConfig(t)
+
+	endpoint, err := cfg.DB.CreateWebhookEndpoint(1, false, "https://hooks.example.com", []string{database.EventChirpCreated}, "whsec_new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(endpoint.EncryptedSecret, "whsec_new") {
+		t.Error("the secret of a new endpoint is stored in plaintext")
+	}
+	secret, err := cfg.DB.WebhookEndpointSecret(endpoint)
+	if err != nil || secret != "whsec_new" {
+		t.Errorf("WebhookEndpointSecret() = %q, %v, want %q", secret, err, "whsec_new")
+	}
+
+	// Endpoints stored before secrets were encrypted are migrated.
+	path := filepath.Join(t.TempDir(), "database.json")
+	legacy := `{"webhook_endpoints":{"e1":{"id":"e1","owner_id":1,"url":"https://hooks.example.com","events":["chirp.created"],"secret":"whsec_legacy"}}}`
+	err = os.WriteFile(path, []byte(legacy), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := database.NewDB(path, []byte("test-hash-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(stored), "whsec_legacy") {
+		t.Error("the legacy secret is still stored in plaintext")
+	}
+	migrated, err := db.GetWebhookEndpoint(1, "e1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err = db.WebhookEndpointSecret(migrated)
+	if err != nil || secret != "whsec_legacy" {
+		t.Errorf("migrated WebhookEndpointSecret() = %q, %v, want %q", secret, err, "whsec_legacy")
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Raihanki/Chirpy/internal/webhook"
+)
+
+func TestPolkaWebhookAuthentication(t *testing.T) {
+	const tolerance = 5 * time.Minute
+	current := []byte("whsec_current")
+	previous := []byte("whsec_previous")
+	signed := PolkaWebhookConfig{Secrets: [][]byte{current}, Tolerance: tolerance}
+	rotating := PolkaWebhookConfig{Secrets: [][]byte{current, previous}, Tolerance: tolerance}
+	unsigned := PolkaWebhookConfig{LegacyAPIKey: "polka-key", Tolerance: tolerance}
+	optedIn := unsigned
+	optedIn.AllowUnsigned = true
+
+	// signature returns the headers of a delivery signed with secret at
+	// the given offset from now.
+	signature := func(secret []byte, offset time.Duration) func(body []byte) http.Header {
+		return func(body []byte) http.Header {
+			timestamp := strconv.FormatInt(time.Now().Add(offset).Unix(), 10)
+			header := http.Header{}
+			header.Set(polkaTimestampHeader, timestamp)
+			header.Set(polkaSignatureHeader, "v1="+webhook.Sign(secret, timestamp, body))
+			return header
+		}
+	}
+	apiKey := func(key string) func([]byte) http.Header {
+		return func([]byte) http.Header {
+			header := http.Header{}
+			header.Set("Authorization", "ApiKey "+key)
+			return header
+		}
+	}
+
+	tests := []struct {
+		name   string
+		config PolkaWebhookConfig
+		header func(body []byte) http.Header
+		status int
+	}{
+		{"valid signature", signed, signature(current, 0), http.StatusNoContent},
+		{"signed with another secret", signed, signature(previous, 0), http.StatusUnauthorized},
+		{"second active secret", rotating, signature(previous, 0), http.StatusNoContent},
+		{"timestamp too old", signed, signature(current, -tolerance-time.Minute), http.StatusUnauthorized},
+		{"timestamp too far ahead", signed, signature(current, tolerance+time.Minute), http.StatusUnauthorized},
+		{"timestamp within tolerance", signed, signature(current, -tolerance+time.Minute), http.StatusNoContent},
+		{"unsigned", signed, func([]byte) http.Header { return http.Header{} }, http.StatusUnauthorized},
+		{"API key while signing is configured", PolkaWebhookConfig{Secrets: signed.Secrets, Tolerance: tolerance, LegacyAPIKey: "polka-key", AllowUnsigned: true}, apiKey("polka-key"), http.StatusUnauthorized},
+		{"API key without opting in", unsigned, apiKey("polka-key"), http.StatusUnauthorized},
+		{"API key after opting in", optedIn, apiKey("polka-key"), http.StatusNoContent},
+		{"wrong API key after opting in", optedIn, apiKey("wrong-key"), http.StatusUnauthorized},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			cfg.PolkaWebhook = tt.config
+			h := cfg.routes(t.TempDir())
+
+			user, err := cfg.DB.CreateUser("polka@example.com", "correct horse battery")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			body := []byte(fmt.Sprintf(`{"id":"evt_%d","event":"user.upgraded","data":{"user_id":%d}}`, i, user.ID))
+			req := httptest.NewRequest(http.MethodPost, "/api/polka/webhooks", strings.NewReader(string(body)))
+			for key, values := range tt.header(body) {
+				req.Header[key] = values
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+
+			// Only authenticated webhooks change the subscription.
+			user, err = cfg.DB.GetUserById(user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.IsChirpyRed != (tt.status == http.StatusNoContent) {
+				t.Errorf("IsChirpyRed = %v after status %d", user.IsChirpyRed, rec.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// UserData is everything stored about one user, as included in a data
+// export.
+type UserData struct {
+	User         User
+	Chirps       []Chirp
+	Sessions     []Session
+	APITokens    []APIToken
+	OAuthClients []OAuthClient
+
+	WebhookEndpoints []WebhookEndpoint
+}
+
+var (
+	ErrDeletionScheduled    = errors.New("account deletion is already scheduled")
+	ErrDeletionNotScheduled = errors.New("account deletion is not scheduled")
+)
+
+// GetUserData collects a user's records from a single snapshot of the
+// database.
+func (db *DB) GetUserData(userId int) (UserData, error) {
+	data, err := db.LoadDB()
+	if err != nil {
+		return UserData{}, err
+	}
+
+	user, exists := data.Users[userId]
+	if !exists {
+		return UserData{}, ErrUserNotFound
+	}
+
+	userData := UserData{
+		User:         user,
+		Chirps:       []Chirp{},
+		Sessions:     []Session{},
+		APITokens:    []APIToken{},
+		OAuthClients: []OAuthClient{},
+
+		WebhookEndpoints: []WebhookEndpoint{},
+	}
+	for _, c := range data.Chirps {
+		if c.AuthorId == userId {
+			userData.Chirps = append(userData.Chirps, c)
+		}
+	}
+	for _, s := range data.Sessions {
+		if s.UserID == userId {
+			userData.Sessions = append(userData.Sessions, s)
+		}
+	}
+	for _, t := range data.APITokens {
+		if t.UserID == userId {
+			userData.APITokens = append(userData.APITokens, t)
+		}
+	}
+	for _, c := range data.OAuthClients {
+		if c.OwnerID == userId {
+			userData.OAuthClients = append(userData.OAuthClients, c)
+		}
+	}
+	for _, e := range data.WebhookEndpoints {
+		if e.OwnerID == userId {
+			userData.WebhookEndpoints = append(userData.WebhookEndpoints, e)
+		}
+	}
+
+	sort.Slice(userData.Chirps, func(i, j int) bool {
+		return userData.Chirps[i].Id < userData.Chirps[j].Id
+	})
+
+	return userData, nil
+}
+
+// ScheduleUserDeletion marks the account to be purged at purgeAt. Until then
+// the user can cancel with CancelUserDeletion.
+func (db *DB) ScheduleUserDeletion(userId int, purgeAt time.Time) (User, error) {
+	user := User{}
+	err := db.update(func(data *DBStructure) error {
+		stored, exists := data.Users[userId]
+		if !exists {
+			return ErrUserNotFound
+		}
+		if !stored.DeletionScheduledAt.IsZero() {
+			return ErrDeletionScheduled
+		}
+
+		stored.DeletionScheduledAt = purgeAt
+		data.Users[userId] = stored
+		user = stored
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+func (db *DB) CancelUserDeletion(userId int) error {
+	return db.update(func(data *DBStructure) error {
+		user, exists := data.Users[userId]
+		if !exists {
+			return ErrUserNotFound
+		}
+		if user.DeletionScheduledAt.IsZero() {
+			return ErrDeletionNotScheduled
+		}
+
+		user.DeletionScheduledAt = time.Time{}
+		data.Users[userId] = user
+		return nil
+	})
+}
+
+// PurgeDeletedUsers removes every account whose deletion is due, along with
+// its sessions, tokens, OAuth clients, pending grants and failed logins. The
+// user's chirps are deleted, or kept without an author if anonymizeChirps is
+// set. Webhook deliveries about the user are dropped, inbound webhook events
+// about the user are scrubbed, and chirps are removed from the user's events
+// still in the outbox. It returns the IDs of the purged users.
+func (db *DB) PurgeDeletedUsers(now time.Time, anonymizeChirps bool) ([]int, error) {
+	purged := []int{}
+	err := db.update(func(data *DBStructure) error {
+		for id, user := range data.Users {
+			if user.DeletionScheduledAt.IsZero() || now.Before(user.DeletionScheduledAt) {
+				continue
+			}
+
+			err := data.purgeUser(user, anonymizeChirps)
+			if err != nil {
+				return err
+			}
+			purged = append(purged, id)
+		}
+
+		if len(purged) == 0 {
+			return errUnchanged
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Ints(purged)
+	return purged, nil
+}
+
+func (data *DBStructure) purgeUser(user User, anonymizeChirps bool) error {
+	id := user.ID
+	err := data.scrubUserEvents(id)
+	if err != nil {
+		return err
+	}
+	for deliveryId, delivery := range data.WebhookDeliveries {
+		if delivery.concerns(id) {
+			delete(data.WebhookDeliveries, deliveryId)
+		}
+	}
+	// Inbound events stay in the ledger so that redeliveries are still
+	// recognized, but lose the payload and result that identify the user.
+	for key, event := range data.WebhookEvents {
+		if event.concerns(id) {
+			event.Payload = nil
+			event.Result = ""
+			data.WebhookEvents[key] = event
+		}
+	}
+
+	for chirpId, c := range data.Chirps {
+		if c.AuthorId != id {
+			continue
+		}
+		eventType := EventChirpDeleted
+		if anonymizeChirps {
+			eventType = EventChirpUpdated
+			c.AuthorId = 0
+			data.Chirps[chirpId] = c
+		} else {
+			delete(data.Chirps, chirpId)
+			c = Chirp{Id: c.Id}
+		}
+		err := data.recordEvent(eventType, id, ChirpEvent{Chirp: c})
+		if err != nil {
+			return err
+		}
+	}
+
+	data.deleteUserSessions(id)
+	for hash, t := range data.APITokens {
+		if t.UserID == id {
+			delete(data.APITokens, hash)
+		}
+	}
+	for clientId, c := range data.OAuthClients {
+		if c.OwnerID == id {
+			data.deleteOAuthClient(clientId)
+		}
+	}
+	for endpointId, e := range data.WebhookEndpoints {
+		if e.OwnerID == id {
+			data.deleteWebhookEndpoint(endpointId)
+		}
+	}
+	for hash, code := range data.AuthorizationCodes {
+		if code.UserID == id {
+			delete(data.AuthorizationCodes, hash)
+		}
+	}
+	for hash, r := range data.PasswordResets {
+		if r.UserID == id {
+			delete(data.PasswordResets, hash)
+		}
+	}
+
+	for key := range data.LoginAttempts {
+		if strings.EqualFold(key, AccountAttemptKey(user.Email)) || key == PasswordResetAttemptKey(user.Email) {
+			delete(data.LoginAttempts, key)
+		}
+	}
+
+	delete(data.UserEmails, emailKey(user.Email))
+	delete(data.Users, id)
+
+	return data.recordEvent(EventUserDeleted, id, UserEvent{UserID: id})
+}
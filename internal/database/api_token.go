@@ -0,0 +1,116 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// APIToken is a personal access token. It is stored under the keyed hash of
+// the token, which is only shown to the user once.
+type APIToken struct {
+	ID         string    `json:"id"`
+	UserID     int       `json:"user_id"`
+	Name       string    `json:"name"`
+	Scopes     []string  `json:"scopes"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at,omitempty"`
+	LastUsedAt time.Time `json:"last_used_at,omitempty"`
+}
+
+// apiTokenTouchInterval limits how often LastUsedAt is written back.
+const apiTokenTouchInterval = time.Minute
+
+var (
+	ErrAPITokenNotFound = errors.New("api token not found")
+	ErrAPITokenExpired  = errors.New("api token expired")
+)
+
+func (db *DB) CreateAPIToken(userId int, name string, scopes []string, token string, expiresAt time.Time) (APIToken, error) {
+	id, err := newRandomId()
+	if err != nil {
+		return APIToken{}, err
+	}
+
+	apiToken := APIToken{
+		ID:        id,
+		UserID:    userId,
+		Name:      name,
+		Scopes:    scopes,
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: expiresAt,
+	}
+	err = db.update(func(data *DBStructure) error {
+		data.APITokens[db.hashToken(token)] = apiToken
+		return nil
+	})
+	if err != nil {
+		return APIToken{}, err
+	}
+
+	return apiToken, nil
+}
+
+// ValidateAPIToken looks up a token by its hash and records that it was
+// used.
+func (db *DB) ValidateAPIToken(token string) (APIToken, error) {
+	apiToken := APIToken{}
+	err := db.update(func(data *DBStructure) error {
+		hash := db.hashToken(token)
+		stored, exists := data.APITokens[hash]
+		if !exists {
+			return ErrAPITokenNotFound
+		}
+
+		now := time.Now().UTC()
+		if !stored.ExpiresAt.IsZero() && now.After(stored.ExpiresAt) {
+			return ErrAPITokenExpired
+		}
+
+		apiToken = stored
+		if now.Sub(stored.LastUsedAt) <= apiTokenTouchInterval {
+			return errUnchanged
+		}
+		apiToken.LastUsedAt = now
+		data.APITokens[hash] = apiToken
+		return nil
+	})
+	if err != nil {
+		return APIToken{}, err
+	}
+
+	return apiToken, nil
+}
+
+// GetAPITokens returns a user's tokens, newest first.
+func (db *DB) GetAPITokens(userId int) ([]APIToken, error) {
+	data, err := db.LoadDB()
+	if err != nil {
+		return []APIToken{}, err
+	}
+
+	tokens := []APIToken{}
+	for _, t := range data.APITokens {
+		if t.UserID == userId {
+			tokens = append(tokens, t)
+		}
+	}
+
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.After(tokens[j].CreatedAt)
+	})
+
+	return tokens, nil
+}
+
+func (db *DB) DeleteAPIToken(userId int, id string) error {
+	return db.update(func(data *DBStructure) error {
+		for hash, t := range data.APITokens {
+			if t.ID == id && t.UserID == userId {
+				delete(data.APITokens, hash)
+				return nil
+			}
+		}
+		return ErrAPITokenNotFound
+	})
+}
@@ -0,0 +1,53 @@
+package database
+
+import (
+	"sort"
+	"time"
+)
+
+// Audited actions.
+const (
+	AuditMetricsReset = "metrics.reset"
+)
+
+// AuditEntry records an administrative action and who took it.
+type AuditEntry struct {
+	ID      int       `json:"id"`
+	At      time.Time `json:"at"`
+	ActorID int       `json:"actor_id"`
+	Action  string    `json:"action"`
+	Detail  string    `json:"detail,omitempty"`
+}
+
+// RecordAudit appends an entry to the audit log. Its ID and time are
+// assigned here.
+func (db *DB) RecordAudit(actorId int, action, detail string) (AuditEntry, error) {
+	entry := AuditEntry{}
+	err := db.update(func(data *DBStructure) error {
+		data.LastAuditID++
+		entry = AuditEntry{
+			ID:      data.LastAuditID,
+			At:      time.Now().UTC(),
+			ActorID: actorId,
+			Action:  action,
+			Detail:  detail,
+		}
+		data.AuditLog = append(data.AuditLog, entry)
+		return nil
+	})
+	return entry, err
+}
+
+// GetAuditLog returns the audit log, newest entry first.
+func (db *DB) GetAuditLog() ([]AuditEntry, error) {
+	data, err := db.LoadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := append([]AuditEntry{}, data.AuditLog...)
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ID > entries[j].ID
+	})
+	return entries, nil
+}
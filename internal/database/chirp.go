@@ -11,23 +11,26 @@ type Chirp struct {
 	AuthorId int    `json:"author_id"`
 }
 
-func (db *DB) CreateChirp(body string, userId int) (Chirp, error) {
-	data, errLoadDb := db.LoadDB()
-	if errLoadDb != nil {
-		return Chirp{}, errLoadDb
-	}
+var (
+	ErrChirpNotFound  = errors.New("chirp not found")
+	ErrNotChirpAuthor = errors.New("chirp belongs to another user")
+)
 
-	newId := len(data.Chirps) + 1
-	chirp := Chirp{
-		Id:       newId,
-		Body:     body,
-		AuthorId: userId,
-	}
-	data.Chirps[newId] = chirp
+func (db *DB) CreateChirp(body string, userId int) (Chirp, error) {
+	chirp := Chirp{}
+	err := db.update(func(data *DBStructure) error {
+		data.LastChirpID++
+		chirp = Chirp{
+			Id:       data.LastChirpID,
+			Body:     body,
+			AuthorId: userId,
+		}
+		data.Chirps[chirp.Id] = chirp
 
-	errWriteDb := db.WriteDB(data)
-	if errWriteDb != nil {
-		return Chirp{}, errWriteDb
+		return data.recordEvent(EventChirpCreated, userId, ChirpEvent{Chirp: chirp})
+	})
+	if err != nil {
+		return Chirp{}, err
 	}
 
 	return chirp, nil
@@ -61,28 +64,48 @@ func (db *DB) GetChirpById(id int) (Chirp, error) {
 		return Chirp{}, err
 	}
 
-	var chirp Chirp
-	for _, c := range data.Chirps {
-		if c.Id == id {
-			chirp = c
-			break
-		}
+	chirp, exists := data.Chirps[id]
+	if !exists {
+		return Chirp{}, ErrChirpNotFound
 	}
 
 	return chirp, nil
 }
 
-func (db *DB) DeleteChirp(chirp Chirp) error {
-	data, err := db.LoadDB()
+// UpdateChirp replaces the body of a chirp written by authorId.
+func (db *DB) UpdateChirp(id int, authorId int, body string) (Chirp, error) {
+	chirp := Chirp{}
+	err := db.update(func(data *DBStructure) error {
+		stored, exists := data.Chirps[id]
+		if !exists {
+			return ErrChirpNotFound
+		}
+		if stored.AuthorId != authorId {
+			return ErrNotChirpAuthor
+		}
+
+		stored.Body = body
+		data.Chirps[id] = stored
+		chirp = stored
+
+		return data.recordEvent(EventChirpUpdated, authorId, ChirpEvent{Chirp: chirp})
+	})
 	if err != nil {
-		return err
+		return Chirp{}, err
 	}
 
-	if _, exists := data.Chirps[chirp.Id]; !exists {
-		return errors.New("chirp not found")
-	}
+	return chirp, nil
+}
+
+func (db *DB) DeleteChirp(chirp Chirp) error {
+	return db.update(func(data *DBStructure) error {
+		stored, exists := data.Chirps[chirp.Id]
+		if !exists {
+			return ErrChirpNotFound
+		}
 
-	delete(data.Chirps, chirp.Id)
+		delete(data.Chirps, chirp.Id)
 
-	return db.WriteDB(data)
+		return data.recordEvent(EventChirpDeleted, stored.AuthorId, ChirpEvent{Chirp: stored})
+	})
 }
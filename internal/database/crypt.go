@@ -0,0 +1,67 @@
+package database
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+)
+
+var errCiphertextInvalid = errors.New("ciphertext is invalid")
+
+// deriveEncryptionKey derives the key that encrypts secrets at rest from the
+// token hash key, so that the two are never the same bytes.
+func deriveEncryptionKey(tokenHashKey []byte) []byte {
+	mac := hmac.New(sha256.New, tokenHashKey)
+	mac.Write([]byte("chirpy encryption key"))
+	return mac.Sum(nil)
+}
+
+// encrypt seals a secret that has to be read back, such as a signing key,
+// for storage in the database file.
+func (db *DB) encrypt(plaintext []byte) (string, error) {
+	aead, err := db.aead()
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, plaintext, nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decrypt opens a secret sealed by encrypt.
+func (db *DB) decrypt(ciphertext string) ([]byte, error) {
+	aead, err := db.aead()
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, errCiphertextInvalid
+	}
+
+	nonce, sealed := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, errCiphertextInvalid
+	}
+	return plaintext, nil
+}
+
+func (db *DB) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(db.encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -1,78 +1,313 @@
 package database
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"log/slog"
 	"os"
+	"path/filepath"
 	"sync"
+	"time"
 )
 
 type DB struct {
-	path string
-	mu   *sync.RWMutex
+	path         string
+	mu           *sync.RWMutex
+	tokenHashKey []byte
+	// encryptionKey encrypts the secrets that must be read back, see
+	// encrypt.
+	encryptionKey []byte
+	// events is signalled after writes that record events.
+	events chan struct{}
+	// observer is told how long each load and write took, see Observe.
+	observer func(op string, duration time.Duration, bytes int)
+	// ctx is passed to the logger, see WithContext.
+	ctx context.Context
+}
+
+// WithContext returns a handle on the same database whose log lines are
+// emitted with ctx, so that they carry its request ID.
+func (db *DB) WithContext(ctx context.Context) *DB {
+	scoped := *db
+	scoped.ctx = ctx
+	return &scoped
+}
+
+// Database operations reported to an observer.
+const (
+	OpLoad  = "load"
+	OpWrite = "write"
+)
+
+// Observe registers fn to be called after every load and write of the
+// database file with the time it took and the size of the file. fn is
+// called with the database locked and must be fast. Observe must be called
+// before the database is shared between goroutines.
+func (db *DB) Observe(fn func(op string, duration time.Duration, bytes int)) {
+	db.observer = fn
+}
+
+func (db *DB) observe(op string, start time.Time, bytes int) {
+	duration := time.Since(start)
+	slog.DebugContext(db.ctx, "Database "+op, "duration", duration, "bytes", bytes)
+	if db.observer != nil {
+		db.observer(op, duration, bytes)
+	}
 }
 
 type DBStructure struct {
+	// SchemaVersion records which migrations have been applied.
+	SchemaVersion int `json:"schema_version"`
+	// LastChirpID and LastUserID are the highest IDs ever assigned, so that
+	// IDs of deleted records are never reused.
+	LastChirpID int `json:"last_chirp_id"`
+	LastUserID  int `json:"last_user_id"`
+	LastEventID int `json:"last_event_id"`
+	LastAuditID int `json:"last_audit_id"`
+
 	Chirps map[int]Chirp `json:"chirps"`
 	Users  map[int]User  `json:"users"`
+	// UserEmails is the unique index of user email addresses, see emailKey.
+	UserEmails map[string]int     `json:"user_emails"`
+	Sessions   map[string]Session `json:"sessions"`
+	// RefreshTokens maps refresh token hashes, current and rotated, to the
+	// ID of the session they belong to.
+	RefreshTokens  map[string]string        `json:"refresh_tokens"`
+	PasswordResets map[string]PasswordReset `json:"password_resets"`
+	LoginAttempts  map[string]LoginAttempt  `json:"login_attempts"`
+	// APITokens maps personal access token hashes to their metadata.
+	APITokens map[string]APIToken `json:"api_tokens"`
+
+	OAuthClients       map[string]OAuthClient       `json:"oauth_clients"`
+	AuthorizationCodes map[string]AuthorizationCode `json:"authorization_codes"`
+	// WebhookEvents is the ledger of inbound webhooks, see WebhookEventKey.
+	WebhookEvents map[string]WebhookEvent `json:"webhook_events"`
+
+	WebhookEndpoints  map[string]WebhookEndpoint `json:"webhook_endpoints"`
+	WebhookDeliveries map[string]WebhookDelivery `json:"webhook_deliveries"`
+
+	// SigningKeys are the keys that sign and validate access tokens, oldest
+	// first.
+	SigningKeys []SigningKey `json:"signing_keys"`
+
+	// Outbox holds domain events until every subscriber has handled them.
+	Outbox map[int]Event `json:"outbox"`
+	// AuditLog records administrative actions, oldest first.
+	AuditLog []AuditEntry `json:"audit_log"`
+	// eventsRecorded is set by recordEvent so that write can signal
+	// events.
+	eventsRecorded bool
 }
 
-func NewDB(path string) (*DB, error) {
+// NewDB opens the database at path. tokenHashKey keys the HMAC used to store
+// secrets such as refresh tokens, and the encryption of secrets that must be
+// read back, such as signing keys.
+func NewDB(path string, tokenHashKey []byte) (*DB, error) {
+	if len(tokenHashKey) == 0 {
+		return nil, errors.New("token hash key must not be empty")
+	}
+
 	db := &DB{
-		path: path,
-		mu:   &sync.RWMutex{},
+		path:          path,
+		mu:            &sync.RWMutex{},
+		tokenHashKey:  tokenHashKey,
+		encryptionKey: deriveEncryptionKey(tokenHashKey),
+		events:        make(chan struct{}, 1),
+		ctx:           context.Background(),
 	}
 
 	err := db.ensureDB()
+	if err != nil {
+		return db, err
+	}
+
+	err = db.migrate()
 	return db, err
 }
 
-func (db *DB) WriteDB(dbStructure DBStructure) error {
+// errUnchanged is returned by an update function that made no changes, so
+// that update can skip the write.
+var errUnchanged = errors.New("database unchanged")
+
+// update loads the database, applies fn and writes the result while
+// holding the lock throughout, so that no write in between is lost. Every
+// change to the database goes through update. An error from fn leaves the
+// database unchanged.
+func (db *DB) update(fn func(data *DBStructure) error) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
+	data, err := db.load()
+	if err != nil {
+		return err
+	}
+	err = fn(&data)
+	if errors.Is(err, errUnchanged) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return db.write(data)
+}
+
+func (db *DB) write(dbStructure DBStructure) error {
+	start := time.Now()
 	data, errMarshal := json.Marshal(dbStructure)
 	if errMarshal != nil {
 		return errMarshal
 	}
 
-	errWriteFile := os.WriteFile(db.path, data, 0600)
+	errWriteFile := writeFileAtomic(db.path, data)
 	if errWriteFile != nil {
+		slog.ErrorContext(db.ctx, "Couldn't write database file", "path", db.path, "error", errWriteFile)
 		return errWriteFile
 	}
+	db.observe(OpWrite, start, len(data))
+
+	if dbStructure.eventsRecorded {
+		select {
+		case db.events <- struct{}{}:
+		default:
+		}
+	}
 
 	return nil
 }
 
+// writeFileAtomic replaces the file at path with data by writing a
+// temporary file next to it and renaming it, so that a crash mid-write
+// doesn't leave a truncated database behind.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
 func (db *DB) ensureDB() error {
 	_, errReadFile := os.ReadFile(db.path)
 	if errors.Is(errReadFile, os.ErrNotExist) {
 		dbStructure := DBStructure{
-			Chirps: map[int]Chirp{},
-			Users:  map[int]User{},
+			SchemaVersion:  schemaVersion,
+			Chirps:         map[int]Chirp{},
+			Users:          map[int]User{},
+			UserEmails:     map[string]int{},
+			Sessions:       map[string]Session{},
+			RefreshTokens:  map[string]string{},
+			PasswordResets: map[string]PasswordReset{},
+			LoginAttempts:  map[string]LoginAttempt{},
+			APITokens:      map[string]APIToken{},
+
+			OAuthClients:       map[string]OAuthClient{},
+			AuthorizationCodes: map[string]AuthorizationCode{},
+			WebhookEvents:      map[string]WebhookEvent{},
+
+			WebhookEndpoints:  map[string]WebhookEndpoint{},
+			WebhookDeliveries: map[string]WebhookDelivery{},
+			Outbox:            map[int]Event{},
 		}
-		return db.WriteDB(dbStructure)
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		return db.write(dbStructure)
 	}
 
 	return errReadFile
 }
 
+// LoadDB returns a snapshot of the database for reading. Changes to the
+// snapshot are not saved; use update to change the database.
 func (db *DB) LoadDB() (DBStructure, error) {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+	db.mu.RLock()
+	defer db.mu.RUnlock()
 
+	return db.load()
+}
+
+func (db *DB) load() (DBStructure, error) {
+	start := time.Now()
 	dbStructure := DBStructure{}
 	data, errReadFile := os.ReadFile(db.path)
+	if errors.Is(errReadFile, os.ErrNotExist) {
+		dbStructure.initMaps()
+		return dbStructure, nil
+	}
 	if errReadFile != nil {
-		if errors.Is(os.ErrNotExist, errReadFile) {
-			return dbStructure, nil
-		}
+		slog.ErrorContext(db.ctx, "Couldn't read database file", "path", db.path, "error", errReadFile)
+		return DBStructure{}, errReadFile
 	}
 
+	// A file that can't be parsed is an error rather than an empty
+	// database, which the next write would save over it.
 	errUnmarshal := json.Unmarshal(data, &dbStructure)
 	if errUnmarshal != nil {
-		return DBStructure{}, nil
+		slog.ErrorContext(db.ctx, "Couldn't parse database file", "path", db.path, "error", errUnmarshal)
+		return DBStructure{}, fmt.Errorf("parsing %s: %w", db.path, errUnmarshal)
 	}
+	dbStructure.initMaps()
+	db.observe(OpLoad, start, len(data))
 
 	return dbStructure, nil
 }
+
+// initMaps creates collections that are missing from database files written
+// before they were introduced.
+func (dbStructure *DBStructure) initMaps() {
+	if dbStructure.Chirps == nil {
+		dbStructure.Chirps = map[int]Chirp{}
+	}
+	if dbStructure.Users == nil {
+		dbStructure.Users = map[int]User{}
+	}
+	if dbStructure.UserEmails == nil {
+		dbStructure.UserEmails = map[string]int{}
+	}
+	if dbStructure.Sessions == nil {
+		dbStructure.Sessions = map[string]Session{}
+	}
+	if dbStructure.RefreshTokens == nil {
+		dbStructure.RefreshTokens = map[string]string{}
+	}
+	if dbStructure.PasswordResets == nil {
+		dbStructure.PasswordResets = map[string]PasswordReset{}
+	}
+	if dbStructure.LoginAttempts == nil {
+		dbStructure.LoginAttempts = map[string]LoginAttempt{}
+	}
+	if dbStructure.APITokens == nil {
+		dbStructure.APITokens = map[string]APIToken{}
+	}
+	if dbStructure.OAuthClients == nil {
+		dbStructure.OAuthClients = map[string]OAuthClient{}
+	}
+	if dbStructure.AuthorizationCodes == nil {
+		dbStructure.AuthorizationCodes = map[string]AuthorizationCode{}
+	}
+	if dbStructure.WebhookEvents == nil {
+		dbStructure.WebhookEvents = map[string]WebhookEvent{}
+	}
+	if dbStructure.WebhookEndpoints == nil {
+		dbStructure.WebhookEndpoints = map[string]WebhookEndpoint{}
+	}
+	if dbStructure.WebhookDeliveries == nil {
+		dbStructure.WebhookDeliveries = map[string]WebhookDelivery{}
+	}
+	if dbStructure.Outbox == nil {
+		dbStructure.Outbox = map[int]Event{}
+	}
+}
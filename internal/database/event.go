@@ -0,0 +1,184 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Types of domain events.
+const (
+	EventChirpCreated   = "chirp.created"
+	EventChirpUpdated   = "chirp.updated"
+	EventChirpDeleted   = "chirp.deleted"
+	EventUserCreated    = "user.created"
+	EventUserUpgraded   = "user.upgraded"
+	EventUserDowngraded = "user.downgraded"
+	EventUserDeleted    = "user.deleted"
+)
+
+// EventTypes lists every type of domain event.
+var EventTypes = []string{
+	EventChirpCreated,
+	EventChirpUpdated,
+	EventChirpDeleted,
+	EventUserCreated,
+	EventUserUpgraded,
+	EventUserDowngraded,
+	EventUserDeleted,
+}
+
+// Event is a domain event in the outbox. Events are recorded in the same
+// write as the change they describe, so that a change is never saved
+// without its event. They stay in the outbox until every subscriber has
+// handled them.
+type Event struct {
+	ID     int    `json:"id"`
+	Type   string `json:"type"`
+	UserID int    `json:"user_id"`
+	// Data is a ChirpEvent or a UserEvent, depending on Type.
+	Data      json.RawMessage `json:"data"`
+	CreatedAt time.Time       `json:"created_at"`
+	// HandledBy lists the subscribers that have handled the event.
+	HandledBy []string `json:"handled_by"`
+	Attempts  int      `json:"attempts"`
+	LastError string   `json:"last_error,omitempty"`
+}
+
+// Key identifies the event across deliveries.
+func (e Event) Key() string {
+	return "evt_" + strconv.Itoa(e.ID)
+}
+
+// ChirpEvent is the data of chirp events.
+type ChirpEvent struct {
+	Chirp Chirp `json:"chirp"`
+}
+
+// UserEvent is the data of user events. Plan is set for upgrades and
+// downgrades.
+type UserEvent struct {
+	UserID int    `json:"user_id"`
+	Plan   string `json:"plan,omitempty"`
+}
+
+var ErrEventNotFound = errors.New("event not found")
+
+// recordEvent adds an event to the outbox. It is saved with the rest of
+// data by the update it is called from.
+func (data *DBStructure) recordEvent(eventType string, userId int, payload interface{}) error {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	data.eventsRecorded = true
+	data.LastEventID++
+	data.Outbox[data.LastEventID] = Event{
+		ID:        data.LastEventID,
+		Type:      eventType,
+		UserID:    userId,
+		Data:      raw,
+		CreatedAt: time.Now().UTC(),
+		HandledBy: []string{},
+	}
+	return nil
+}
+
+// scrubUserEvents reduces the chirps in the user's events in the outbox to
+// their IDs, so that their bodies aren't kept or delivered after the user is
+// purged.
+func (data *DBStructure) scrubUserEvents(userId int) error {
+	for id, event := range data.Outbox {
+		if event.UserID != userId || !strings.HasPrefix(event.Type, "chirp.") {
+			continue
+		}
+		payload := ChirpEvent{}
+		err := json.Unmarshal(event.Data, &payload)
+		if err != nil {
+			return err
+		}
+		raw, err := json.Marshal(ChirpEvent{Chirp: Chirp{Id: payload.Chirp.Id}})
+		if err != nil {
+			return err
+		}
+		event.Data = raw
+		data.Outbox[id] = event
+	}
+	return nil
+}
+
+// EventsRecorded receives a value after a write that records events, so
+// that a dispatcher can wake up without waiting to poll.
+func (db *DB) EventsRecorded() <-chan struct{} {
+	return db.events
+}
+
+// PendingEvents returns the events in the outbox in the order they were
+// recorded.
+func (db *DB) PendingEvents() ([]Event, error) {
+	data, err := db.LoadDB()
+	if err != nil {
+		return []Event{}, err
+	}
+
+	events := []Event{}
+	for _, event := range data.Outbox {
+		events = append(events, event)
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].ID < events[j].ID
+	})
+
+	return events, nil
+}
+
+// AckEvent records that subscriber has handled an event, so that it isn't
+// dispatched to that subscriber again.
+func (db *DB) AckEvent(id int, subscriber string) error {
+	return db.update(func(data *DBStructure) error {
+		event, exists := data.Outbox[id]
+		if !exists {
+			return ErrEventNotFound
+		}
+
+		if !slices.Contains(event.HandledBy, subscriber) {
+			event.HandledBy = append(event.HandledBy, subscriber)
+		}
+		data.Outbox[id] = event
+		return nil
+	})
+}
+
+// CompleteEvent removes an event that every subscriber has handled from the
+// outbox.
+func (db *DB) CompleteEvent(id int) error {
+	return db.update(func(data *DBStructure) error {
+		if _, exists := data.Outbox[id]; !exists {
+			return ErrEventNotFound
+		}
+		delete(data.Outbox, id)
+		return nil
+	})
+}
+
+// RecordEventFailure records that a subscriber failed to handle an event.
+// The event stays in the outbox to be dispatched again.
+func (db *DB) RecordEventFailure(id int, subscriber string, cause error) error {
+	return db.update(func(data *DBStructure) error {
+		event, exists := data.Outbox[id]
+		if !exists {
+			return ErrEventNotFound
+		}
+
+		event.Attempts++
+		event.LastError = subscriber + ": " + cause.Error()
+		data.Outbox[id] = event
+		return nil
+	})
+}
@@ -0,0 +1,188 @@
+package database
+
+import (
+	"sort"
+	"time"
+)
+
+// LoginAttempt tracks failed logins for one key, such as an email address
+// or a client IP.
+type LoginAttempt struct {
+	Key           string    `json:"key"`
+	Failures      int       `json:"failures"`
+	LastFailureAt time.Time `json:"last_failure_at"`
+	LockedUntil   time.Time `json:"locked_until,omitempty"`
+}
+
+// LockoutPolicy decides when repeated failures lock a key. The first
+// MaxFailures failures are free; each one after that locks the key for
+// BaseDelay, doubling every time up to MaxDelay. Failures are forgotten
+// once MaxDelay has passed without a new one.
+type LockoutPolicy struct {
+	MaxFailures int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// AccountAttemptKey is the key failed logins to the account with email are
+// tracked under.
+func AccountAttemptKey(email string) string {
+	return "email:" + emailKey(email)
+}
+
+// IPAttemptKey is the key failed logins from a client IP are tracked under.
+func IPAttemptKey(ip string) string {
+	return "ip:" + ip
+}
+
+// PasswordResetAttemptKey is the key password reset requests for the
+// account with email are tracked under.
+func PasswordResetAttemptKey(email string) string {
+	return "reset:email:" + emailKey(email)
+}
+
+// PasswordResetIPAttemptKey is the key password reset requests from a
+// client IP are tracked under.
+func PasswordResetIPAttemptKey(ip string) string {
+	return "reset:ip:" + ip
+}
+
+func (p LockoutPolicy) delay(failures int) time.Duration {
+	excess := failures - p.MaxFailures
+	if excess <= 0 {
+		return 0
+	}
+	d := p.BaseDelay
+	for i := 1; i < excess && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d
+}
+
+// BeginLoginAttempt checks and counts a login attempt against each key in
+// one step, so that concurrent attempts can't all pass the check before any
+// of them is counted. If any key is locked, the attempt isn't counted and the
+// latest time until which a key is locked is returned. Otherwise the attempt
+// is counted as a failure under the policy for each key, and the zero time is
+// returned; callers forgive it with LoginSucceeded once the credentials turn
+// out to be valid.
+//
+// Keys whose failures have been forgotten under the longest of the policies
+// are pruned on the way, so that the table doesn't grow without bound.
+func (db *DB) BeginLoginAttempt(policies map[string]LockoutPolicy) (time.Time, error) {
+	var until time.Time
+	err := db.update(func(data *DBStructure) error {
+		now := time.Now().UTC()
+		pruned := pruneLoginAttempts(data, now, policies)
+
+		for key := range policies {
+			attempt, exists := data.LoginAttempts[key]
+			if exists && attempt.LockedUntil.After(now) && attempt.LockedUntil.After(until) {
+				until = attempt.LockedUntil
+			}
+		}
+		if !until.IsZero() {
+			if !pruned {
+				return errUnchanged
+			}
+			return nil
+		}
+
+		for key, policy := range policies {
+			attempt, exists := data.LoginAttempts[key]
+			if !exists || now.Sub(attempt.LastFailureAt) > policy.MaxDelay {
+				attempt = LoginAttempt{Key: key}
+			}
+			attempt.Failures++
+			attempt.LastFailureAt = now
+			if d := policy.delay(attempt.Failures); d > 0 {
+				attempt.LockedUntil = now.Add(d)
+			}
+			data.LoginAttempts[key] = attempt
+		}
+		return nil
+	})
+	return until, err
+}
+
+// LoginSucceeded takes back the failure counted by BeginLoginAttempt for
+// each key in policies, and forgets all failures for each key in clear.
+func (db *DB) LoginSucceeded(policies map[string]LockoutPolicy, clear ...string) error {
+	return db.update(func(data *DBStructure) error {
+		for key, policy := range policies {
+			attempt, exists := data.LoginAttempts[key]
+			if !exists {
+				continue
+			}
+			attempt.Failures--
+			if attempt.Failures <= 0 {
+				delete(data.LoginAttempts, key)
+				continue
+			}
+			if policy.delay(attempt.Failures) == 0 {
+				attempt.LockedUntil = time.Time{}
+			}
+			data.LoginAttempts[key] = attempt
+		}
+		for _, key := range clear {
+			delete(data.LoginAttempts, key)
+		}
+		return nil
+	})
+}
+
+// pruneLoginAttempts deletes the keys that are no longer locked and whose
+// last failure is older than the longest MaxDelay of policies, and reports
+// whether it deleted any.
+func pruneLoginAttempts(data *DBStructure, now time.Time, policies map[string]LockoutPolicy) bool {
+	var window time.Duration
+	for _, policy := range policies {
+		window = max(window, policy.MaxDelay)
+	}
+	if window == 0 {
+		return false
+	}
+
+	pruned := false
+	for key, attempt := range data.LoginAttempts {
+		if attempt.LockedUntil.After(now) || now.Sub(attempt.LastFailureAt) <= window {
+			continue
+		}
+		delete(data.LoginAttempts, key)
+		pruned = true
+	}
+	return pruned
+}
+
+// ClearLoginFailures forgets failures and lifts any lockout for key.
+func (db *DB) ClearLoginFailures(key string) error {
+	return db.update(func(data *DBStructure) error {
+		if _, exists := data.LoginAttempts[key]; !exists {
+			return errUnchanged
+		}
+		delete(data.LoginAttempts, key)
+		return nil
+	})
+}
+
+// GetLoginAttempts returns all tracked keys, most recent failure first.
+func (db *DB) GetLoginAttempts() ([]LoginAttempt, error) {
+	data, err := db.LoadDB()
+	if err != nil {
+		return []LoginAttempt{}, err
+	}
+
+	attempts := []LoginAttempt{}
+	for _, attempt := range data.LoginAttempts {
+		attempts = append(attempts, attempt)
+	}
+
+	sort.Slice(attempts, func(i, j int) bool {
+		return attempts[i].LastFailureAt.After(attempts[j].LastFailureAt)
+	})
+
+	return attempts, nil
+}
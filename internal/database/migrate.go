@@ -0,0 +1,81 @@
+package database
+
+import (
+	"log/slog"
+	"sort"
+)
+
+// schemaVersion is the version written by this code. Each entry in
+// migrations upgrades the database from the version at its index.
+const schemaVersion = 4
+
+var migrations = []func(*DBStructure){
+	// Accounts created before email verification was introduced are
+	// treated as verified.
+	func(dbStructure *DBStructure) {
+		for id, user := range dbStructure.Users {
+			user.EmailVerified = true
+			dbStructure.Users[id] = user
+		}
+	},
+	// Build the unique email index. If older data has several accounts
+	// with the same address, the oldest one keeps it.
+	func(dbStructure *DBStructure) {
+		ids := make([]int, 0, len(dbStructure.Users))
+		for id := range dbStructure.Users {
+			ids = append(ids, id)
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(ids)))
+		for _, id := range ids {
+			dbStructure.UserEmails[emailKey(dbStructure.Users[id].Email)] = id
+		}
+	},
+	// Record the highest IDs in use, which used to be derived from the
+	// number of records.
+	func(dbStructure *DBStructure) {
+		for id := range dbStructure.Chirps {
+			dbStructure.LastChirpID = max(dbStructure.LastChirpID, id)
+		}
+		for id := range dbStructure.Users {
+			dbStructure.LastUserID = max(dbStructure.LastUserID, id)
+		}
+	},
+	// Give Chirpy Red users from before subscriptions were tracked an
+	// active subscription without a billing period.
+	func(dbStructure *DBStructure) {
+		for id, user := range dbStructure.Users {
+			if user.IsChirpyRed && user.Subscription == nil {
+				user.Subscription = &Subscription{Plan: PlanRed, Status: SubscriptionActive}
+				dbStructure.Users[id] = user
+			}
+		}
+	},
+}
+
+func (db *DB) migrate() error {
+	err := db.update(func(data *DBStructure) error {
+		if data.SchemaVersion >= schemaVersion {
+			return errUnchanged
+		}
+
+		slog.InfoContext(db.ctx, "Migrating database", "from", data.SchemaVersion, "to", schemaVersion)
+		for _, m := range migrations[data.SchemaVersion:] {
+			m(data)
+		}
+		data.SchemaVersion = schemaVersion
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = db.migrateRefreshTokens()
+	if err != nil {
+		return err
+	}
+	err = db.migrateTOTPSecrets()
+	if err != nil {
+		return err
+	}
+	return db.migrateWebhookSecrets()
+}
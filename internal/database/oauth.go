@@ -0,0 +1,217 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+// OAuthClient is a third-party application registered by a Chirpy user.
+// Public clients, such as mobile or single-page apps, have no secret.
+type OAuthClient struct {
+	ID           string    `json:"id"`
+	OwnerID      int       `json:"owner_id"`
+	Name         string    `json:"name"`
+	SecretHash   string    `json:"secret_hash,omitempty"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func (c OAuthClient) Public() bool {
+	return c.SecretHash == ""
+}
+
+// AuthorizationCode is a pending OAuth authorization code grant, stored
+// under the keyed hash of the code.
+type AuthorizationCode struct {
+	ClientID      string    `json:"client_id"`
+	UserID        int       `json:"user_id"`
+	RedirectURI   string    `json:"redirect_uri"`
+	Scopes        []string  `json:"scopes"`
+	CodeChallenge string    `json:"code_challenge"`
+	ExpiresAt     time.Time `json:"expires_at"`
+}
+
+var (
+	ErrOAuthClientNotFound  = errors.New("oauth client not found")
+	ErrClientSecretInvalid  = errors.New("oauth client secret is invalid")
+	ErrAuthorizationInvalid = errors.New("authorization code is invalid or expired")
+)
+
+// CreateOAuthClient registers a client. secret is empty for public clients.
+func (db *DB) CreateOAuthClient(ownerId int, name string, redirectURIs []string, secret string) (OAuthClient, error) {
+	id, err := newRandomId()
+	if err != nil {
+		return OAuthClient{}, err
+	}
+
+	client := OAuthClient{
+		ID:           id,
+		OwnerID:      ownerId,
+		Name:         name,
+		RedirectURIs: redirectURIs,
+		CreatedAt:    time.Now().UTC(),
+	}
+	if secret != "" {
+		client.SecretHash = db.hashToken(secret)
+	}
+
+	err = db.update(func(data *DBStructure) error {
+		data.OAuthClients[id] = client
+		return nil
+	})
+	if err != nil {
+		return OAuthClient{}, err
+	}
+
+	return client, nil
+}
+
+func (db *DB) GetOAuthClient(id string) (OAuthClient, error) {
+	data, err := db.LoadDB()
+	if err != nil {
+		return OAuthClient{}, err
+	}
+
+	client, exists := data.OAuthClients[id]
+	if !exists {
+		return OAuthClient{}, ErrOAuthClientNotFound
+	}
+
+	return client, nil
+}
+
+// AuthenticateOAuthClient checks a confidential client's secret. Public
+// clients must not present one.
+func (db *DB) AuthenticateOAuthClient(id, secret string) (OAuthClient, error) {
+	client, err := db.GetOAuthClient(id)
+	if err != nil {
+		return OAuthClient{}, err
+	}
+
+	if client.Public() {
+		if secret != "" {
+			return OAuthClient{}, ErrClientSecretInvalid
+		}
+		return client, nil
+	}
+
+	if !tokenHashEqual(client.SecretHash, db.hashToken(secret)) {
+		return OAuthClient{}, ErrClientSecretInvalid
+	}
+	return client, nil
+}
+
+func (db *DB) GetOAuthClients(ownerId int) ([]OAuthClient, error) {
+	data, err := db.LoadDB()
+	if err != nil {
+		return []OAuthClient{}, err
+	}
+
+	clients := []OAuthClient{}
+	for _, c := range data.OAuthClients {
+		if c.OwnerID == ownerId {
+			clients = append(clients, c)
+		}
+	}
+
+	return clients, nil
+}
+
+// DeleteOAuthClient removes a client along with its pending codes and the
+// sessions it holds.
+func (db *DB) DeleteOAuthClient(ownerId int, id string) error {
+	return db.update(func(data *DBStructure) error {
+		client, exists := data.OAuthClients[id]
+		if !exists || client.OwnerID != ownerId {
+			return ErrOAuthClientNotFound
+		}
+		data.deleteOAuthClient(id)
+		return nil
+	})
+}
+
+func (dbStructure *DBStructure) deleteOAuthClient(id string) {
+	delete(dbStructure.OAuthClients, id)
+
+	for hash, code := range dbStructure.AuthorizationCodes {
+		if code.ClientID == id {
+			delete(dbStructure.AuthorizationCodes, hash)
+		}
+	}
+	for _, s := range dbStructure.Sessions {
+		if s.ClientID == id {
+			dbStructure.deleteSession(s)
+		}
+	}
+}
+
+func (db *DB) CreateAuthorizationCode(code string, grant AuthorizationCode) error {
+	return db.update(func(data *DBStructure) error {
+		data.AuthorizationCodes[db.hashToken(code)] = grant
+		return nil
+	})
+}
+
+// ConsumeAuthorizationCode returns the grant for code and deletes it, so that
+// each code can be exchanged only once.
+func (db *DB) ConsumeAuthorizationCode(code string) (AuthorizationCode, error) {
+	grant := AuthorizationCode{}
+	err := db.update(func(data *DBStructure) error {
+		hash := db.hashToken(code)
+		stored, exists := data.AuthorizationCodes[hash]
+		if !exists {
+			return ErrAuthorizationInvalid
+		}
+		delete(data.AuthorizationCodes, hash)
+		grant = stored
+		return nil
+	})
+	if err != nil {
+		return AuthorizationCode{}, err
+	}
+
+	if time.Now().After(grant.ExpiresAt) {
+		return AuthorizationCode{}, ErrAuthorizationInvalid
+	}
+	return grant, nil
+}
+
+// CreateClientSession opens a session for the grant a user gave to client.
+// The session is named after the client so it can be recognized, and
+// revoked, alongside the user's own logins.
+func (db *DB) CreateClientSession(userId int, client OAuthClient, scopes []string, ip, userAgent, refreshToken string, expiresAt time.Time) (Session, error) {
+	return db.createSession(Session{
+		UserID:           userId,
+		DeviceName:       client.Name,
+		IP:               ip,
+		UserAgent:        userAgent,
+		RefreshExpiresAt: expiresAt,
+		ClientID:         client.ID,
+		Scopes:           scopes,
+	}, refreshToken)
+}
+
+// RevokeClientRefreshToken ends the session a refresh token belongs to, if it
+// was issued to clientID. Unknown tokens are ignored, as RFC 7009 requires.
+func (db *DB) RevokeClientRefreshToken(clientID, token string) error {
+	return db.update(func(data *DBStructure) error {
+		s, _, ok := data.sessionByTokenHash(db.hashToken(token))
+		if !ok || s.ClientID != clientID {
+			return errUnchanged
+		}
+		data.deleteSession(s)
+		return nil
+	})
+}
+
+// RevokeClientSession ends a session by ID if it was granted to clientID.
+func (db *DB) RevokeClientSession(clientID, sessionId string) error {
+	return db.update(func(data *DBStructure) error {
+		s, ok := data.Sessions[sessionId]
+		if !ok || s.ClientID != clientID {
+			return errUnchanged
+		}
+		data.deleteSession(s)
+		return nil
+	})
+}
@@ -0,0 +1,81 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+// PasswordReset is a pending password reset. It is stored under the keyed
+// hash of its token and removed once used.
+type PasswordReset struct {
+	UserID    int       `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+var ErrResetTokenInvalid = errors.New("password reset token is invalid or expired")
+
+func (db *DB) CreatePasswordReset(userId int, token string, expiresAt time.Time) error {
+	return db.update(func(data *DBStructure) error {
+		data.PasswordResets[db.hashToken(token)] = PasswordReset{
+			UserID:    userId,
+			CreatedAt: time.Now().UTC(),
+			ExpiresAt: expiresAt,
+		}
+		return nil
+	})
+}
+
+// ResetPassword consumes a reset token, sets the user's new password and
+// revokes all of the user's sessions, personal access tokens and
+// outstanding reset tokens.
+func (db *DB) ResetPassword(token string, password string) (User, error) {
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		return User{}, err
+	}
+
+	user := User{}
+	// The token is consumed even if it turns out to be expired, so the
+	// update succeeds and the outcome is reported separately.
+	var result error
+	err = db.update(func(data *DBStructure) error {
+		hash := db.hashToken(token)
+		reset, exists := data.PasswordResets[hash]
+		if !exists {
+			return ErrResetTokenInvalid
+		}
+		delete(data.PasswordResets, hash)
+
+		stored, exists := data.Users[reset.UserID]
+		if !exists || time.Now().After(reset.ExpiresAt) {
+			result = ErrResetTokenInvalid
+			return nil
+		}
+
+		stored.Password = hashedPassword
+		data.Users[stored.ID] = stored
+		user = stored
+
+		for h, r := range data.PasswordResets {
+			if r.UserID == stored.ID {
+				delete(data.PasswordResets, h)
+			}
+		}
+		data.deleteUserSessions(stored.ID)
+		for h, t := range data.APITokens {
+			if t.UserID == stored.ID {
+				delete(data.APITokens, h)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+	if result != nil {
+		return User{}, result
+	}
+
+	return user, nil
+}
@@ -0,0 +1,331 @@
+package database
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"time"
+)
+
+// Session is a login on one device. Its refresh tokens form a single
+// family: each refresh replaces RefreshTokenHash and moves the old hash to
+// RotatedTokenHashes so that replays can be detected. Only keyed hashes of
+// refresh tokens are stored.
+type Session struct {
+	ID                 string    `json:"id"`
+	UserID             int       `json:"user_id"`
+	DeviceName         string    `json:"device_name"`
+	IP                 string    `json:"ip"`
+	UserAgent          string    `json:"user_agent"`
+	RefreshTokenHash   string    `json:"refresh_token_hash"`
+	RefreshExpiresAt   time.Time `json:"refresh_expires_at"`
+	RotatedTokenHashes []string  `json:"rotated_token_hashes,omitempty"`
+	CreatedAt          time.Time `json:"created_at"`
+	LastUsedAt         time.Time `json:"last_used_at"`
+
+	// ClientID and Scopes are set for sessions granted to OAuth clients.
+	// Access tokens issued for them carry only these scopes.
+	ClientID string   `json:"client_id,omitempty"`
+	Scopes   []string `json:"scopes,omitempty"`
+
+	// Plaintext tokens written before hashing was introduced. They are
+	// hashed by migrateRefreshTokens when the database is opened.
+	LegacyRefreshToken  string   `json:"refresh_token,omitempty"`
+	LegacyRotatedTokens []string `json:"rotated_tokens,omitempty"`
+}
+
+var (
+	ErrSessionNotFound      = errors.New("session not found")
+	ErrRefreshTokenNotFound = errors.New("refresh token not found")
+	ErrRefreshTokenExpired  = errors.New("refresh token expired")
+	ErrRefreshTokenReused   = errors.New("refresh token reused")
+)
+
+func newRandomId() (string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func (db *DB) CreateSession(userId int, deviceName, ip, userAgent, refreshToken string, expiresAt time.Time) (Session, error) {
+	return db.createSession(Session{
+		UserID:           userId,
+		DeviceName:       deviceName,
+		IP:               ip,
+		UserAgent:        userAgent,
+		RefreshExpiresAt: expiresAt,
+	}, refreshToken)
+}
+
+// createSession stores s under a new ID with refreshToken as its current
+// refresh token.
+func (db *DB) createSession(s Session, refreshToken string) (Session, error) {
+	id, err := newRandomId()
+	if err != nil {
+		return Session{}, err
+	}
+
+	now := time.Now().UTC()
+	s.ID = id
+	s.RefreshTokenHash = db.hashToken(refreshToken)
+	s.CreatedAt = now
+	s.LastUsedAt = now
+
+	err = db.update(func(data *DBStructure) error {
+		data.Sessions[id] = s
+		data.indexSession(s)
+		return nil
+	})
+	if err != nil {
+		return Session{}, err
+	}
+
+	return s, nil
+}
+
+func (dbStructure *DBStructure) indexSession(s Session) {
+	dbStructure.RefreshTokens[s.RefreshTokenHash] = s.ID
+	for _, hash := range s.RotatedTokenHashes {
+		dbStructure.RefreshTokens[hash] = s.ID
+	}
+}
+
+func (dbStructure *DBStructure) deleteSession(s Session) {
+	delete(dbStructure.RefreshTokens, s.RefreshTokenHash)
+	for _, hash := range s.RotatedTokenHashes {
+		delete(dbStructure.RefreshTokens, hash)
+	}
+	delete(dbStructure.Sessions, s.ID)
+}
+
+func (dbStructure *DBStructure) deleteUserSessions(userId int) {
+	for _, s := range dbStructure.Sessions {
+		if s.UserID == userId {
+			dbStructure.deleteSession(s)
+		}
+	}
+}
+
+// sessionByTokenHash finds the session a refresh token hash belongs to and
+// reports whether the hash is the session's current token.
+func (dbStructure *DBStructure) sessionByTokenHash(hash string) (Session, bool, bool) {
+	id, ok := dbStructure.RefreshTokens[hash]
+	if !ok {
+		return Session{}, false, false
+	}
+	s, ok := dbStructure.Sessions[id]
+	if !ok {
+		return Session{}, false, false
+	}
+
+	if tokenHashEqual(s.RefreshTokenHash, hash) {
+		return s, true, true
+	}
+	for _, rotated := range s.RotatedTokenHashes {
+		if tokenHashEqual(rotated, hash) {
+			return s, false, true
+		}
+	}
+	return Session{}, false, false
+}
+
+func (db *DB) ValidateRefreshToken(token string) (Session, error) {
+	data, err := db.LoadDB()
+	if err != nil {
+		return Session{}, err
+	}
+
+	s, current, ok := data.sessionByTokenHash(db.hashToken(token))
+	if !ok || !current {
+		return Session{}, ErrRefreshTokenNotFound
+	}
+
+	return s, nil
+}
+
+// RotateRefreshToken replaces the current refresh token of a session with
+// newToken. Presenting a token that was already rotated means it has leaked,
+// so the whole session is revoked and ErrRefreshTokenReused is returned.
+// clientID is the OAuth client presenting the token, or empty for Chirpy's
+// own login sessions; tokens issued to anyone else are treated as unknown.
+//
+// The lookup and rotation happen in one update, so of two concurrent
+// requests with the same token only one can rotate it.
+func (db *DB) RotateRefreshToken(clientID, oldToken, newToken string, expiresAt time.Time) (Session, error) {
+	session := Session{}
+	// Reused and expired tokens revoke the session, so the update succeeds
+	// and the outcome is reported separately.
+	var result error
+	err := db.update(func(data *DBStructure) error {
+		s, current, ok := data.sessionByTokenHash(db.hashToken(oldToken))
+		if !ok || s.ClientID != clientID {
+			return ErrRefreshTokenNotFound
+		}
+
+		if !current {
+			data.deleteSession(s)
+			result = ErrRefreshTokenReused
+			return nil
+		}
+
+		now := time.Now().UTC()
+		if now.After(s.RefreshExpiresAt) {
+			data.deleteSession(s)
+			result = ErrRefreshTokenExpired
+			return nil
+		}
+
+		s.RotatedTokenHashes = append(s.RotatedTokenHashes, s.RefreshTokenHash)
+		s.RefreshTokenHash = db.hashToken(newToken)
+		s.RefreshExpiresAt = expiresAt
+		s.LastUsedAt = now
+		data.Sessions[s.ID] = s
+		data.indexSession(s)
+		session = s
+		return nil
+	})
+	if err != nil {
+		return Session{}, err
+	}
+	if result != nil {
+		return Session{}, result
+	}
+	return session, nil
+}
+
+// GetSessions returns the sessions of a user, most recently used first.
+func (db *DB) GetSessions(userId int) ([]Session, error) {
+	data, err := db.LoadDB()
+	if err != nil {
+		return []Session{}, err
+	}
+
+	sessions := []Session{}
+	for _, s := range data.Sessions {
+		if s.UserID == userId {
+			sessions = append(sessions, s)
+		}
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+	})
+
+	return sessions, nil
+}
+
+// GetSession returns a session owned by userId, failing with
+// ErrSessionNotFound once it has been revoked.
+func (db *DB) GetSession(userId int, id string) (Session, error) {
+	data, err := db.LoadDB()
+	if err != nil {
+		return Session{}, err
+	}
+
+	session, exists := data.Sessions[id]
+	if !exists || session.UserID != userId {
+		return Session{}, ErrSessionNotFound
+	}
+	return session, nil
+}
+
+// DeleteSession revokes a single session owned by userId.
+func (db *DB) DeleteSession(userId int, id string) error {
+	return db.update(func(data *DBStructure) error {
+		session, exists := data.Sessions[id]
+		if !exists || session.UserID != userId {
+			return ErrSessionNotFound
+		}
+		data.deleteSession(session)
+		return nil
+	})
+}
+
+// legacyRefreshTokenTTL is how long refresh tokens from before sessions were
+// introduced stay valid after migration. They had no expiry of their own.
+const legacyRefreshTokenTTL = 60 * 24 * time.Hour
+
+// migrateRefreshTokens hashes plaintext refresh tokens left by older versions
+// and rebuilds the refresh token index. Tokens stored on users, from before
+// sessions were introduced, become sessions of their own.
+func (db *DB) migrateRefreshTokens() error {
+	return db.update(func(data *DBStructure) error {
+		changed := false
+		now := time.Now().UTC()
+		for userId, user := range data.Users {
+			if user.LegacyRefreshToken == "" {
+				continue
+			}
+			id, err := newRandomId()
+			if err != nil {
+				return err
+			}
+			data.Sessions[id] = Session{
+				ID:               id,
+				UserID:           userId,
+				DeviceName:       "Migrated session",
+				RefreshTokenHash: db.hashToken(user.LegacyRefreshToken),
+				RefreshExpiresAt: now.Add(legacyRefreshTokenTTL),
+				CreatedAt:        now,
+				LastUsedAt:       now,
+			}
+			user.LegacyRefreshToken = ""
+			data.Users[userId] = user
+			changed = true
+		}
+
+		for id, s := range data.Sessions {
+			if s.LegacyRefreshToken == "" && len(s.LegacyRotatedTokens) == 0 {
+				continue
+			}
+			if s.LegacyRefreshToken != "" {
+				s.RefreshTokenHash = db.hashToken(s.LegacyRefreshToken)
+			}
+			for _, token := range s.LegacyRotatedTokens {
+				s.RotatedTokenHashes = append(s.RotatedTokenHashes, db.hashToken(token))
+			}
+			s.LegacyRefreshToken = ""
+			s.LegacyRotatedTokens = nil
+			data.Sessions[id] = s
+			changed = true
+		}
+
+		index := map[string]string{}
+		for _, s := range data.Sessions {
+			index[s.RefreshTokenHash] = s.ID
+			for _, hash := range s.RotatedTokenHashes {
+				index[hash] = s.ID
+			}
+		}
+		if len(index) != len(data.RefreshTokens) {
+			changed = true
+		}
+		data.RefreshTokens = index
+
+		if !changed {
+			return errUnchanged
+		}
+		return nil
+	})
+}
+
+// CountActiveSessions returns the number of sessions whose refresh token
+// hasn't expired by now.
+func (db *DB) CountActiveSessions(now time.Time) (int, error) {
+	data, err := db.LoadDB()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, session := range data.Sessions {
+		if session.RefreshExpiresAt.After(now) {
+			count++
+		}
+	}
+	return count, nil
+}
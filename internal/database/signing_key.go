@@ -0,0 +1,117 @@
+package database
+
+import "time"
+
+// SigningKey is a key that signs and validates access tokens. Its material
+// is stored encrypted and only decrypted in the copies returned by the
+// methods below. A key without material is supplied by configuration
+// instead, such as the legacy JWT_SECRET.
+type SigningKey struct {
+	ID  string `json:"id"`
+	Alg string `json:"alg"`
+	// Material is the key in the form the keyring encodes it in.
+	Material          []byte    `json:"-"`
+	EncryptedMaterial string    `json:"encrypted_material,omitempty"`
+	CreatedAt         time.Time `json:"created_at"`
+	// RetiredAt is set once a newer key takes over signing.
+	RetiredAt time.Time `json:"retired_at,omitempty"`
+}
+
+// Expired reports whether the key stopped signing and its retention period
+// has passed by now.
+func (k SigningKey) Expired(now time.Time, retention time.Duration) bool {
+	return !k.RetiredAt.IsZero() && now.Sub(k.RetiredAt) >= retention
+}
+
+// GetSigningKeys returns the stored signing keys, oldest first. The last
+// one is active.
+func (db *DB) GetSigningKeys() ([]SigningKey, error) {
+	data, err := db.LoadDB()
+	if err != nil {
+		return nil, err
+	}
+	return db.decryptSigningKeys(data.SigningKeys)
+}
+
+// InitSigningKeys stores keys if no signing keys are stored yet, and
+// returns the stored keys either way.
+func (db *DB) InitSigningKeys(keys []SigningKey) ([]SigningKey, error) {
+	stored := []SigningKey{}
+	err := db.update(func(data *DBStructure) error {
+		if len(data.SigningKeys) > 0 {
+			stored = data.SigningKeys
+			return errUnchanged
+		}
+
+		for _, key := range keys {
+			sealed, err := db.sealSigningKey(key)
+			if err != nil {
+				return err
+			}
+			data.SigningKeys = append(data.SigningKeys, sealed)
+		}
+		stored = data.SigningKeys
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return db.decryptSigningKeys(stored)
+}
+
+// RotateSigningKeys retires the active key in favour of next and drops the
+// keys whose retention period has passed. It returns the stored keys.
+func (db *DB) RotateSigningKeys(next SigningKey, retention time.Duration) ([]SigningKey, error) {
+	sealed, err := db.sealSigningKey(next)
+	if err != nil {
+		return nil, err
+	}
+
+	stored := []SigningKey{}
+	err = db.update(func(data *DBStructure) error {
+		now := time.Now().UTC()
+		keys := []SigningKey{}
+		for _, key := range data.SigningKeys {
+			if key.RetiredAt.IsZero() {
+				key.RetiredAt = now
+			}
+			if !key.Expired(now, retention) {
+				keys = append(keys, key)
+			}
+		}
+		data.SigningKeys = append(keys, sealed)
+		stored = data.SigningKeys
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return db.decryptSigningKeys(stored)
+}
+
+func (db *DB) sealSigningKey(key SigningKey) (SigningKey, error) {
+	if len(key.Material) > 0 {
+		encrypted, err := db.encrypt(key.Material)
+		if err != nil {
+			return SigningKey{}, err
+		}
+		key.EncryptedMaterial = encrypted
+	}
+	key.Material = nil
+	return key, nil
+}
+
+func (db *DB) decryptSigningKeys(stored []SigningKey) ([]SigningKey, error) {
+	keys := []SigningKey{}
+	for _, key := range stored {
+		if key.EncryptedMaterial != "" {
+			material, err := db.decrypt(key.EncryptedMaterial)
+			if err != nil {
+				return nil, err
+			}
+			key.Material = material
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
@@ -0,0 +1,36 @@
+package database
+
+import "time"
+
+// Stats are counts of the records in the database.
+type Stats struct {
+	Users          int
+	Chirps         int
+	ChirpyRedUsers int
+	ActiveSessions int
+}
+
+// GetStats counts users, chirps, Chirpy Red subscribers and sessions whose
+// refresh token hasn't expired by now.
+func (db *DB) GetStats(now time.Time) (Stats, error) {
+	data, err := db.LoadDB()
+	if err != nil {
+		return Stats{}, err
+	}
+
+	stats := Stats{
+		Users:  len(data.Users),
+		Chirps: len(data.Chirps),
+	}
+	for _, user := range data.Users {
+		if user.IsChirpyRed {
+			stats.ChirpyRedUsers++
+		}
+	}
+	for _, session := range data.Sessions {
+		if session.RefreshExpiresAt.After(now) {
+			stats.ActiveSessions++
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,189 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	PlanFree = "free"
+	PlanRed  = "red"
+)
+
+// Subscription statuses. Active, canceled and past-due subscriptions give
+// access to the plan; expired and refunded ones don't.
+const (
+	// SubscriptionActive renews at CurrentPeriodEnd.
+	SubscriptionActive = "active"
+	// SubscriptionCanceled stays usable until CurrentPeriodEnd and then
+	// expires.
+	SubscriptionCanceled = "canceled"
+	// SubscriptionPastDue had a failed payment and stays usable until
+	// GraceUntil.
+	SubscriptionPastDue  = "past_due"
+	SubscriptionExpired  = "expired"
+	SubscriptionRefunded = "refunded"
+)
+
+// Subscription is a user's paid plan. A zero CurrentPeriodEnd means the
+// subscription doesn't lapse on its own, as for upgrades recorded before
+// billing periods were tracked.
+type Subscription struct {
+	Plan             string    `json:"plan"`
+	Status           string    `json:"status"`
+	StartedAt        time.Time `json:"started_at"`
+	CurrentPeriodEnd time.Time `json:"current_period_end,omitempty"`
+	CanceledAt       time.Time `json:"canceled_at,omitempty"`
+	GraceUntil       time.Time `json:"grace_until,omitempty"`
+	EndedAt          time.Time `json:"ended_at,omitempty"`
+}
+
+var ErrSubscriptionNotFound = errors.New("subscription not found")
+
+func (s *Subscription) HasAccess() bool {
+	if s == nil {
+		return false
+	}
+	switch s.Status {
+	case SubscriptionActive, SubscriptionCanceled, SubscriptionPastDue:
+		return true
+	}
+	return false
+}
+
+// Start begins a new subscription to plan, or renews the current one if it
+// still gives access, paid up to periodEnd.
+func (s *Subscription) Start(plan string, now, periodEnd time.Time) {
+	if !s.HasAccess() || s.Plan != plan {
+		*s = Subscription{Plan: plan, StartedAt: now}
+	}
+	s.Status = SubscriptionActive
+	s.CurrentPeriodEnd = periodEnd
+	s.CanceledAt = time.Time{}
+	s.GraceUntil = time.Time{}
+	s.EndedAt = time.Time{}
+}
+
+// Cancel stops renewal. The plan stays usable until the end of the paid
+// period, or ends now if no period is known, since it would otherwise never
+// lapse.
+func (s *Subscription) Cancel(now time.Time) {
+	s.CanceledAt = now
+	if s.CurrentPeriodEnd.IsZero() {
+		s.End(SubscriptionExpired, now)
+		return
+	}
+	s.Status = SubscriptionCanceled
+}
+
+// PaymentFailed keeps the plan usable for a grace period after the end of
+// the paid period, to give the payment time to be retried.
+func (s *Subscription) PaymentFailed(now time.Time, grace time.Duration) {
+	s.Status = SubscriptionPastDue
+	s.GraceUntil = now.Add(grace)
+	if s.CurrentPeriodEnd.After(now) {
+		s.GraceUntil = s.CurrentPeriodEnd.Add(grace)
+	}
+}
+
+// End removes access immediately, as on a downgrade or a refund.
+func (s *Subscription) End(status string, now time.Time) {
+	s.Status = status
+	s.EndedAt = now
+}
+
+// expire ends a subscription whose paid period, and grace period, have run
+// out. It reports whether the subscription changed.
+func (s *Subscription) expire(now time.Time, grace time.Duration) bool {
+	var lapsesAt time.Time
+	switch s.Status {
+	case SubscriptionActive:
+		// A renewal may still be on its way.
+		if !s.CurrentPeriodEnd.IsZero() {
+			lapsesAt = s.CurrentPeriodEnd.Add(grace)
+		}
+	case SubscriptionCanceled:
+		lapsesAt = s.CurrentPeriodEnd
+	case SubscriptionPastDue:
+		lapsesAt = s.GraceUntil
+	}
+
+	if lapsesAt.IsZero() || now.Before(lapsesAt) {
+		return false
+	}
+	s.End(SubscriptionExpired, lapsesAt)
+	return true
+}
+
+// UpdateSubscription applies update to the user's subscription, creating an
+// empty one if the user has none, and keeps IsChirpyRed in step with it.
+func (db *DB) UpdateSubscription(userId int, update func(*Subscription) error) (User, error) {
+	user := User{}
+	err := db.update(func(data *DBStructure) error {
+		stored, exists := data.Users[userId]
+		if !exists {
+			return ErrUserNotFound
+		}
+
+		subscription := Subscription{}
+		if stored.Subscription != nil {
+			subscription = *stored.Subscription
+		}
+		err := update(&subscription)
+		if err != nil {
+			return err
+		}
+		wasChirpyRed := stored.IsChirpyRed
+		stored.Subscription = &subscription
+		stored.IsChirpyRed = subscription.HasAccess() && subscription.Plan == PlanRed
+		data.Users[userId] = stored
+		user = stored
+
+		switch {
+		case stored.IsChirpyRed && !wasChirpyRed:
+			return data.recordEvent(EventUserUpgraded, userId, UserEvent{UserID: userId, Plan: PlanRed})
+		case !stored.IsChirpyRed && wasChirpyRed:
+			return data.recordEvent(EventUserDowngraded, userId, UserEvent{UserID: userId, Plan: PlanFree})
+		}
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+// ExpireSubscriptions ends every subscription that has lapsed by now and
+// returns the IDs of the affected users.
+func (db *DB) ExpireSubscriptions(now time.Time, grace time.Duration) ([]int, error) {
+	expired := []int{}
+	err := db.update(func(data *DBStructure) error {
+		for id, user := range data.Users {
+			if user.Subscription == nil || !user.Subscription.expire(now, grace) {
+				continue
+			}
+			wasChirpyRed := user.IsChirpyRed
+			user.IsChirpyRed = false
+			data.Users[id] = user
+			expired = append(expired, id)
+
+			if wasChirpyRed {
+				err := data.recordEvent(EventUserDowngraded, id, UserEvent{UserID: id, Plan: PlanFree})
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if len(expired) == 0 {
+			return errUnchanged
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return expired, nil
+}
@@ -0,0 +1,20 @@
+package database
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// hashToken returns the keyed hash under which a secret token is stored.
+// Raw tokens are never written to the database file.
+func (db *DB) hashToken(token string) string {
+	mac := hmac.New(sha256.New, db.tokenHashKey)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// tokenHashEqual compares two token hashes in constant time.
+func tokenHashEqual(a, b string) bool {
+	return hmac.Equal([]byte(a), []byte(b))
+}
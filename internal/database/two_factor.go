@@ -0,0 +1,152 @@
+package database
+
+import "errors"
+
+var (
+	ErrTwoFactorNotPending = errors.New("two-factor enrollment has not been started")
+	ErrTOTPCodeReused      = errors.New("one-time code has already been used")
+	ErrRecoveryCodeInvalid = errors.New("recovery code is invalid")
+)
+
+// updateUser applies fn to a user in a single update.
+func (db *DB) updateUser(userId int, fn func(user *User) error) error {
+	return db.update(func(data *DBStructure) error {
+		user, exists := data.Users[userId]
+		if !exists {
+			return ErrUserNotFound
+		}
+		err := fn(&user)
+		if err != nil {
+			return err
+		}
+		data.Users[userId] = user
+		return nil
+	})
+}
+
+// TOTPSecret returns the user's active TOTP secret, or "" if none is set.
+func (db *DB) TOTPSecret(user User) (string, error) {
+	return db.decryptTOTPSecret(user.EncryptedTOTPSecret)
+}
+
+// PendingTOTPSecret returns the secret stored by SetPendingTOTPSecret, or ""
+// if enrollment hasn't been started.
+func (db *DB) PendingTOTPSecret(user User) (string, error) {
+	return db.decryptTOTPSecret(user.EncryptedTOTPPendingSecret)
+}
+
+func (db *DB) decryptTOTPSecret(encrypted string) (string, error) {
+	if encrypted == "" {
+		return "", nil
+	}
+	secret, err := db.decrypt(encrypted)
+	if err != nil {
+		return "", err
+	}
+	return string(secret), nil
+}
+
+// SetPendingTOTPSecret stores a secret that becomes active once the user
+// proves, with a valid code, that their authenticator has it.
+func (db *DB) SetPendingTOTPSecret(userId int, secret string) error {
+	encrypted, err := db.encrypt([]byte(secret))
+	if err != nil {
+		return err
+	}
+	return db.updateUser(userId, func(user *User) error {
+		user.EncryptedTOTPPendingSecret = encrypted
+		return nil
+	})
+}
+
+// EnableTOTP activates the pending secret and replaces the user's recovery
+// codes. counter is the time step of the code that confirmed enrollment.
+func (db *DB) EnableTOTP(userId int, counter int64, recoveryCodes []string) error {
+	return db.updateUser(userId, func(user *User) error {
+		if user.EncryptedTOTPPendingSecret == "" {
+			return ErrTwoFactorNotPending
+		}
+
+		user.EncryptedTOTPSecret = user.EncryptedTOTPPendingSecret
+		user.EncryptedTOTPPendingSecret = ""
+		user.TOTPEnabled = true
+		user.TOTPLastCounter = counter
+		user.RecoveryCodeHashes = []string{}
+		for _, code := range recoveryCodes {
+			user.RecoveryCodeHashes = append(user.RecoveryCodeHashes, db.hashToken(code))
+		}
+		return nil
+	})
+}
+
+func (db *DB) DisableTOTP(userId int) error {
+	return db.updateUser(userId, func(user *User) error {
+		user.TOTPEnabled = false
+		user.EncryptedTOTPSecret = ""
+		user.EncryptedTOTPPendingSecret = ""
+		user.TOTPLastCounter = 0
+		user.RecoveryCodeHashes = nil
+		return nil
+	})
+}
+
+// UseTOTPCounter records that the code for time step counter was used. Codes
+// from the same or an earlier step are rejected with ErrTOTPCodeReused.
+func (db *DB) UseTOTPCounter(userId int, counter int64) error {
+	return db.updateUser(userId, func(user *User) error {
+		if counter <= user.TOTPLastCounter {
+			return ErrTOTPCodeReused
+		}
+		user.TOTPLastCounter = counter
+		return nil
+	})
+}
+
+// UseRecoveryCode consumes one of the user's recovery codes.
+func (db *DB) UseRecoveryCode(userId int, code string) error {
+	return db.updateUser(userId, func(user *User) error {
+		hash := db.hashToken(code)
+		for i, h := range user.RecoveryCodeHashes {
+			if tokenHashEqual(h, hash) {
+				user.RecoveryCodeHashes = append(user.RecoveryCodeHashes[:i:i], user.RecoveryCodeHashes[i+1:]...)
+				return nil
+			}
+		}
+		return ErrRecoveryCodeInvalid
+	})
+}
+
+// migrateTOTPSecrets encrypts plaintext TOTP secrets left by older versions.
+func (db *DB) migrateTOTPSecrets() error {
+	return db.update(func(data *DBStructure) error {
+		changed := false
+		for id, user := range data.Users {
+			if user.LegacyTOTPSecret == "" && user.LegacyTOTPPendingSecret == "" {
+				continue
+			}
+			if user.LegacyTOTPSecret != "" {
+				encrypted, err := db.encrypt([]byte(user.LegacyTOTPSecret))
+				if err != nil {
+					return err
+				}
+				user.EncryptedTOTPSecret = encrypted
+			}
+			if user.LegacyTOTPPendingSecret != "" {
+				encrypted, err := db.encrypt([]byte(user.LegacyTOTPPendingSecret))
+				if err != nil {
+					return err
+				}
+				user.EncryptedTOTPPendingSecret = encrypted
+			}
+			user.LegacyTOTPSecret = ""
+			user.LegacyTOTPPendingSecret = ""
+			data.Users[id] = user
+			changed = true
+		}
+
+		if !changed {
+			return errUnchanged
+		}
+		return nil
+	})
+}
@@ -2,43 +2,96 @@ package database
 
 import (
 	"errors"
+	"strings"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
 type User struct {
-	ID           int    `json:"id"`
-	Email        string `json:"email"`
-	Password     string `json:"password"`
-	RefreshToken string `json:"refresh_token"`
-	IsChirpyRed  bool   `json:"is_chirpy_red"`
+	ID       int    `json:"id"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	// IsChirpyRed reports whether Subscription currently gives access to
+	// Chirpy Red.
+	IsChirpyRed  bool          `json:"is_chirpy_red"`
+	Subscription *Subscription `json:"subscription,omitempty"`
+	Roles        []string      `json:"roles,omitempty"`
+
+	EmailVerified      bool      `json:"email_verified"`
+	VerificationSentAt time.Time `json:"verification_sent_at,omitempty"`
+
+	// The TOTP secrets are encrypted; TOTPSecret and PendingTOTPSecret
+	// decrypt them.
+	TOTPEnabled                bool     `json:"totp_enabled"`
+	EncryptedTOTPSecret        string   `json:"encrypted_totp_secret,omitempty"`
+	EncryptedTOTPPendingSecret string   `json:"encrypted_totp_pending_secret,omitempty"`
+	TOTPLastCounter            int64    `json:"totp_last_counter,omitempty"`
+	RecoveryCodeHashes         []string `json:"recovery_code_hashes,omitempty"`
+
+	// LegacyRefreshToken is the plaintext refresh token written before
+	// sessions were introduced. migrateRefreshTokens turns it into a session.
+	LegacyRefreshToken string `json:"refresh_token,omitempty"`
+
+	// Plaintext secrets written before they were encrypted. They are
+	// encrypted by migrateTOTPSecrets when the database is opened.
+	LegacyTOTPSecret        string `json:"totp_secret,omitempty"`
+	LegacyTOTPPendingSecret string `json:"totp_pending_secret,omitempty"`
+
+	// DeletionScheduledAt is when the account will be purged, if the user
+	// has asked for it to be deleted.
+	DeletionScheduledAt time.Time `json:"deletion_scheduled_at,omitempty"`
 }
 
-func (db *DB) CreateUser(email string, password string) (User, error) {
-	data, err := db.LoadDB()
+var (
+	ErrUserNotFound            = errors.New("user not found")
+	ErrEmailTaken              = errors.New("email address is already registered")
+	ErrEmailChanged            = errors.New("email address has changed")
+	ErrVerificationRateLimited = errors.New("verification email sent too recently")
+)
+
+func hashPassword(password string) (string, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
-		return User{}, nil
+		return "", err
 	}
+	return string(hashedPassword), nil
+}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+// emailKey is the key of an address in the unique email index. Addresses
+// are compared case-insensitively.
+func emailKey(email string) string {
+	return strings.ToLower(email)
+}
+
+// CreateUser adds a user, failing with ErrEmailTaken if the address is
+// already registered. The password is hashed before the database is locked,
+// and the check and insert happen in one update, so that concurrent signups
+// for the same address can't both succeed.
+func (db *DB) CreateUser(email string, password string) (User, error) {
+	hashedPassword, err := hashPassword(password)
 	if err != nil {
 		return User{}, err
 	}
 
-	newId := len(data.Users) + 1
-	user := User{
-		ID:          newId,
-		Email:       email,
-		Password:    string(hashedPassword),
-		IsChirpyRed: false,
-	}
-	data.Users[newId] = user
+	user := User{}
+	err = db.update(func(data *DBStructure) error {
+		if _, taken := data.UserEmails[emailKey(email)]; taken {
+			return ErrEmailTaken
+		}
 
-	dbStructure := DBStructure{
-		Chirps: data.Chirps,
-		Users:  data.Users,
-	}
-	err = db.WriteDB(dbStructure)
+		data.LastUserID++
+		user = User{
+			ID:          data.LastUserID,
+			Email:       email,
+			Password:    hashedPassword,
+			IsChirpyRed: false,
+		}
+		data.Users[user.ID] = user
+		data.UserEmails[emailKey(email)] = user.ID
+
+		return data.recordEvent(EventUserCreated, user.ID, UserEvent{UserID: user.ID})
+	})
 	if err != nil {
 		return User{}, err
 	}
@@ -47,117 +100,107 @@ func (db *DB) CreateUser(email string, password string) (User, error) {
 }
 
 func (db *DB) UpdateUser(email string, password string, userId int) (User, error) {
-	data, err := db.LoadDB()
+	hashedPassword, err := hashPassword(password)
 	if err != nil {
 		return User{}, err
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		return User{}, err
-	}
+	user := User{}
+	err = db.update(func(data *DBStructure) error {
+		stored, exists := data.Users[userId]
+		if !exists {
+			return ErrUserNotFound
+		}
 
-	var updatedUser User
-	if user, exists := data.Users[userId]; exists {
-		user.Email = email
-		user.Password = string(hashedPassword)
-		data.Users[userId] = user
-		updatedUser = user
-	}
+		if id, taken := data.UserEmails[emailKey(email)]; taken && id != userId {
+			return ErrEmailTaken
+		}
 
-	dbStructure := DBStructure{
-		Chirps: data.Chirps,
-		Users:  data.Users,
-	}
-	err = db.WriteDB(dbStructure)
+		if stored.Email != email {
+			stored.EmailVerified = false
+		}
+		delete(data.UserEmails, emailKey(stored.Email))
+		data.UserEmails[emailKey(email)] = userId
+		stored.Email = email
+		stored.Password = hashedPassword
+		data.Users[userId] = stored
+		user = stored
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
 
-	return updatedUser, nil
+	return user, nil
 }
 
-func (db *DB) SaveRefreshToken(userId int, token string) error {
+func (db *DB) GetUserById(id int) (User, error) {
 	data, err := db.LoadDB()
 	if err != nil {
-		return err
-	}
-
-	if user, exists := data.Users[userId]; exists {
-		user.RefreshToken = token
-		data.Users[userId] = user
+		return User{}, err
 	}
 
-	dbStructure := DBStructure{
-		Chirps: data.Chirps,
-		Users:  data.Users,
-	}
-	err = db.WriteDB(dbStructure)
-	if err != nil {
-		return err
+	user, exists := data.Users[id]
+	if !exists {
+		return User{}, ErrUserNotFound
 	}
 
-	return nil
+	return user, nil
 }
 
-func (db *DB) ValidateRefreshToken(token string) (User, error) {
+func (db *DB) GetUserByEmail(email string) (User, error) {
 	data, err := db.LoadDB()
 	if err != nil {
 		return User{}, err
 	}
 
-	var user User
-	for _, u := range data.Users {
-		if u.RefreshToken == token {
-			user = u
-		}
+	id, exists := data.UserEmails[emailKey(email)]
+	if !exists {
+		return User{}, ErrUserNotFound
 	}
-
-	if user == (User{}) {
-		return User{}, errors.New("refresh token not found")
+	user, exists := data.Users[id]
+	if !exists {
+		return User{}, ErrUserNotFound
 	}
 
 	return user, nil
 }
 
-func (db *DB) DeleteRefreshToken(user User) error {
-	data, err := db.LoadDB()
-	if err != nil {
-		return err
-	}
-
-	if u, exist := data.Users[user.ID]; exist {
-		u.RefreshToken = ""
-		data.Users[user.ID] = u
-
-		err = db.WriteDB(data)
-		if err != nil {
-			return err
+// MarkEmailVerified marks the user's email as verified, provided it is still
+// the address the verification was sent to.
+func (db *DB) MarkEmailVerified(userId int, email string) error {
+	return db.update(func(data *DBStructure) error {
+		user, exists := data.Users[userId]
+		if !exists {
+			return ErrUserNotFound
+		}
+		if user.Email != email {
+			return ErrEmailChanged
 		}
-	}
 
-	return nil
+		user.EmailVerified = true
+		data.Users[userId] = user
+		return nil
+	})
 }
 
-func (db *DB) UpgradeChirpy(userId int) error {
-	// log.Printf("USER ID : %v", userId)
-	data, err := db.LoadDB()
-	if err != nil {
-		return err
-	}
-
-	if u, exists := data.Users[userId]; exists {
-		u.IsChirpyRed = true
-
-		data.Users[userId] = u
+// RecordVerificationSent notes that a verification email is being sent to
+// the user, unless one was already sent within interval, in which case it
+// returns ErrVerificationRateLimited.
+func (db *DB) RecordVerificationSent(userId int, interval time.Duration) error {
+	return db.update(func(data *DBStructure) error {
+		user, exists := data.Users[userId]
+		if !exists {
+			return ErrUserNotFound
+		}
 
-		err = db.WriteDB(data)
-		if err != nil {
-			return err
+		now := time.Now().UTC()
+		if now.Before(user.VerificationSentAt.Add(interval)) {
+			return ErrVerificationRateLimited
 		}
-	} else {
-		return errors.New("notfound")
-	}
 
-	return nil
+		user.VerificationSentAt = now
+		data.Users[userId] = user
+		return nil
+	})
 }
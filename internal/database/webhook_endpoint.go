@@ -0,0 +1,445 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"sort"
+	"time"
+)
+
+// WebhookEndpoint is a URL that outbound events are delivered to. A user's
+// endpoint receives events about that user's own chirps and account; an
+// endpoint registered by an admin with AllUsers receives events for every
+// user.
+type WebhookEndpoint struct {
+	ID       string   `json:"id"`
+	OwnerID  int      `json:"owner_id"`
+	AllUsers bool     `json:"all_users"`
+	URL      string   `json:"url"`
+	Events   []string `json:"events"`
+	// EncryptedSecret is the secret that signs deliveries. Every delivery
+	// needs it, so unlike other secrets it is encrypted rather than hashed;
+	// WebhookEndpointSecret decrypts it.
+	EncryptedSecret string    `json:"encrypted_secret"`
+	CreatedAt       time.Time `json:"created_at"`
+
+	// LegacySecret is the plaintext secret written before secrets were
+	// encrypted. It is encrypted by migrateWebhookSecrets when the database
+	// is opened.
+	LegacySecret string `json:"secret,omitempty"`
+}
+
+// Receives reports whether the endpoint subscribes to eventType for a
+// resource owned by ownerId.
+func (e WebhookEndpoint) Receives(eventType string, ownerId int) bool {
+	return (e.AllUsers || e.OwnerID == ownerId) && slices.Contains(e.Events, eventType)
+}
+
+// Statuses of a WebhookDelivery. Dead deliveries have used up their
+// attempts and form the dead-letter list.
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliverySucceeded = "succeeded"
+	WebhookDeliveryDead      = "dead"
+)
+
+// WebhookAttempt is one entry in a delivery's log. StatusCode is 0 if the
+// receiver couldn't be reached.
+type WebhookAttempt struct {
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Response   string    `json:"response,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"duration_ms"`
+}
+
+// WebhookDelivery is an event queued for one endpoint.
+type WebhookDelivery struct {
+	ID            string           `json:"id"`
+	EndpointID    string           `json:"endpoint_id"`
+	EventID       string           `json:"event_id"`
+	Event         string           `json:"event"`
+	Payload       json.RawMessage  `json:"payload"`
+	Status        string           `json:"status"`
+	Attempts      int              `json:"attempts"`
+	NextAttemptAt time.Time        `json:"next_attempt_at,omitempty"`
+	CreatedAt     time.Time        `json:"created_at"`
+	Log           []WebhookAttempt `json:"log"`
+}
+
+// concerns reports whether the delivery's payload is about the user, as the
+// subject of a user event or the author of a chirp.
+func (d WebhookDelivery) concerns(userId int) bool {
+	payload := struct {
+		Data struct {
+			UserID int `json:"user_id"`
+			Chirp  struct {
+				AuthorId int `json:"author_id"`
+			} `json:"chirp"`
+		} `json:"data"`
+	}{}
+	err := json.Unmarshal(d.Payload, &payload)
+	if err != nil {
+		return false
+	}
+	return payload.Data.UserID == userId || payload.Data.Chirp.AuthorId == userId
+}
+
+// maxWebhookAttemptLog is how many attempts a delivery's log keeps.
+const maxWebhookAttemptLog = 20
+
+// RetryPolicy decides when failed deliveries are retried. The first retry
+// waits BaseDelay, doubling every time up to MaxDelay. A delivery is dead
+// after MaxAttempts attempts.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+func (p RetryPolicy) delay(attempts int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < attempts && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d
+}
+
+var (
+	ErrWebhookEndpointNotFound = errors.New("webhook endpoint not found")
+	ErrWebhookDeliveryNotFound = errors.New("webhook delivery not found")
+)
+
+func (db *DB) CreateWebhookEndpoint(ownerId int, allUsers bool, url string, events []string, secret string) (WebhookEndpoint, error) {
+	id, err := newRandomId()
+	if err != nil {
+		return WebhookEndpoint{}, err
+	}
+	encrypted, err := db.encrypt([]byte(secret))
+	if err != nil {
+		return WebhookEndpoint{}, err
+	}
+
+	endpoint := WebhookEndpoint{
+		ID:              id,
+		OwnerID:         ownerId,
+		AllUsers:        allUsers,
+		URL:             url,
+		Events:          events,
+		EncryptedSecret: encrypted,
+		CreatedAt:       time.Now().UTC(),
+	}
+	err = db.update(func(data *DBStructure) error {
+		data.WebhookEndpoints[id] = endpoint
+		return nil
+	})
+	if err != nil {
+		return WebhookEndpoint{}, err
+	}
+
+	return endpoint, nil
+}
+
+// WebhookEndpointSecret returns the secret that signs deliveries to
+// endpoint.
+func (db *DB) WebhookEndpointSecret(endpoint WebhookEndpoint) (string, error) {
+	secret, err := db.decrypt(endpoint.EncryptedSecret)
+	if err != nil {
+		return "", err
+	}
+	return string(secret), nil
+}
+
+// migrateWebhookSecrets encrypts plaintext endpoint secrets left by older
+// versions.
+func (db *DB) migrateWebhookSecrets() error {
+	return db.update(func(data *DBStructure) error {
+		changed := false
+		for id, endpoint := range data.WebhookEndpoints {
+			if endpoint.LegacySecret == "" {
+				continue
+			}
+			encrypted, err := db.encrypt([]byte(endpoint.LegacySecret))
+			if err != nil {
+				return err
+			}
+			endpoint.EncryptedSecret = encrypted
+			endpoint.LegacySecret = ""
+			data.WebhookEndpoints[id] = endpoint
+			changed = true
+		}
+
+		if !changed {
+			return errUnchanged
+		}
+		return nil
+	})
+}
+
+// GetWebhookEndpoint returns an endpoint owned by ownerId.
+func (db *DB) GetWebhookEndpoint(ownerId int, id string) (WebhookEndpoint, error) {
+	data, err := db.LoadDB()
+	if err != nil {
+		return WebhookEndpoint{}, err
+	}
+
+	endpoint, exists := data.WebhookEndpoints[id]
+	if !exists || endpoint.OwnerID != ownerId {
+		return WebhookEndpoint{}, ErrWebhookEndpointNotFound
+	}
+
+	return endpoint, nil
+}
+
+// GetWebhookEndpoints returns the endpoints owned by ownerId, oldest first.
+func (db *DB) GetWebhookEndpoints(ownerId int) ([]WebhookEndpoint, error) {
+	data, err := db.LoadDB()
+	if err != nil {
+		return []WebhookEndpoint{}, err
+	}
+
+	endpoints := []WebhookEndpoint{}
+	for _, endpoint := range data.WebhookEndpoints {
+		if endpoint.OwnerID == ownerId {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+
+	sort.Slice(endpoints, func(i, j int) bool {
+		return endpoints[i].CreatedAt.Before(endpoints[j].CreatedAt)
+	})
+
+	return endpoints, nil
+}
+
+// DeleteWebhookEndpoint removes an endpoint owned by ownerId along with its
+// deliveries.
+func (db *DB) DeleteWebhookEndpoint(ownerId int, id string) error {
+	return db.update(func(data *DBStructure) error {
+		endpoint, exists := data.WebhookEndpoints[id]
+		if !exists || endpoint.OwnerID != ownerId {
+			return ErrWebhookEndpointNotFound
+		}
+		data.deleteWebhookEndpoint(id)
+		return nil
+	})
+}
+
+func (data *DBStructure) deleteWebhookEndpoint(id string) {
+	delete(data.WebhookEndpoints, id)
+	for deliveryId, delivery := range data.WebhookDeliveries {
+		if delivery.EndpointID == id {
+			delete(data.WebhookDeliveries, deliveryId)
+		}
+	}
+}
+
+// EnqueueWebhookEvent queues a delivery of an event to every endpoint that
+// receives it. The payload sent is an envelope of the event's key, type,
+// time and data. Endpoints that already have a delivery of the event are
+// skipped, so that an event handled twice is delivered once. It returns the
+// number of deliveries queued.
+func (db *DB) EnqueueWebhookEvent(event Event) (int, error) {
+	payload, err := json.Marshal(struct {
+		ID        string          `json:"id"`
+		Type      string          `json:"type"`
+		CreatedAt time.Time       `json:"created_at"`
+		Data      json.RawMessage `json:"data"`
+	}{event.Key(), event.Type, event.CreatedAt, event.Data})
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	err = db.update(func(data *DBStructure) error {
+		queued := map[string]bool{}
+		for _, delivery := range data.WebhookDeliveries {
+			if delivery.EventID == event.Key() {
+				queued[delivery.EndpointID] = true
+			}
+		}
+
+		now := time.Now().UTC()
+		for _, endpoint := range data.WebhookEndpoints {
+			if !endpoint.Receives(event.Type, event.UserID) || queued[endpoint.ID] {
+				continue
+			}
+			id, err := newRandomId()
+			if err != nil {
+				return err
+			}
+			data.WebhookDeliveries[id] = WebhookDelivery{
+				ID:            id,
+				EndpointID:    endpoint.ID,
+				EventID:       event.Key(),
+				Event:         event.Type,
+				Payload:       payload,
+				Status:        WebhookDeliveryPending,
+				NextAttemptAt: now,
+				CreatedAt:     now,
+				Log:           []WebhookAttempt{},
+			}
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// DueWebhookDelivery is a pending delivery together with its endpoint.
+type DueWebhookDelivery struct {
+	Delivery WebhookDelivery
+	Endpoint WebhookEndpoint
+}
+
+// DueWebhookDeliveries returns pending deliveries whose next attempt is due
+// by now, oldest first.
+func (db *DB) DueWebhookDeliveries(now time.Time) ([]DueWebhookDelivery, error) {
+	data, err := db.LoadDB()
+	if err != nil {
+		return []DueWebhookDelivery{}, err
+	}
+
+	due := []DueWebhookDelivery{}
+	for _, delivery := range data.WebhookDeliveries {
+		if delivery.Status != WebhookDeliveryPending || delivery.NextAttemptAt.After(now) {
+			continue
+		}
+		endpoint, exists := data.WebhookEndpoints[delivery.EndpointID]
+		if exists {
+			due = append(due, DueWebhookDelivery{Delivery: delivery, Endpoint: endpoint})
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].Delivery.CreatedAt.Before(due[j].Delivery.CreatedAt)
+	})
+
+	return due, nil
+}
+
+// RecordWebhookAttempt logs an attempt at a delivery. A successful attempt
+// completes the delivery; a failed one schedules a retry under policy, or
+// moves the delivery to the dead-letter list once its attempts are used up.
+func (db *DB) RecordWebhookAttempt(id string, attempt WebhookAttempt, succeeded bool, policy RetryPolicy) (WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	err := db.update(func(data *DBStructure) error {
+		var exists bool
+		delivery, exists = data.WebhookDeliveries[id]
+		if !exists {
+			return ErrWebhookDeliveryNotFound
+		}
+
+		delivery.Attempts++
+		delivery.Log = append(delivery.Log, attempt)
+		if len(delivery.Log) > maxWebhookAttemptLog {
+			delivery.Log = delivery.Log[len(delivery.Log)-maxWebhookAttemptLog:]
+		}
+
+		switch {
+		case succeeded:
+			delivery.Status = WebhookDeliverySucceeded
+			delivery.NextAttemptAt = time.Time{}
+		case delivery.Attempts >= policy.MaxAttempts:
+			delivery.Status = WebhookDeliveryDead
+			delivery.NextAttemptAt = time.Time{}
+		default:
+			delivery.NextAttemptAt = attempt.At.Add(policy.delay(delivery.Attempts))
+		}
+		data.WebhookDeliveries[id] = delivery
+		return nil
+	})
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+
+	return delivery, nil
+}
+
+// GetWebhookDeliveries returns the deliveries to an endpoint, most recent
+// first. An empty status returns deliveries of every status.
+func (db *DB) GetWebhookDeliveries(endpointId string, status string) ([]WebhookDelivery, error) {
+	data, err := db.LoadDB()
+	if err != nil {
+		return []WebhookDelivery{}, err
+	}
+
+	deliveries := []WebhookDelivery{}
+	for _, delivery := range data.WebhookDeliveries {
+		if (endpointId == "" || delivery.EndpointID == endpointId) && (status == "" || delivery.Status == status) {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].CreatedAt.After(deliveries[j].CreatedAt)
+	})
+
+	return deliveries, nil
+}
+
+// lastActivity is when the delivery was last attempted, or created if it
+// never was.
+func (d WebhookDelivery) lastActivity() time.Time {
+	if len(d.Log) == 0 {
+		return d.CreatedAt
+	}
+	return d.Log[len(d.Log)-1].At
+}
+
+// PruneWebhookDeliveries deletes succeeded and dead deliveries that have
+// seen no activity since before, and returns how many it deleted. Pending
+// deliveries are kept however old they are.
+func (db *DB) PruneWebhookDeliveries(before time.Time) (int, error) {
+	count := 0
+	err := db.update(func(data *DBStructure) error {
+		for id, delivery := range data.WebhookDeliveries {
+			if delivery.Status == WebhookDeliveryPending || !delivery.lastActivity().Before(before) {
+				continue
+			}
+			delete(data.WebhookDeliveries, id)
+			count++
+		}
+		if count == 0 {
+			return errUnchanged
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// RetryWebhookDelivery queues a delivery to endpointId again with a fresh
+// set of attempts, whatever its status. Its log is kept.
+func (db *DB) RetryWebhookDelivery(endpointId, id string) (WebhookDelivery, error) {
+	delivery := WebhookDelivery{}
+	err := db.update(func(data *DBStructure) error {
+		stored, exists := data.WebhookDeliveries[id]
+		if !exists || stored.EndpointID != endpointId {
+			return ErrWebhookDeliveryNotFound
+		}
+
+		stored.Status = WebhookDeliveryPending
+		stored.Attempts = 0
+		stored.NextAttemptAt = time.Now().UTC()
+		data.WebhookDeliveries[id] = stored
+		delivery = stored
+		return nil
+	})
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+
+	return delivery, nil
+}
@@ -0,0 +1,212 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+)
+
+// Statuses of a WebhookEvent. Events that are processed or ignored are
+// final; received and failed events are processed again on redelivery. An
+// event is processing while a delivery or replay has claimed it, see
+// RecordWebhookEvent.
+const (
+	WebhookEventReceived   = "received"
+	WebhookEventProcessing = "processing"
+	WebhookEventProcessed  = "processed"
+	WebhookEventIgnored    = "ignored"
+	WebhookEventFailed     = "failed"
+)
+
+// WebhookClaimTimeout is how long a claim on an event holds. A claim older
+// than this was left by a process that died while handling the event, and
+// the event may be claimed again.
+const WebhookClaimTimeout = 5 * time.Minute
+
+// WebhookEvent is an inbound webhook in the ledger, stored under
+// WebhookEventKey of its provider and the provider's event ID.
+type WebhookEvent struct {
+	Key         string          `json:"key"`
+	Provider    string          `json:"provider"`
+	EventID     string          `json:"event_id"`
+	Type        string          `json:"type"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+	Status      string          `json:"status"`
+	Result      string          `json:"result,omitempty"`
+	Attempts    int             `json:"attempts"`
+	ReceivedAt  time.Time       `json:"received_at"`
+	ClaimedAt   time.Time       `json:"claimed_at,omitempty"`
+	ProcessedAt time.Time       `json:"processed_at,omitempty"`
+}
+
+func (e WebhookEvent) Final() bool {
+	return e.Status == WebhookEventProcessed || e.Status == WebhookEventIgnored
+}
+
+// claimed reports whether another delivery or replay is handling the event.
+func (e WebhookEvent) claimed(now time.Time) bool {
+	return e.Status == WebhookEventProcessing && now.Sub(e.ClaimedAt) < WebhookClaimTimeout
+}
+
+// claim marks the event as being handled by the caller.
+func (e *WebhookEvent) claim(now time.Time) {
+	e.Status = WebhookEventProcessing
+	e.ClaimedAt = now
+}
+
+var (
+	ErrWebhookEventNotFound = errors.New("webhook event not found")
+	ErrWebhookEventClaimed  = errors.New("webhook event is being processed")
+	ErrWebhookEventScrubbed = errors.New("webhook event payload was removed")
+)
+
+// concerns reports whether the event's payload is about the user.
+func (e WebhookEvent) concerns(userId int) bool {
+	payload := struct {
+		Data struct {
+			UserID int `json:"user_id"`
+		} `json:"data"`
+	}{}
+	err := json.Unmarshal(e.Payload, &payload)
+	if err != nil {
+		return false
+	}
+	return payload.Data.UserID == userId
+}
+
+func WebhookEventKey(provider, eventId string) string {
+	return provider + ":" + eventId
+}
+
+// RecordWebhookEvent adds a delivery to the ledger and claims the event for
+// the caller, who must record the outcome with CompleteWebhookEvent. If the
+// event was delivered before, the existing entry is returned with its
+// attempt count incremented; it is only claimed if it isn't final and no
+// other delivery holds a claim on it. claimed reports whether the caller
+// holds the claim.
+func (db *DB) RecordWebhookEvent(provider, eventId, eventType string, payload []byte) (WebhookEvent, bool, error) {
+	event := WebhookEvent{}
+	claimed := false
+	err := db.update(func(data *DBStructure) error {
+		now := time.Now().UTC()
+		key := WebhookEventKey(provider, eventId)
+		stored, exists := data.WebhookEvents[key]
+		if !exists {
+			stored = WebhookEvent{
+				Key:        key,
+				Provider:   provider,
+				EventID:    eventId,
+				Type:       eventType,
+				Payload:    json.RawMessage(payload),
+				Status:     WebhookEventReceived,
+				ReceivedAt: now,
+			}
+		}
+		stored.Attempts++
+		if !stored.Final() && !stored.claimed(now) {
+			stored.claim(now)
+			claimed = true
+		}
+		data.WebhookEvents[key] = stored
+		event = stored
+		return nil
+	})
+	if err != nil {
+		return WebhookEvent{}, false, err
+	}
+
+	return event, claimed, nil
+}
+
+// ClaimWebhookEvent claims an event for processing again, whatever its
+// status. It fails with ErrWebhookEventClaimed if a delivery or another
+// replay holds a claim on it, and with ErrWebhookEventScrubbed if its
+// payload was removed when the user it was about was purged.
+func (db *DB) ClaimWebhookEvent(key string) (WebhookEvent, error) {
+	event := WebhookEvent{}
+	err := db.update(func(data *DBStructure) error {
+		now := time.Now().UTC()
+		stored, exists := data.WebhookEvents[key]
+		if !exists {
+			return ErrWebhookEventNotFound
+		}
+		if stored.claimed(now) {
+			return ErrWebhookEventClaimed
+		}
+		if len(stored.Payload) == 0 {
+			return ErrWebhookEventScrubbed
+		}
+
+		stored.claim(now)
+		data.WebhookEvents[key] = stored
+		event = stored
+		return nil
+	})
+	if err != nil {
+		return WebhookEvent{}, err
+	}
+
+	return event, nil
+}
+
+// CompleteWebhookEvent records the outcome of processing an event and
+// releases the claim on it.
+func (db *DB) CompleteWebhookEvent(key, status, result string) (WebhookEvent, error) {
+	event := WebhookEvent{}
+	err := db.update(func(data *DBStructure) error {
+		stored, exists := data.WebhookEvents[key]
+		if !exists {
+			return ErrWebhookEventNotFound
+		}
+
+		stored.Status = status
+		stored.Result = result
+		stored.ProcessedAt = time.Now().UTC()
+		stored.ClaimedAt = time.Time{}
+		data.WebhookEvents[key] = stored
+		event = stored
+		return nil
+	})
+	if err != nil {
+		return WebhookEvent{}, err
+	}
+
+	return event, nil
+}
+
+func (db *DB) GetWebhookEvent(key string) (WebhookEvent, error) {
+	data, err := db.LoadDB()
+	if err != nil {
+		return WebhookEvent{}, err
+	}
+
+	event, exists := data.WebhookEvents[key]
+	if !exists {
+		return WebhookEvent{}, ErrWebhookEventNotFound
+	}
+
+	return event, nil
+}
+
+// GetWebhookEvents returns the ledger, most recently received first. An
+// empty status returns events of every status.
+func (db *DB) GetWebhookEvents(status string) ([]WebhookEvent, error) {
+	data, err := db.LoadDB()
+	if err != nil {
+		return []WebhookEvent{}, err
+	}
+
+	events := []WebhookEvent{}
+	for _, event := range data.WebhookEvents {
+		if status == "" || event.Status == status {
+			events = append(events, event)
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].ReceivedAt.After(events[j].ReceivedAt)
+	})
+
+	return events, nil
+}
@@ -0,0 +1,124 @@
+// Package events dispatches the domain events that the database records in
+// its outbox to in-process subscribers.
+//
+// Delivery is at least once: a subscriber is acknowledged only after it
+// returns nil, so it may see an event again if the process stops in
+// between, and is retried on every dispatch until it succeeds. Subscribers
+// should therefore be idempotent, for example by keying their work on
+// Event.Key.
+package events
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Raihanki/Chirpy/internal/database"
+)
+
+// Handler reacts to an event.
+type Handler func(ctx context.Context, event database.Event) error
+
+type subscription struct {
+	name    string
+	types   []string
+	handler Handler
+}
+
+func (s subscription) wants(event database.Event) bool {
+	return len(s.types) == 0 || slices.Contains(s.types, event.Type)
+}
+
+// Bus dispatches outbox events to subscribers.
+type Bus struct {
+	db *database.DB
+
+	mu            sync.Mutex
+	subscriptions []subscription
+	// dispatching serializes Dispatch, so that an event isn't handled by
+	// two dispatches at once.
+	dispatching sync.Mutex
+}
+
+func NewBus(db *database.DB) *Bus {
+	return &Bus{db: db}
+}
+
+// Subscribe registers handler for events of the given types, or of every
+// type if none are given. name identifies the subscriber in the outbox and
+// must stay the same across restarts.
+func (b *Bus) Subscribe(name string, handler Handler, types ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscriptions = append(b.subscriptions, subscription{name: name, types: types, handler: handler})
+}
+
+// Dispatch hands every pending event to the subscribers that haven't
+// handled it yet. Events that all of their subscribers have handled are
+// removed from the outbox.
+func (b *Bus) Dispatch(ctx context.Context) error {
+	b.dispatching.Lock()
+	defer b.dispatching.Unlock()
+
+	b.mu.Lock()
+	subscriptions := slices.Clone(b.subscriptions)
+	b.mu.Unlock()
+
+	pending, err := b.db.PendingEvents()
+	if err != nil {
+		return err
+	}
+
+	for _, event := range pending {
+		complete := true
+		for _, s := range subscriptions {
+			if !s.wants(event) || slices.Contains(event.HandledBy, s.name) {
+				continue
+			}
+
+			err := s.handler(ctx, event)
+			if err != nil {
+				complete = false
+				slog.ErrorContext(ctx, "Couldn't handle event", "event_id", event.Key(), "type", event.Type, "subscriber", s.name, "error", err)
+				err = b.db.RecordEventFailure(event.ID, s.name, err)
+			} else {
+				err = b.db.AckEvent(event.ID, s.name)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if complete {
+			err = b.db.CompleteEvent(event.ID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Start dispatches events as soon as they are recorded, and every interval
+// to retry failed subscribers, until stop is closed.
+func (b *Bus) Start(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-b.db.EventsRecorded():
+			case <-stop:
+				return
+			}
+			err := b.Dispatch(context.Background())
+			if err != nil {
+				slog.Error("Couldn't dispatch events", "error", err)
+			}
+		}
+	}()
+}
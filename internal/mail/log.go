@@ -0,0 +1,48 @@
+package mail
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"regexp"
+	"sync"
+)
+
+// LogMailer is meant for local development. It appends messages to a file,
+// or writes them to the standard logger when Path is empty. Messages carry
+// live password reset and verification links, so the values of URL query
+// parameters are redacted from the logged copy; only the file has the
+// links as sent.
+type LogMailer struct {
+	Path string
+	From string
+
+	mu sync.Mutex
+}
+
+func (m *LogMailer) Send(ctx context.Context, msg Message) error {
+	data := format(m.From, msg)
+	if m.Path == "" {
+		slog.InfoContext(ctx, "Mail", "to", msg.To, "message", redactQueryValues(string(data)))
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := os.OpenFile(m.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(data, "\r\n\r\n"...))
+	return err
+}
+
+// queryValue matches the value of a parameter in a URL query string.
+var queryValue = regexp.MustCompile(`([?&][^=\s&]+=)[^&\s]+`)
+
+func redactQueryValues(s string) string {
+	return queryValue.ReplaceAllString(s, "${1}REDACTED")
+}
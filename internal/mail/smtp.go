@@ -0,0 +1,42 @@
+package mail
+
+import (
+	"context"
+	"net"
+	netmail "net/mail"
+	"net/smtp"
+)
+
+// SMTPMailer sends messages through an SMTP server. Credentials are optional;
+// when set, PLAIN authentication is used.
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	// From is the sender as shown in the From header, with or without a
+	// display name.
+	From string
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	// The envelope sender must be a bare address, without the display name
+	// that the From header may carry.
+	from, err := netmail.ParseAddress(m.From)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	addr := net.JoinHostPort(m.Host, m.Port)
+	return smtp.SendMail(addr, auth, from.Address, []string{msg.To}, format(m.From, msg))
+}
@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteTextEscapes(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("requests_total", "Requests by path.\nPaths are \\-separated.", "path").
+		WithLabelValues("C:\\chirps\n\"quoted\"").Inc()
+
+	out := strings.Builder{}
+	err := WriteText(&out, r.Gather())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# HELP requests_total Requests by path.\nPaths are \\-separated.
+# TYPE requests_total counter
+requests_total{path="C:\\chirps\n\"quoted\""} 1
+`
+	if out.String() != want {
+		t.Errorf("WriteText() =\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestWriteTextHistogram(t *testing.T) {
+	r := NewRegistry()
+	h := r.NewHistogramVec("latency_seconds", "Request latency.", []float64{0.1, 1}, "route")
+	for _, v := range []float64{0.05, 0.5, 0.5, 3} {
+		h.WithLabelValues("/api/chirps").Observe(v)
+	}
+
+	out := strings.Builder{}
+	err := WriteText(&out, r.Gather())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Buckets are cumulative and +Inf counts every observation.
+	want := `# HELP latency_seconds Request latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="/api/chirps",le="0.1"} 1
+latency_seconds_bucket{route="/api/chirps",le="1"} 3
+latency_seconds_bucket{route="/api/chirps",le="+Inf"} 4
+latency_seconds_sum{route="/api/chirps"} 4.05
+latency_seconds_count{route="/api/chirps"} 4
+`
+	if out.String() != want {
+		t.Errorf("WriteText() =\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewGauge("queue_depth", "Queued items.").Set(2.5)
+
+	rec := httptest.NewRecorder()
+	Handler(r).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if got := rec.Header().Get("Content-Type"); got != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	if !strings.Contains(rec.Body.String(), "\nqueue_depth 2.5\n") {
+		t.Errorf("body doesn't contain the gauge:\n%s", rec.Body)
+	}
+}
@@ -0,0 +1,350 @@
+// Package metrics is a small, dependency-free metrics registry that can be
+// scraped in the Prometheus text exposition format.
+//
+// Collectors report their current values as families of samples when the
+// registry is gathered, so that every view of the metrics, whether the
+// exposition format or an HTML page, reads the same numbers.
+package metrics
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Metric types, as named in the exposition format.
+const (
+	TypeCounter   = "counter"
+	TypeGauge     = "gauge"
+	TypeHistogram = "histogram"
+)
+
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is one value of a family. Name differs from the family name for
+// the _bucket, _sum and _count samples of histograms.
+type Sample struct {
+	Name   string
+	Labels []Label
+	Value  float64
+}
+
+// Family is a named metric and its samples.
+type Family struct {
+	Name    string
+	Help    string
+	Type    string
+	Samples []Sample
+}
+
+// Collector reports the current values of one or more families.
+type Collector interface {
+	Collect() []Family
+}
+
+// Registry holds the collectors of an application.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []Collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) Register(c Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// Gather collects every family, sorted by name.
+func (r *Registry) Gather() []Family {
+	r.mu.Lock()
+	collectors := append([]Collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	families := []Family{}
+	for _, c := range collectors {
+		families = append(families, c.Collect()...)
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].Name < families[j].Name
+	})
+	return families
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	value atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+func (c *Counter) Value() uint64 {
+	return c.value.Load()
+}
+
+// Reset sets the counter back to zero. Scrapers treat this like a restart
+// of the process.
+func (c *Counter) Reset() {
+	c.value.Store(0)
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	bits atomic.Uint64
+}
+
+func (g *Gauge) Set(v float64) {
+	g.bits.Store(math.Float64bits(v))
+}
+
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(g.bits.Load())
+}
+
+// Histogram counts observations in cumulative buckets.
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *Histogram) samples(name string, labels []Label) []Sample {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	samples := make([]Sample, 0, len(h.buckets)+3)
+	for i, upper := range h.buckets {
+		samples = append(samples, Sample{
+			Name:   name + "_bucket",
+			Labels: withLabel(labels, "le", formatFloat(upper)),
+			Value:  float64(h.counts[i]),
+		})
+	}
+	samples = append(samples,
+		Sample{Name: name + "_bucket", Labels: withLabel(labels, "le", "+Inf"), Value: float64(h.count)},
+		Sample{Name: name + "_sum", Labels: labels, Value: h.sum},
+		Sample{Name: name + "_count", Labels: labels, Value: float64(h.count)},
+	)
+	return samples
+}
+
+func withLabel(labels []Label, name, value string) []Label {
+	return append(append([]Label(nil), labels...), Label{Name: name, Value: value})
+}
+
+// DefaultBuckets suit request latencies in seconds.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// vec keeps one metric per combination of label values.
+type vec[M any] struct {
+	labelNames []string
+	newMetric  func() *M
+
+	mu      sync.RWMutex
+	metrics map[string]*M
+	values  map[string][]string
+}
+
+func newVec[M any](labelNames []string, newMetric func() *M) *vec[M] {
+	return &vec[M]{
+		labelNames: labelNames,
+		newMetric:  newMetric,
+		metrics:    map[string]*M{},
+		values:     map[string][]string{},
+	}
+}
+
+// with returns the metric for values, which must match the label names.
+func (v *vec[M]) with(values ...string) *M {
+	if len(values) != len(v.labelNames) {
+		panic("metrics: wrong number of label values")
+	}
+	key := strings.Join(values, "\xff")
+
+	v.mu.RLock()
+	m, ok := v.metrics[key]
+	v.mu.RUnlock()
+	if ok {
+		return m
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if m, ok := v.metrics[key]; ok {
+		return m
+	}
+	m = v.newMetric()
+	v.metrics[key] = m
+	v.values[key] = append([]string(nil), values...)
+	return m
+}
+
+// each calls fn for every metric in a stable order.
+func (v *vec[M]) each(fn func(labels []Label, m *M)) {
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.metrics))
+	for key := range v.metrics {
+		keys = append(keys, key)
+	}
+	v.mu.RUnlock()
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		v.mu.RLock()
+		m, values := v.metrics[key], v.values[key]
+		v.mu.RUnlock()
+
+		labels := make([]Label, len(values))
+		for i, value := range values {
+			labels[i] = Label{Name: v.labelNames[i], Value: value}
+		}
+		fn(labels, m)
+	}
+}
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct {
+	name, help string
+	*vec[Counter]
+}
+
+func (r *Registry) NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, vec: newVec(labelNames, func() *Counter { return &Counter{} })}
+	r.Register(c)
+	return c
+}
+
+func (c *CounterVec) WithLabelValues(values ...string) *Counter {
+	return c.with(values...)
+}
+
+// Reset sets every counter of c back to zero.
+func (c *CounterVec) Reset() {
+	c.each(func(_ []Label, counter *Counter) {
+		counter.Reset()
+	})
+}
+
+// Values returns the value of every counter of c keyed by its label
+// values, joined with commas.
+func (c *CounterVec) Values() map[string]uint64 {
+	values := map[string]uint64{}
+	c.each(func(labels []Label, counter *Counter) {
+		parts := make([]string, len(labels))
+		for i, l := range labels {
+			parts[i] = l.Value
+		}
+		values[strings.Join(parts, ",")] = counter.Value()
+	})
+	return values
+}
+
+func (c *CounterVec) Collect() []Family {
+	f := Family{Name: c.name, Help: c.help, Type: TypeCounter, Samples: []Sample{}}
+	c.each(func(labels []Label, counter *Counter) {
+		f.Samples = append(f.Samples, Sample{Name: c.name, Labels: labels, Value: float64(counter.Value())})
+	})
+	return []Family{f}
+}
+
+// HistogramVec is a histogram partitioned by labels.
+type HistogramVec struct {
+	name, help string
+	*vec[Histogram]
+}
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	h := &HistogramVec{name: name, help: help, vec: newVec(labelNames, func() *Histogram { return newHistogram(buckets) })}
+	r.Register(h)
+	return h
+}
+
+func (h *HistogramVec) WithLabelValues(values ...string) *Histogram {
+	return h.with(values...)
+}
+
+func (h *HistogramVec) Collect() []Family {
+	f := Family{Name: h.name, Help: h.help, Type: TypeHistogram, Samples: []Sample{}}
+	h.each(func(labels []Label, histogram *Histogram) {
+		f.Samples = append(f.Samples, histogram.samples(h.name, labels)...)
+	})
+	return []Family{f}
+}
+
+type singleCounter struct {
+	name, help string
+	counter    *Counter
+}
+
+func (c singleCounter) Collect() []Family {
+	return []Family{{Name: c.name, Help: c.help, Type: TypeCounter, Samples: []Sample{
+		{Name: c.name, Value: float64(c.counter.Value())},
+	}}}
+}
+
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &Counter{}
+	r.Register(singleCounter{name: name, help: help, counter: c})
+	return c
+}
+
+type singleGauge struct {
+	name, help string
+	gauge      *Gauge
+}
+
+func (g singleGauge) Collect() []Family {
+	return []Family{{Name: g.name, Help: g.help, Type: TypeGauge, Samples: []Sample{
+		{Name: g.name, Value: g.gauge.Value()},
+	}}}
+}
+
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	g := &Gauge{}
+	r.Register(singleGauge{name: name, help: help, gauge: g})
+	return g
+}
+
+// GaugeFunc is a gauge whose value is computed when gathered.
+type GaugeFunc struct {
+	name, help string
+	fn         func() float64
+}
+
+func (g GaugeFunc) Collect() []Family {
+	return []Family{{Name: g.name, Help: g.help, Type: TypeGauge, Samples: []Sample{
+		{Name: g.name, Value: g.fn()},
+	}}}
+}
+
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.Register(GaugeFunc{name: name, help: help, fn: fn})
+}
@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"runtime"
+	"time"
+)
+
+// runtimeCollector reports Go runtime and process statistics. Metrics that
+// the official Prometheus client also exports use its names; the GC cycle
+// and pause counters have no equivalent there, since it reports pauses as a
+// go_gc_duration_seconds summary.
+type runtimeCollector struct {
+	start time.Time
+}
+
+// RegisterRuntime adds Go runtime statistics to r.
+func (r *Registry) RegisterRuntime() {
+	r.Register(runtimeCollector{start: time.Now()})
+}
+
+func (c runtimeCollector) Collect() []Family {
+	ms := runtime.MemStats{}
+	runtime.ReadMemStats(&ms)
+	threads, _ := runtime.ThreadCreateProfile(nil)
+
+	gauge := func(name, help string, v float64) Family {
+		return Family{Name: name, Help: help, Type: TypeGauge, Samples: []Sample{{Name: name, Value: v}}}
+	}
+	counter := func(name, help string, v float64) Family {
+		return Family{Name: name, Help: help, Type: TypeCounter, Samples: []Sample{{Name: name, Value: v}}}
+	}
+
+	return []Family{
+		gauge("go_goroutines", "Number of goroutines that currently exist.", float64(runtime.NumGoroutine())),
+		{Name: "go_info", Help: "Information about the Go environment.", Type: TypeGauge, Samples: []Sample{
+			{Name: "go_info", Labels: []Label{{Name: "version", Value: runtime.Version()}}, Value: 1},
+		}},
+		gauge("go_memstats_alloc_bytes", "Number of bytes allocated and still in use.", float64(ms.Alloc)),
+		counter("go_memstats_alloc_bytes_total", "Total number of bytes allocated, even if freed.", float64(ms.TotalAlloc)),
+		gauge("go_memstats_sys_bytes", "Number of bytes obtained from the system.", float64(ms.Sys)),
+		gauge("go_memstats_heap_inuse_bytes", "Number of heap bytes that are in use.", float64(ms.HeapInuse)),
+		gauge("go_memstats_heap_objects", "Number of allocated objects.", float64(ms.HeapObjects)),
+		counter("go_gc_cycles_total", "Number of completed GC cycles.", float64(ms.NumGC)),
+		counter("go_gc_pause_seconds_total", "Total time spent in GC stop-the-world pauses.", float64(ms.PauseTotalNs)/1e9),
+		gauge("go_threads", "Number of OS threads created.", float64(threads)),
+		gauge("process_start_time_seconds", "Start time of the process since the Unix epoch in seconds.", float64(c.start.UnixNano())/1e9),
+	}
+}
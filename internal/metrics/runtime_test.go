@@ -0,0 +1,43 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRuntimeFamilies(t *testing.T) {
+	r := NewRegistry()
+	r.RegisterRuntime()
+
+	families := map[string]Family{}
+	for _, f := range r.Gather() {
+		families[f.Name] = f
+	}
+
+	// These names are shared with the official Prometheus client, so that
+	// existing dashboards work unchanged.
+	for _, name := range []string{
+		"go_goroutines",
+		"go_info",
+		"go_memstats_alloc_bytes",
+		"go_memstats_alloc_bytes_total",
+		"go_memstats_sys_bytes",
+		"go_memstats_heap_inuse_bytes",
+		"go_memstats_heap_objects",
+		"go_threads",
+		"process_start_time_seconds",
+	} {
+		if _, ok := families[name]; !ok {
+			t.Errorf("no %s family", name)
+		}
+	}
+
+	for name, f := range families {
+		if (f.Type == TypeCounter) != strings.HasSuffix(name, "_total") {
+			t.Errorf("%s is a %s", name, f.Type)
+		}
+		if len(f.Samples) != 1 || f.Samples[0].Name != name {
+			t.Errorf("%s has samples %+v", name, f.Samples)
+		}
+	}
+}
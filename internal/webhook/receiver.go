@@ -0,0 +1,72 @@
+package webhook
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Receiver is a webhook endpoint meant for local development. It verifies
+// each delivery against Secret, logs it, and answers with Status so that
+// retries can be exercised.
+type Receiver struct {
+	Secret    string
+	Tolerance time.Duration
+	// Status is the response to verified deliveries. It defaults to 204.
+	Status int
+	// Logger defaults to slog.Default().
+	Logger *slog.Logger
+
+	mu       sync.Mutex
+	received map[string]int
+}
+
+func (rc *Receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	tolerance := rc.Tolerance
+	if tolerance == 0 {
+		tolerance = 5 * time.Minute
+	}
+	err = Verify(r.Header, TimestampHeader, SignatureHeader, body, [][]byte{[]byte(rc.Secret)}, time.Now(), tolerance)
+	if err != nil {
+		rc.logger().WarnContext(r.Context(), "Rejected delivery", "delivery_id", r.Header.Get(DeliveryHeader), "error", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	delivery := r.Header.Get(DeliveryHeader)
+	rc.mu.Lock()
+	if rc.received == nil {
+		rc.received = map[string]int{}
+	}
+	rc.received[delivery]++
+	attempt := rc.received[delivery]
+	rc.mu.Unlock()
+
+	rc.logger().InfoContext(r.Context(), "Received delivery", "event", r.Header.Get(EventHeader), "delivery_id", delivery, "attempt", attempt, "body", string(body))
+
+	status := rc.Status
+	if status == 0 {
+		status = http.StatusNoContent
+	}
+	w.WriteHeader(status)
+}
+
+func (rc *Receiver) logger() *slog.Logger {
+	if rc.Logger == nil {
+		return slog.Default()
+	}
+	return rc.Logger
+}
@@ -0,0 +1,97 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestSendSignsDelivery(t *testing.T) {
+	secret := "whsec_test"
+	body := []byte(`{"id":"evt_1","type":"chirp.created"}`)
+	now := time.Now()
+
+	received := make(chan error, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(r.Body)
+		if err == nil {
+			err = Verify(r.Header, TimestampHeader, SignatureHeader, data, [][]byte{[]byte(secret)}, now, time.Minute)
+		}
+		if err == nil && (r.Header.Get(EventHeader) != "chirp.created" || r.Header.Get(DeliveryHeader) != "dlv_1") {
+			err = errors.New("event or delivery header is missing")
+		}
+		received <- err
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	sender := NewSender(time.Second, true)
+	resp, err := sender.Send(context.Background(), Delivery{
+		ID:     "dlv_1",
+		Event:  "chirp.created",
+		URL:    server.URL,
+		Secret: secret,
+		Body:   body,
+	}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Succeeded() {
+		t.Errorf("status = %d, want a 2xx", resp.StatusCode)
+	}
+	if err := <-received; err != nil {
+		t.Errorf("receiver rejected the delivery: %v", err)
+	}
+}
+
+func TestSenderRefusesPrivateAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the request reached a loopback receiver")
+	}))
+	defer server.Close()
+
+	sender := NewSender(time.Second, false)
+	_, err := sender.Send(context.Background(), Delivery{URL: server.URL, Body: []byte("{}")}, time.Now())
+	if !errors.Is(err, ErrAddressBlocked) {
+		t.Errorf("Send() = %v, want %v", err, ErrAddressBlocked)
+	}
+}
+
+func TestBlockedAddress(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"100.64.0.1", true},
+		{"100.127.255.254", true},
+		{"0.0.0.0", true},
+		{"198.18.0.1", true},
+		{"255.255.255.255", true},
+		{"::1", true},
+		{"fd00::1", true},
+		{"fe80::1", true},
+		{"::ffff:10.0.0.1", true},
+		{"64:ff9b::a00:1", true},
+		{"100.63.255.255", false},
+		{"100.128.0.1", false},
+		{"93.184.216.34", false},
+		{"2606:2800:220:1::1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := blockedAddress(netip.MustParseAddr(tt.ip)); got != tt.want {
+				t.Errorf("blockedAddress(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+// Package webhook signs, sends and verifies outbound webhook deliveries.
+//
+// A delivery is a JSON POST whose "<timestamp>.<body>" is signed with
+// HMAC-SHA256 using the endpoint's secret. The signature is sent as
+// "v1=<hex>" in SignatureHeader, so that the scheme can be versioned.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	EventHeader     = "X-Chirpy-Event"
+	DeliveryHeader  = "X-Chirpy-Delivery"
+	TimestampHeader = "X-Chirpy-Timestamp"
+	SignatureHeader = "X-Chirpy-Signature"
+
+	signatureVersion = "v1"
+)
+
+var (
+	ErrSignatureMissing = errors.New("missing signature or timestamp header")
+	ErrTimestampInvalid = errors.New("malformed timestamp")
+	ErrTimestampExpired = errors.New("timestamp outside the replay window")
+	ErrSignatureInvalid = errors.New("no signature matches the secret")
+)
+
+// Sign returns the hex HMAC-SHA256 of "<timestamp>.<body>".
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the timestamp and signatures in header against body. The
+// signature header may hold several comma-separated signatures; one of
+// them must match. Timestamps further than tolerance from now are rejected
+// as possible replays.
+func Verify(header http.Header, timestampHeader, signatureHeader string, body []byte, secrets [][]byte, now time.Time, tolerance time.Duration) error {
+	timestamp := header.Get(timestampHeader)
+	signatures := header.Get(signatureHeader)
+	if timestamp == "" || signatures == "" {
+		return ErrSignatureMissing
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrTimestampInvalid
+	}
+	age := now.Sub(time.Unix(unix, 0))
+	if age > tolerance || age < -tolerance {
+		return ErrTimestampExpired
+	}
+
+	for _, secret := range secrets {
+		expected := []byte(Sign(secret, timestamp, body))
+		for _, signature := range strings.Split(signatures, ",") {
+			version, value, ok := strings.Cut(strings.TrimSpace(signature), "=")
+			if ok && version == signatureVersion && hmac.Equal(expected, []byte(value)) {
+				return nil
+			}
+		}
+	}
+	return ErrSignatureInvalid
+}
@@ -0,0 +1,42 @@
+package webhook
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestVerifyRejectsTampering(t *testing.T) {
+	secret := []byte("whsec_test")
+	body := []byte(`{"id":"evt_1"}`)
+	now := time.Now()
+	timestamp := "1700000000"
+	signed := time.Unix(1700000000, 0)
+
+	header := http.Header{}
+	header.Set(TimestampHeader, timestamp)
+	header.Set(SignatureHeader, "v0=abc, v1="+Sign(secret, timestamp, body))
+
+	tests := []struct {
+		name    string
+		body    []byte
+		secrets [][]byte
+		now     time.Time
+		want    error
+	}{
+		{"valid", body, [][]byte{secret}, signed, nil},
+		{"rotated secret", body, [][]byte{[]byte("old"), secret}, signed, nil},
+		{"modified body", []byte(`{"id":"evt_2"}`), [][]byte{secret}, signed, ErrSignatureInvalid},
+		{"wrong secret", body, [][]byte{[]byte("other")}, signed, ErrSignatureInvalid},
+		{"replayed", body, [][]byte{secret}, now, ErrTimestampExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Verify(header, TimestampHeader, SignatureHeader, tt.body, tt.secrets, tt.now, 5*time.Minute)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Verify() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
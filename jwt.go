@@ -1,7 +1,10 @@
 package main
 
 import (
-	"os"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -11,24 +14,99 @@ type JwtConfig struct {
 	Issuer    string
 	ExpiresAt int
 	Subject   string
+	Roles     []string
+	Scopes    []string
+	SessionId string
+	// ClientId is set for tokens issued to OAuth clients.
+	ClientId string
 }
 
-func (cfg *JwtConfig) generateToken() (string, error) {
-	// expiredTime := time.Duration(cfg.ExpiresAt) * time.Second
-	// if cfg.ExpiresAt > 86400 {
-	// 	expiredTime = 86400 * time.Second
-	// }
-	token := jwt.NewWithClaims(
-		jwt.SigningMethodHS256,
-		jwt.RegisteredClaims{
+type ChirpyClaims struct {
+	Roles     []string `json:"roles,omitempty"`
+	Scope     string   `json:"scope,omitempty"`
+	SessionId string   `json:"sid,omitempty"`
+	ClientId  string   `json:"client_id,omitempty"`
+	// TokenUse is empty for access tokens. Tokens signed for other purposes,
+	// such as email verification, set it so they can't be used as access
+	// tokens.
+	TokenUse string `json:"token_use,omitempty"`
+	jwt.RegisteredClaims
+}
+
+func (c ChirpyClaims) scopes() []string {
+	return strings.Fields(c.Scope)
+}
+
+func newTokenId() (string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// generateSecureToken returns a random 256-bit opaque token, hex encoded.
+func generateSecureToken() (string, error) {
+	// Create a byte slice to hold the random data (32 bytes for 256 bits)
+	token := make([]byte, 32)
+
+	// Read random bytes using crypto/rand's rand.Read function
+	_, err := rand.Read(token)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// TokenPolicy bounds the lifetime of access tokens and sets the lifetime of
+// each refresh token.
+type TokenPolicy struct {
+	DefaultTTL time.Duration
+	MinTTL     time.Duration
+	MaxTTL     time.Duration
+	RefreshTTL time.Duration
+}
+
+func (p TokenPolicy) RefreshExpiresAt() time.Time {
+	return time.Now().UTC().Add(p.RefreshTTL)
+}
+
+// ExpiresIn returns the access token lifetime in seconds for a requested
+// lifetime, clamped to the policy. A nil request uses the default.
+func (p TokenPolicy) ExpiresIn(requestedSeconds *int) int {
+	ttl := p.DefaultTTL
+	if requestedSeconds != nil {
+		ttl = time.Duration(*requestedSeconds) * time.Second
+	}
+	if ttl < p.MinTTL {
+		ttl = p.MinTTL
+	}
+	if ttl > p.MaxTTL {
+		ttl = p.MaxTTL
+	}
+	return int(ttl / time.Second)
+}
+
+func (cfg *JwtConfig) generateToken(keys *Keyring) (string, error) {
+	tokenId, err := newTokenId()
+	if err != nil {
+		return "", err
+	}
+
+	tokenString, err := keys.Sign(ChirpyClaims{
+		Roles:     cfg.Roles,
+		Scope:     strings.Join(cfg.Scopes, " "),
+		SessionId: cfg.SessionId,
+		ClientId:  cfg.ClientId,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        tokenId,
 			Issuer:    cfg.Issuer,
 			Subject:   cfg.Subject,
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Duration(cfg.ExpiresAt) * time.Second)),
 		},
-	)
-
-	tokenString, err := token.SignedString([]byte(os.Getenv("JWT_SECRET")))
+	})
 	if err != nil {
 		return "", err
 	}
@@ -36,18 +114,31 @@ func (cfg *JwtConfig) generateToken() (string, error) {
 	return tokenString, nil
 }
 
-func ValidateToken(tokenString string) (jwt.MapClaims, error) {
-	claims := jwt.MapClaims{}
-	token, err := jwt.ParseWithClaims(tokenString, &claims, func(t *jwt.Token) (interface{}, error) {
-		return []byte(os.Getenv("JWT_SECRET")), nil
-	})
+// parseToken verifies tokenString against the keyring and decodes it into
+// claims.
+func parseToken(keys *Keyring, tokenString string, claims jwt.Claims) error {
+	token, err := jwt.ParseWithClaims(tokenString, claims, keys.Keyfunc, jwt.WithValidMethods(supportedSigningMethods))
 	if err != nil {
-		return claims, err
+		return err
 	}
 
 	if !token.Valid {
+		return errors.New("invalid token")
+	}
+
+	return nil
+}
+
+func ValidateToken(keys *Keyring, tokenString string) (ChirpyClaims, error) {
+	claims := ChirpyClaims{}
+	err := parseToken(keys, tokenString, &claims)
+	if err != nil {
 		return claims, err
 	}
 
+	if claims.TokenUse != "" {
+		return claims, errors.New("not an access token")
+	}
+
 	return claims, nil
 }
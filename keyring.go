@@ -0,0 +1,377 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Raihanki/Chirpy/internal/database"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	legacyKeyId = "legacy"
+	rsaKeyBits  = 2048
+)
+
+var supportedSigningMethods = []string{
+	jwt.SigningMethodHS256.Alg(),
+	jwt.SigningMethodRS256.Alg(),
+	jwt.SigningMethodEdDSA.Alg(),
+}
+
+type signingKey struct {
+	id        string
+	method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+	createdAt time.Time
+	// retiredAt is set once a newer key takes over signing. Retired keys
+	// keep validating tokens until the retention period has passed.
+	retiredAt time.Time
+}
+
+// Keyring holds the keys used to sign and validate access tokens. The newest
+// key signs; older keys stay valid for a retention period after rotation.
+// Keys are stored, encrypted, in the database, so that tokens survive a
+// restart.
+type Keyring struct {
+	mu           sync.RWMutex
+	db           *database.DB
+	alg          string
+	retention    time.Duration
+	legacySecret string
+	keys         []*signingKey
+}
+
+// NewKeyring creates a keyring for alg from the keys stored in db. If
+// legacySecret is set it is kept as an HS256 key so that tokens signed
+// before key IDs were introduced remain valid; on first start it signs new
+// tokens until the first rotation when alg is HS256. Like any other key it
+// stops validating tokens once it has been retired for the retention
+// period. A fresh key is generated whenever no stored key can sign for alg.
+func NewKeyring(db *database.DB, alg string, retention time.Duration, legacySecret string) (*Keyring, error) {
+	if jwt.GetSigningMethod(alg) == nil || !slices.Contains(supportedSigningMethods, alg) {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+
+	kr := &Keyring{
+		db:           db,
+		alg:          alg,
+		retention:    retention,
+		legacySecret: legacySecret,
+	}
+
+	stored, err := db.GetSigningKeys()
+	if err != nil {
+		return nil, err
+	}
+	if len(stored) == 0 && legacySecret != "" {
+		stored, err = db.InitSigningKeys([]database.SigningKey{{
+			ID:        legacyKeyId,
+			Alg:       jwt.SigningMethodHS256.Alg(),
+			CreatedAt: time.Now().UTC(),
+		}})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = kr.load(stored)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(stored) > 0 {
+		active := stored[len(stored)-1]
+		if active.Alg == alg && (active.ID != legacyKeyId || legacySecret != "") {
+			return kr, nil
+		}
+	}
+
+	err = kr.Rotate()
+	if err != nil {
+		return nil, err
+	}
+	return kr, nil
+}
+
+// load replaces the keys of the keyring with the stored keys. The legacy key
+// is left out if no legacy secret is configured.
+func (kr *Keyring) load(stored []database.SigningKey) error {
+	keys := []*signingKey{}
+	for _, s := range stored {
+		if s.ID == legacyKeyId && kr.legacySecret == "" {
+			continue
+		}
+
+		key := &signingKey{
+			id:        s.ID,
+			method:    jwt.GetSigningMethod(s.Alg),
+			createdAt: s.CreatedAt,
+			retiredAt: s.RetiredAt,
+		}
+		material := s.Material
+		if s.ID == legacyKeyId {
+			material = []byte(kr.legacySecret)
+		}
+		err := key.setMaterial(s.Alg, material)
+		if err != nil {
+			return fmt.Errorf("signing key %q: %w", s.ID, err)
+		}
+		keys = append(keys, key)
+	}
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.keys = keys
+	return nil
+}
+
+func generateSigningKey(alg string) (*signingKey, error) {
+	id, err := newTokenId()
+	if err != nil {
+		return nil, err
+	}
+
+	key := &signingKey{
+		id:        id,
+		method:    jwt.GetSigningMethod(alg),
+		createdAt: time.Now().UTC(),
+	}
+
+	switch alg {
+	case jwt.SigningMethodHS256.Alg():
+		secret := make([]byte, 32)
+		_, err = rand.Read(secret)
+		if err != nil {
+			return nil, err
+		}
+		key.signKey = secret
+		key.verifyKey = secret
+	case jwt.SigningMethodRS256.Alg():
+		private, err := rsa.GenerateKey(rand.Reader, rsaKeyBits)
+		if err != nil {
+			return nil, err
+		}
+		key.signKey = private
+		key.verifyKey = &private.PublicKey
+	case jwt.SigningMethodEdDSA.Alg():
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		key.signKey = private
+		key.verifyKey = public
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+
+	return key, nil
+}
+
+// material encodes the key for storage: the secret of an HMAC key, or the
+// PKCS #8 form of a private key.
+func (k *signingKey) material() ([]byte, error) {
+	if secret, ok := k.signKey.([]byte); ok {
+		return secret, nil
+	}
+	return x509.MarshalPKCS8PrivateKey(k.signKey)
+}
+
+// setMaterial decodes a key for alg encoded by material.
+func (k *signingKey) setMaterial(alg string, material []byte) error {
+	if alg == jwt.SigningMethodHS256.Alg() {
+		k.signKey = material
+		k.verifyKey = material
+		return nil
+	}
+
+	private, err := x509.ParsePKCS8PrivateKey(material)
+	if err != nil {
+		return err
+	}
+	switch private := private.(type) {
+	case *rsa.PrivateKey:
+		if alg != jwt.SigningMethodRS256.Alg() {
+			break
+		}
+		k.signKey = private
+		k.verifyKey = &private.PublicKey
+		return nil
+	case ed25519.PrivateKey:
+		if alg != jwt.SigningMethodEdDSA.Alg() {
+			break
+		}
+		k.signKey = private
+		k.verifyKey = private.Public()
+		return nil
+	}
+	return fmt.Errorf("key does not match algorithm %q", alg)
+}
+
+// Rotate generates a new signing key, retires the current one and drops
+// retired keys whose retention period has passed.
+func (kr *Keyring) Rotate() error {
+	key, err := generateSigningKey(kr.alg)
+	if err != nil {
+		return err
+	}
+	material, err := key.material()
+	if err != nil {
+		return err
+	}
+
+	stored, err := kr.db.RotateSigningKeys(database.SigningKey{
+		ID:        key.id,
+		Alg:       kr.alg,
+		Material:  material,
+		CreatedAt: key.createdAt,
+	}, kr.retention)
+	if err != nil {
+		return err
+	}
+
+	return kr.load(stored)
+}
+
+// StartRotation rotates the signing key every interval until stop is closed.
+func (kr *Keyring) StartRotation(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				err := kr.Rotate()
+				if err != nil {
+					slog.Error("Couldn't rotate signing key", "error", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func (kr *Keyring) activeKey() *signingKey {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.keys[len(kr.keys)-1]
+}
+
+func (kr *Keyring) lookup(kid string) (*signingKey, bool) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	for _, k := range kr.keys {
+		if k.id != kid {
+			continue
+		}
+		if !k.retiredAt.IsZero() && time.Since(k.retiredAt) >= kr.retention {
+			return nil, false
+		}
+		return k, true
+	}
+	return nil, false
+}
+
+// Sign signs claims with the active key and sets its ID in the kid header.
+func (kr *Keyring) Sign(claims jwt.Claims) (string, error) {
+	key := kr.activeKey()
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.id
+	return token.SignedString(key.signKey)
+}
+
+// Keyfunc resolves the verification key for a token from its kid header.
+// Tokens without a kid predate key IDs, and are only checked against the
+// legacy secret while the keyring signs with HS256.
+func (kr *Keyring) Keyfunc(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	if kid == "" {
+		if kr.alg != jwt.SigningMethodHS256.Alg() {
+			return nil, errors.New("token has no key ID")
+		}
+		kid = legacyKeyId
+	}
+
+	key, ok := kr.lookup(kid)
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if t.Method.Alg() != key.method.Alg() {
+		return nil, errors.New("signing method does not match key")
+	}
+	return key.verifyKey, nil
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// PublicKeys returns the asymmetric validation keys as JWKs. HMAC keys are
+// secret and never published.
+func (kr *Keyring) PublicKeys() []JWK {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	jwks := []JWK{}
+	for _, k := range kr.keys {
+		jwk, ok := publicJWK(k)
+		if ok {
+			jwks = append(jwks, jwk)
+		}
+	}
+	return jwks
+}
+
+func publicJWK(k *signingKey) (JWK, bool) {
+	encode := base64.RawURLEncoding.EncodeToString
+	jwk := JWK{
+		Use: "sig",
+		Kid: k.id,
+		Alg: k.method.Alg(),
+	}
+
+	switch pub := k.verifyKey.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = encode(pub.N.Bytes())
+		jwk.E = encode(big.NewInt(int64(pub.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = encode(pub)
+	default:
+		return JWK{}, false
+	}
+	return jwk, true
+}
+
+func (cfg *apiConfig) handlerJWKS(w http.ResponseWriter, r *http.Request) {
+	type jwksResponse struct {
+		Keys []JWK `json:"keys"`
+	}
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithJSON(w, r, http.StatusOK, jwksResponse{
+		Keys: cfg.Keys.PublicKeys(),
+	})
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/Raihanki/Chirpy/internal/logging"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// validRequestID reports whether a client supplied request ID is safe to
+// log and echo: short and made of unreserved URL characters only.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.', c == '~':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// middlewareRequestID gives every request an ID, taken from the
+// X-Request-ID header if the client sent a valid one, and returns it in the
+// same header. The ID is stored in the request context, which ties every
+// line logged with it to the request. Each request is logged once it has
+// been served.
+func middlewareRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			var err error
+			id, err = newTokenId()
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Couldn't generate request ID", "error", err)
+			}
+		}
+		w.Header().Set(requestIDHeader, id)
+		r = r.WithContext(logging.WithRequestID(r.Context(), id))
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		level := slog.LevelInfo
+		if rec.status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		slog.Log(r.Context(), level, "Served request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"duration", time.Since(start),
+			"ip", clientIP(r),
+		)
+	})
+}
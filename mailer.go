@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	netmail "net/mail"
+	"os"
+
+	"github.com/Raihanki/Chirpy/internal/mail"
+)
+
+// newMailer returns the mailer selected by MAILER: "smtp", or "log" for local
+// development, which is the default.
+func newMailer() (mail.Mailer, error) {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "Chirpy <no-reply@chirpy.local>"
+	}
+	_, err := netmail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MAIL_FROM %q: %w", from, err)
+	}
+
+	if os.Getenv("MAILER") == "smtp" {
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		return &mail.SMTPMailer{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     port,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}, nil
+	}
+
+	return &mail.LogMailer{
+		Path: os.Getenv("MAIL_LOG_FILE"),
+		From: from,
+	}, nil
+}
+
+// sendMail delivers msg in the background so that request latency doesn't
+// depend on the mail server, or reveal whether a message was sent at all.
+// The message outlives the request, but is logged with its request ID.
+func (cfg *apiConfig) sendMail(ctx context.Context, msg mail.Message) {
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		err := cfg.Mailer.Send(ctx, msg)
+		if err != nil {
+			slog.ErrorContext(ctx, "Couldn't send email", "subject", msg.Subject, "error", err)
+		}
+	}()
+}
@@ -1,16 +1,56 @@
 package main
 
 import (
+	"fmt"
+	"html/template"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/Raihanki/Chirpy/internal/database"
+	"github.com/Raihanki/Chirpy/internal/events"
+	"github.com/Raihanki/Chirpy/internal/logging"
+	"github.com/Raihanki/Chirpy/internal/mail"
 	"github.com/joho/godotenv"
 )
 
 type apiConfig struct {
-	fileserverHits int
-	DB             *database.DB
+	DB      *database.DB
+	Metrics *Metrics
+	// Events dispatches domain events recorded by DB to subscribers.
+	Events         *events.Bus
+	Keys           *Keyring
+	TokenPolicy    TokenPolicy
+	PasswordPolicy PasswordPolicy
+	// LoginProtection throttles repeated failed logins.
+	LoginProtection LoginProtection
+	// AdminEmails lists accounts that are granted the admin role.
+	AdminEmails map[string]struct{}
+	Mailer      mail.Mailer
+	// PolkaWebhook authenticates payment webhooks from Polka.
+	PolkaWebhook PolkaWebhookConfig
+	// OutboundWebhooks delivers events to endpoints registered by users.
+	OutboundWebhooks OutboundWebhookConfig
+	Subscriptions    SubscriptionPolicy
+	Entitlements     PlanEntitlements
+	BaseURL          string
+	// ConsentTemplate renders the OAuth consent page.
+	ConsentTemplate *template.Template
+	// PasswordResetTemplate renders the page password reset emails link to.
+	PasswordResetTemplate *template.Template
+
+	PasswordResetTTL           time.Duration
+	EmailVerificationTTL       time.Duration
+	VerificationResendInterval time.Duration
+
+	AccountDeletionGracePeriod time.Duration
+	// AnonymizeDeletedChirps keeps the chirps of purged accounts without an
+	// author instead of deleting them.
+	AnonymizeDeletedChirps bool
 }
 
 func main() {
@@ -19,48 +59,325 @@ func main() {
 		log.Fatalf("error loading configuration file: %v", err)
 	}
 
+	logger, err := logging.New(os.Stderr, os.Getenv("LOG_FORMAT"), os.Getenv("LOG_LEVEL"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(logger)
+
 	const filepathRoot = "."
 	const port = "8080"
 
-	db, err := database.NewDB("database.json")
+	db, err := database.NewDB("database.json", []byte(os.Getenv("TOKEN_HASH_KEY")))
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+
+	alg := os.Getenv("JWT_SIGNING_ALG")
+	if alg == "" {
+		alg = "HS256"
+	}
+	rotationInterval, err := durationFromEnv("JWT_KEY_ROTATION_INTERVAL", 0)
+	if err != nil {
+		fatal(err)
+	}
+	keyRetention, err := durationFromEnv("JWT_KEY_RETENTION", 24*time.Hour)
+	if err != nil {
+		fatal(err)
+	}
+
+	keys, err := NewKeyring(db, alg, keyRetention, os.Getenv("JWT_SECRET"))
+	if err != nil {
+		fatal(err)
+	}
+	if rotationInterval > 0 {
+		keys.StartRotation(rotationInterval, make(chan struct{}))
+	}
+
+	tokenPolicy, err := loadTokenPolicy()
+	if err != nil {
+		fatal(err)
+	}
+
+	passwordPolicy, err := loadPasswordPolicy()
+	if err != nil {
+		fatal(err)
+	}
+
+	loginProtection, err := loadLoginProtection()
+	if err != nil {
+		fatal(err)
+	}
+
+	adminEmails := map[string]struct{}{}
+	for _, email := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		normalized, fieldErr := normalizeEmail(email)
+		if fieldErr == nil {
+			adminEmails[normalized] = struct{}{}
+		}
+	}
+
+	passwordResetTTL, err := durationFromEnv("PASSWORD_RESET_TTL", time.Hour)
+	if err != nil {
+		fatal(err)
+	}
+
+	emailVerificationTTL, err := durationFromEnv("EMAIL_VERIFICATION_TTL", 24*time.Hour)
+	if err != nil {
+		fatal(err)
+	}
+	verificationResendInterval, err := durationFromEnv("EMAIL_VERIFICATION_RESEND_INTERVAL", time.Minute)
+	if err != nil {
+		fatal(err)
+	}
+
+	deletionGracePeriod, err := durationFromEnv("ACCOUNT_DELETION_GRACE_PERIOD", 30*24*time.Hour)
+	if err != nil {
+		fatal(err)
+	}
+	purgeInterval, err := durationFromEnv("ACCOUNT_PURGE_INTERVAL", time.Hour)
+	if err != nil {
+		fatal(err)
+	}
+	deletedChirps := os.Getenv("ACCOUNT_DELETION_CHIRPS")
+	if deletedChirps != "" && deletedChirps != "delete" && deletedChirps != "anonymize" {
+		fatal(fmt.Errorf("invalid ACCOUNT_DELETION_CHIRPS %q, expected delete or anonymize", deletedChirps))
+	}
+
+	polkaWebhook, err := loadPolkaWebhookConfig()
+	if err != nil {
+		fatal(err)
+	}
+
+	subscriptions, err := loadSubscriptionPolicy()
+	if err != nil {
+		fatal(err)
+	}
+	subscriptionCheckInterval, err := durationFromEnv("SUBSCRIPTION_CHECK_INTERVAL", time.Hour)
+	if err != nil {
+		fatal(err)
+	}
+
+	entitlements, err := loadPlanEntitlements()
+	if err != nil {
+		fatal(err)
+	}
+
+	outboundWebhooks, err := loadOutboundWebhookConfig()
+	if err != nil {
+		fatal(err)
+	}
+	webhookDeliveryInterval, err := durationFromEnv("WEBHOOK_DELIVERY_INTERVAL", 5*time.Second)
+	if err != nil {
+		fatal(err)
+	}
+
+	eventRetryInterval, err := durationFromEnv("EVENT_RETRY_INTERVAL", 30*time.Second)
+	if err != nil {
+		fatal(err)
+	}
+	if eventRetryInterval <= 0 {
+		fatal(fmt.Errorf("invalid EVENT_RETRY_INTERVAL %s", eventRetryInterval))
+	}
+
+	consentTemplate, err := template.ParseFiles(filepath.Join(filepathRoot, "consent.html"))
+	if err != nil {
+		fatal(err)
+	}
+	passwordResetTemplate, err := template.ParseFiles(filepath.Join(filepathRoot, "reset_password.html"))
+	if err != nil {
+		fatal(err)
+	}
+
+	mailer, err := newMailer()
+	if err != nil {
+		fatal(err)
+	}
+
+	baseURL := os.Getenv("BASE_URL")
+	if baseURL == "" {
+		baseURL = "http://localhost:" + port
 	}
 
 	apiCfg := apiConfig{
-		fileserverHits: 0,
-		DB:             db,
+		Metrics:          newMetrics(db, os.Getenv("METRICS_TOKEN")),
+		DB:               db,
+		Events:           events.NewBus(db),
+		Keys:             keys,
+		TokenPolicy:      tokenPolicy,
+		PasswordPolicy:   passwordPolicy,
+		LoginProtection:  loginProtection,
+		AdminEmails:      adminEmails,
+		Mailer:           mailer,
+		PolkaWebhook:     polkaWebhook,
+		OutboundWebhooks: outboundWebhooks,
+		Subscriptions:    subscriptions,
+		Entitlements:     entitlements,
+		BaseURL:          strings.TrimSuffix(baseURL, "/"),
+		PasswordResetTTL: passwordResetTTL,
+		ConsentTemplate:  consentTemplate,
+
+		PasswordResetTemplate:      passwordResetTemplate,
+		EmailVerificationTTL:       emailVerificationTTL,
+		VerificationResendInterval: verificationResendInterval,
+		AccountDeletionGracePeriod: deletionGracePeriod,
+		AnonymizeDeletedChirps:     deletedChirps == "anonymize",
+	}
+	apiCfg.Events.Subscribe("webhooks", apiCfg.enqueueWebhooks)
+	apiCfg.Events.Start(eventRetryInterval, make(chan struct{}))
+
+	if purgeInterval > 0 {
+		apiCfg.StartAccountPurge(purgeInterval, make(chan struct{}))
+	}
+	if subscriptionCheckInterval > 0 {
+		apiCfg.StartSubscriptionExpiry(subscriptionCheckInterval, make(chan struct{}))
+	}
+	if webhookDeliveryInterval > 0 {
+		apiCfg.StartWebhookDelivery(webhookDeliveryInterval, make(chan struct{}))
 	}
 
+	srv := &http.Server{
+		Addr:    ":" + port,
+		Handler: apiCfg.routes(filepathRoot),
+	}
+
+	slog.Info("Serving files", "root", filepathRoot, "port", port)
+	fatal(srv.ListenAndServe())
+}
+
+// routes registers the handlers of the server and wraps them in the
+// middleware that applies to every request.
+func (cfg *apiConfig) routes(filepathRoot string) http.Handler {
 	mux := http.NewServeMux()
-	fsHandler := apiCfg.middlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot))))
-	mux.Handle("/app/", fsHandler)
+	// Only the app's own files are served, never the rest of the working
+	// directory, which holds the database and .env.
+	fsHandler := cfg.middlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot))))
+	mux.Handle("GET /app/{$}", fsHandler)
+	mux.Handle("GET /app/index.html", fsHandler)
+	mux.Handle("GET /app/assets/", fsHandler)
 
 	mux.HandleFunc("GET /api/healthz", handlerReadiness)
-	mux.HandleFunc("GET /api/reset", apiCfg.handlerReset)
 
-	mux.HandleFunc("POST /api/chirps", apiCfg.handlerChirpsCreate)
-	mux.HandleFunc("GET /api/chirps", apiCfg.handlerChirpsRetrieve)
-	mux.HandleFunc("GET /api/chirps/{chirpId}", apiCfg.handlerDetailChirp)
-	mux.HandleFunc("DELETE /api/chirps/{chirpId}", apiCfg.handlerDeleteChirp)
+	mux.HandleFunc("POST /api/chirps", cfg.middlewareAuth(requireScope(scopeChirpsWrite, handleErrors(cfg.handlerChirpsCreate))))
+	mux.HandleFunc("GET /api/chirps", cfg.middlewareOptionalAuth(scopeChirpsRead, cfg.handlerChirpsRetrieve))
+	mux.HandleFunc("GET /api/chirps/{chirpId}", cfg.middlewareOptionalAuth(scopeChirpsRead, handleErrors(cfg.handlerDetailChirp)))
+	mux.HandleFunc("PUT /api/chirps/{chirpId}", cfg.middlewareAuth(requireScope(scopeChirpsWrite, handleErrors(cfg.handlerUpdateChirp))))
+	mux.HandleFunc("DELETE /api/chirps/{chirpId}", cfg.middlewareAuth(requireScope(scopeChirpsWrite, handleErrors(cfg.handlerDeleteChirp))))
+
+	mux.HandleFunc("POST /api/users", handleErrors(cfg.handlerCreateUser))
+	mux.HandleFunc("POST /api/login", handleErrors(cfg.handlerUserLogin))
+	mux.HandleFunc("POST /api/login/2fa", cfg.handlerLoginTwoFactor)
+	mux.HandleFunc("PUT /api/users", cfg.middlewareAuth(requireScope(scopeAccount, handleErrors(cfg.handlerUpdateUser))))
+	mux.HandleFunc("POST /api/users/me/2fa", cfg.middlewareAuth(requireScope(scopeAccount, cfg.handlerTwoFactorEnroll)))
+	mux.HandleFunc("POST /api/users/me/2fa/confirm", cfg.middlewareAuth(requireScope(scopeAccount, cfg.handlerTwoFactorConfirm)))
+	mux.HandleFunc("DELETE /api/users/me/2fa", cfg.middlewareAuth(requireScope(scopeAccount, cfg.handlerTwoFactorDisable)))
+	mux.HandleFunc("GET /api/users/me", cfg.middlewareAuth(requireScope(scopeAccount, cfg.handlerUserMe)))
+	mux.HandleFunc("GET /api/users/{userId}", cfg.handlerUserDetail)
+	mux.HandleFunc("GET /api/users/me/entitlements", cfg.middlewareAuth(requireScope(scopeAccount, cfg.handlerEntitlements)))
+	mux.HandleFunc("GET /api/users/me/export", cfg.middlewareAuth(requireScope(scopeAccount, cfg.handlerUserExport)))
+	mux.HandleFunc("DELETE /api/users/me", cfg.middlewareAuth(requireScope(scopeAccount, cfg.handlerUserDelete)))
+	mux.HandleFunc("DELETE /api/users/me/deletion", cfg.middlewareAuth(requireScope(scopeAccount, cfg.handlerUserDeleteCancel)))
+	mux.HandleFunc("GET /api/users/verify", cfg.handlerVerifyEmail)
+	mux.HandleFunc("POST /api/users/verify/resend", cfg.middlewareAuth(requireScope(scopeAccount, cfg.handlerResendVerification)))
 
-	mux.HandleFunc("POST /api/users", apiCfg.handlerCreateUser)
-	mux.HandleFunc("POST /api/login", apiCfg.handlerUserLogin)
-	mux.HandleFunc("PUT /api/users", apiCfg.handlerUpdateUser)
+	mux.HandleFunc("POST /api/refresh", handleErrors(cfg.handlerRefreshToken))
+	mux.HandleFunc("POST /api/revoke", handleErrors(cfg.handlerRevokeToken))
 
-	mux.HandleFunc("POST /api/refresh", apiCfg.handlerRefreshToken)
-	mux.HandleFunc("POST /api/revoke", apiCfg.handlerRevokeToken)
+	mux.HandleFunc("POST /api/password/forgot", cfg.handlerPasswordForgot)
+	mux.HandleFunc("POST /api/password/reset", cfg.handlerPasswordReset)
+	mux.HandleFunc("GET /app/reset-password", cfg.handlerPasswordResetPage)
+	mux.HandleFunc("POST /app/reset-password", cfg.handlerPasswordResetForm)
+
+	mux.HandleFunc("GET /api/sessions", cfg.middlewareAuth(requireScope(scopeAccount, cfg.handlerSessionsList)))
+	mux.HandleFunc("DELETE /api/sessions/{sessionId}", cfg.middlewareAuth(requireScope(scopeAccount, cfg.handlerSessionRevoke)))
+
+	mux.HandleFunc("GET /api/tokens", cfg.middlewareAuth(requireScope(scopeAccount, cfg.handlerAPITokensList)))
+	mux.HandleFunc("POST /api/tokens", cfg.middlewareAuth(requireScope(scopeAccount, cfg.handlerAPITokenCreate)))
+	mux.HandleFunc("DELETE /api/tokens/{tokenId}", cfg.middlewareAuth(requireScope(scopeAccount, cfg.handlerAPITokenRevoke)))
+
+	mux.HandleFunc("GET /api/oauth/clients", cfg.middlewareAuth(requireScope(scopeAccount, cfg.handlerOAuthClientsList)))
+	mux.HandleFunc("POST /api/oauth/clients", cfg.middlewareAuth(requireScope(scopeAccount, cfg.handlerOAuthClientCreate)))
+	mux.HandleFunc("DELETE /api/oauth/clients/{clientId}", cfg.middlewareAuth(requireScope(scopeAccount, cfg.handlerOAuthClientDelete)))
+
+	mux.HandleFunc("GET /api/webhooks", cfg.middlewareAuth(requireScope(scopeAccount, cfg.handlerWebhookEndpointsList)))
+	mux.HandleFunc("POST /api/webhooks", cfg.middlewareAuth(requireScope(scopeAccount, cfg.handlerWebhookEndpointCreate)))
+	mux.HandleFunc("DELETE /api/webhooks/{endpointId}", cfg.middlewareAuth(requireScope(scopeAccount, cfg.handlerWebhookEndpointDelete)))
+	mux.HandleFunc("GET /api/webhooks/{endpointId}/deliveries", cfg.middlewareAuth(requireScope(scopeAccount, cfg.handlerWebhookDeliveriesList)))
+	mux.HandleFunc("POST /api/webhooks/{endpointId}/deliveries/{deliveryId}/retry", cfg.middlewareAuth(requireScope(scopeAccount, cfg.handlerWebhookDeliveryRetry)))
+
+	mux.HandleFunc("GET /oauth/authorize", cfg.handlerOAuthAuthorize)
+	mux.HandleFunc("POST /oauth/authorize", cfg.handlerOAuthConsent)
+	mux.HandleFunc("POST /oauth/token", cfg.handlerOAuthToken)
+	mux.HandleFunc("POST /oauth/revoke", cfg.handlerOAuthRevoke)
 
 	//webhook
-	mux.HandleFunc("POST /api/polka/webhooks", apiCfg.handlerPolkaWebhook)
+	mux.HandleFunc("POST /api/polka/webhooks", handleErrors(cfg.handlerPolkaWebhook))
 
-	mux.HandleFunc("GET /admin/metrics", apiCfg.handlerMetrics)
+	mux.HandleFunc("GET /.well-known/jwks.json", cfg.handlerJWKS)
 
-	srv := &http.Server{
-		Addr:    ":" + port,
-		Handler: mux,
+	mux.HandleFunc("GET /metrics", cfg.handlerPrometheus)
+	mux.HandleFunc("GET /admin/metrics", cfg.middlewareAdmin(cfg.handlerMetrics))
+	mux.HandleFunc("GET /admin/stats", cfg.middlewareAdmin(cfg.handlerStats))
+	mux.HandleFunc("POST /admin/reset", cfg.middlewareAdmin(cfg.handlerReset))
+	mux.HandleFunc("GET /admin/audit", cfg.middlewareAdmin(cfg.handlerAuditLog))
+	mux.HandleFunc("GET /admin/lockouts", cfg.middlewareAdmin(cfg.handlerLockoutsList))
+	mux.HandleFunc("DELETE /admin/lockouts/{key}", cfg.middlewareAdmin(cfg.handlerLockoutClear))
+	mux.HandleFunc("GET /admin/webhooks", cfg.middlewareAdmin(cfg.handlerWebhookEventsList))
+	mux.HandleFunc("GET /admin/webhooks/{key}", cfg.middlewareAdmin(cfg.handlerWebhookEventDetail))
+	mux.HandleFunc("POST /admin/webhooks/{key}/replay", cfg.middlewareAdmin(handleErrors(cfg.handlerWebhookEventReplay)))
+	mux.HandleFunc("GET /admin/webhook-deliveries", cfg.middlewareAdmin(cfg.handlerWebhookDeliveriesAdmin))
+
+	return middlewareRequestID(cfg.middlewareRequestMetrics(mux, middlewareRecover(mux)))
+}
+
+// fatal logs an error that keeps the server from running and exits.
+func fatal(err error) {
+	slog.Error("Couldn't run server", "error", err)
+	os.Exit(1)
+}
+
+func durationFromEnv(key string, fallback time.Duration) (time.Duration, error) {
+	val := os.Getenv(key)
+	if val == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return d, nil
+}
+
+func loadTokenPolicy() (TokenPolicy, error) {
+	defaultTTL, err := durationFromEnv("ACCESS_TOKEN_TTL", time.Hour)
+	if err != nil {
+		return TokenPolicy{}, err
+	}
+	minTTL, err := durationFromEnv("ACCESS_TOKEN_MIN_TTL", time.Minute)
+	if err != nil {
+		return TokenPolicy{}, err
+	}
+	maxTTL, err := durationFromEnv("ACCESS_TOKEN_MAX_TTL", 24*time.Hour)
+	if err != nil {
+		return TokenPolicy{}, err
+	}
+
+	refreshTTL, err := durationFromEnv("REFRESH_TOKEN_TTL", 60*24*time.Hour)
+	if err != nil {
+		return TokenPolicy{}, err
+	}
+
+	if minTTL <= 0 || minTTL > maxTTL || defaultTTL < minTTL || defaultTTL > maxTTL {
+		return TokenPolicy{}, fmt.Errorf("invalid access token policy: min %s, default %s, max %s", minTTL, defaultTTL, maxTTL)
+	}
+	if refreshTTL <= 0 {
+		return TokenPolicy{}, fmt.Errorf("invalid refresh token lifetime %s", refreshTTL)
 	}
 
-	log.Printf("Serving files from %s on port: %s\n", filepathRoot, port)
-	log.Fatal(srv.ListenAndServe())
+	return TokenPolicy{
+		DefaultTTL: defaultTTL,
+		MinTTL:     minTTL,
+		MaxTTL:     maxTTL,
+		RefreshTTL: refreshTTL,
+	}, nil
 }
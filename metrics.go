@@ -1,28 +1,201 @@
 package main
 
 import (
-	"fmt"
+	"crypto/subtle"
+	"html/template"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Raihanki/Chirpy/internal/database"
+	"github.com/Raihanki/Chirpy/internal/metrics"
 )
 
-func (cfg *apiConfig) handlerMetrics(w http.ResponseWriter, r *http.Request) {
-	w.Header().Add("Content-Type", "text/html")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(fmt.Sprintf(`
+// Metrics are the instruments of the server. They are all registered in
+// Registry, which backs both /metrics and the admin page.
+type Metrics struct {
+	Registry        *metrics.Registry
+	FileserverHits  *metrics.Counter
+	PathHits        *metrics.CounterVec
+	Requests        *metrics.CounterVec
+	RequestDuration *metrics.HistogramVec
+	DBDuration      *metrics.HistogramVec
+	DBFileSize      *metrics.Gauge
+	// Token, if set, must be sent as a bearer token to scrape /metrics.
+	Token string
+}
+
+var dbBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+func newMetrics(db *database.DB, token string) *Metrics {
+	registry := metrics.NewRegistry()
+	registry.RegisterRuntime()
+
+	m := &Metrics{
+		Registry: registry,
+		FileserverHits: registry.NewCounter("chirpy_fileserver_hits_total",
+			"Requests for files under /app/."),
+		PathHits: registry.NewCounterVec("chirpy_fileserver_path_hits_total",
+			"Requests for files under /app/ that were served, by path.", "path"),
+		Requests: registry.NewCounterVec("chirpy_http_requests_total",
+			"HTTP requests by route pattern, method and status code.", "route", "method", "code"),
+		RequestDuration: registry.NewHistogramVec("chirpy_http_request_duration_seconds",
+			"HTTP request latency by route pattern and method.", metrics.DefaultBuckets, "route", "method"),
+		DBDuration: registry.NewHistogramVec("chirpy_db_operation_duration_seconds",
+			"Time taken to load or write the database file.", dbBuckets, "operation"),
+		DBFileSize: registry.NewGauge("chirpy_db_file_size_bytes",
+			"Size of the database file when it was last loaded or written."),
+		Token: token,
+	}
+
+	registry.NewGaugeFunc("chirpy_active_sessions", "Sessions whose refresh token hasn't expired.", func() float64 {
+		count, err := db.CountActiveSessions(time.Now())
+		if err != nil {
+			slog.Error("Couldn't count sessions for metrics", "error", err)
+		}
+		return float64(count)
+	})
+
+	db.Observe(func(op string, duration time.Duration, bytes int) {
+		m.DBDuration.WithLabelValues(op).Observe(duration.Seconds())
+		m.DBFileSize.Set(float64(bytes))
+	})
+
+	return m
+}
+
+// knownMethods bounds the values of the method label.
+var knownMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true, http.MethodPut: true,
+	http.MethodPatch: true, http.MethodDelete: true, http.MethodOptions: true,
+}
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// middlewareRequestMetrics counts and times every request to next by the
+// pattern of mux that matched it, so that path parameters don't create a
+// series per ID.
+func (cfg *apiConfig) middlewareRequestMetrics(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		if _, path, ok := strings.Cut(pattern, " "); ok {
+			pattern = path
+		}
+		if pattern == "" {
+			pattern = "unmatched"
+		}
+		method := r.Method
+		if !knownMethods[method] {
+			method = "OTHER"
+		}
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		cfg.Metrics.RequestDuration.WithLabelValues(pattern, method).Observe(time.Since(start).Seconds())
+		cfg.Metrics.Requests.WithLabelValues(pattern, method, strconv.Itoa(rec.status)).Inc()
+	})
+}
+
+// handlerPrometheus serves the registry in the Prometheus exposition format.
+func (cfg *apiConfig) handlerPrometheus(w http.ResponseWriter, r *http.Request) {
+	if cfg.Metrics.Token != "" {
+		token, err := getBearerToken(r)
+		if err != nil || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.Metrics.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+
+	metrics.Handler(cfg.Metrics.Registry).ServeHTTP(w, r)
+}
+
+var metricsPage = template.Must(template.New("metrics").Funcs(template.FuncMap{
+	"labels": func(labels []metrics.Label) string {
+		parts := make([]string, len(labels))
+		for i, l := range labels {
+			parts[i] = l.Name + "=" + l.Value
+		}
+		return strings.Join(parts, ", ")
+	},
+}).Parse(`
 <html>
 
 <body>
 	<h1>Welcome, Chirpy Admin</h1>
-	<p>Chirpy has been visited %dtimes!</p>
+	<p>Chirpy has been visited {{.Hits}} times!</p>
+	<table>
+		<tr><th>Metric</th><th>Labels</th><th>Value</th></tr>
+		{{- range .Samples}}
+		<tr><td>{{.Name}}</td><td>{{labels .Labels}}</td><td>{{.Value}}</td></tr>
+		{{- end}}
+	</table>
 </body>
 
 </html>
-	`, cfg.fileserverHits)))
+`))
+
+// handlerMetrics renders the registry as an HTML page. Histogram buckets
+// are left out; their sums and counts are shown.
+func (cfg *apiConfig) handlerMetrics(w http.ResponseWriter, r *http.Request) {
+	samples := []metrics.Sample{}
+	for _, family := range cfg.Metrics.Registry.Gather() {
+		for _, sample := range family.Samples {
+			if !strings.HasSuffix(sample.Name, "_bucket") {
+				samples = append(samples, sample)
+			}
+		}
+	}
+
+	w.Header().Add("Content-Type", "text/html")
+	w.WriteHeader(http.StatusOK)
+	err := metricsPage.Execute(w, struct {
+		Hits    uint64
+		Samples []metrics.Sample
+	}{
+		Hits:    cfg.Metrics.FileserverHits.Value(),
+		Samples: samples,
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Couldn't render metrics page", "error", err)
+	}
 }
 
+// middlewareMetricsInc counts requests for files. Hits per path are only
+// counted for files that were served, so that probing for missing files
+// doesn't create a series per path.
 func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cfg.fileserverHits++
-		next.ServeHTTP(w, r)
+		cfg.Metrics.FileserverHits.Inc()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 || rec.status < http.StatusBadRequest {
+			cfg.Metrics.PathHits.WithLabelValues(r.URL.Path).Inc()
+		}
 	})
 }
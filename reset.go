@@ -1,9 +1,28 @@
 package main
 
-import "net/http"
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
 
+	"github.com/Raihanki/Chirpy/internal/database"
+)
+
+// handlerReset sets the fileserver hit counters back to zero and records
+// who did it in the audit log.
 func (cfg *apiConfig) handlerReset(w http.ResponseWriter, r *http.Request) {
-	cfg.fileserverHits = 0
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Hits reset to 0"))
+	principal, _ := principalFromContext(r.Context())
+
+	hits := cfg.Metrics.FileserverHits.Value()
+	cfg.Metrics.FileserverHits.Reset()
+	cfg.Metrics.PathHits.Reset()
+
+	entry, err := cfg.DB.WithContext(r.Context()).RecordAudit(principal.UserID, database.AuditMetricsReset, fmt.Sprintf("fileserver hits were %d", hits))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Couldn't record metrics reset", "user_id", principal.UserID, "error", err)
+		respondWithError(w, r, http.StatusInternalServerError, "Hits were reset but the reset couldn't be recorded")
+		return
+	}
+
+	respondWithJSON(w, r, http.StatusOK, auditEntryFromDB(entry))
 }
@@ -2,27 +2,38 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
 )
 
-func respondWithError(w http.ResponseWriter, code int, msg string) {
+func respondWithError(w http.ResponseWriter, r *http.Request, code int, msg string) {
 	if code > 499 {
-		log.Printf("Responding with 5XX error: %s", msg)
+		slog.ErrorContext(r.Context(), "Responding with 5XX error", "error", msg)
 	}
 	type errorResponse struct {
 		Error string `json:"error"`
 	}
-	respondWithJSON(w, code, errorResponse{
+	respondWithJSON(w, r, code, errorResponse{
 		Error: msg,
 	})
 }
 
-func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
+func respondWithValidationError(w http.ResponseWriter, r *http.Request, errs []fieldError) {
+	type validationResponse struct {
+		Error   string       `json:"error"`
+		Details []fieldError `json:"details"`
+	}
+	respondWithJSON(w, r, http.StatusBadRequest, validationResponse{
+		Error:   "Validation failed",
+		Details: errs,
+	})
+}
+
+func respondWithJSON(w http.ResponseWriter, r *http.Request, code int, payload interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	dat, err := json.Marshal(payload)
 	if err != nil {
-		log.Printf("Error marshalling JSON: %s", err)
+		slog.ErrorContext(r.Context(), "Couldn't marshal JSON response", "error", err)
 		w.WriteHeader(500)
 		return
 	}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/Raihanki/Chirpy/internal/database"
+)
+
+// bcryptHash matches the prefix of a bcrypt hash, such as $2a$10$.
+var bcryptHash = regexp.MustCompile(`\$2[abxy]?\$\d{2}\$`)
+
+// storedHashes returns every password and token hash in the database.
+func storedHashes(t *testing.T, db *database.DB) []string {
+	t.Helper()
+
+	data, err := db.LoadDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hashes := []string{}
+	for _, user := range data.Users {
+		hashes = append(hashes, user.Password)
+		hashes = append(hashes, user.RecoveryCodeHashes...)
+	}
+	for _, session := range data.Sessions {
+		hashes = append(hashes, session.RefreshTokenHash)
+		hashes = append(hashes, session.RotatedTokenHashes...)
+	}
+	for hash := range data.RefreshTokens {
+		hashes = append(hashes, hash)
+	}
+	for hash := range data.APITokens {
+		hashes = append(hashes, hash)
+	}
+	for hash := range data.PasswordResets {
+		hashes = append(hashes, hash)
+	}
+	for _, client := range data.OAuthClients {
+		hashes = append(hashes, client.SecretHash)
+	}
+	for hash := range data.AuthorizationCodes {
+		hashes = append(hashes, hash)
+	}
+	return hashes
+}
+
+func TestResponsesDoNotExposeHashes(t *testing.T) {
+	cfg := newTestConfig(t)
+	h := cfg.routes(t.TempDir())
+
+	token, refreshToken := signUpAndLogin(t, h, testAdminEmail, "correct horse battery")
+
+	type exchange struct {
+		name string
+		body []byte
+	}
+	exchanges := []exchange{}
+	call := func(method, target, token string, body any) []byte {
+		t.Helper()
+		res, data := doJSON(t, h, method, target, token, body)
+		if res.StatusCode >= http.StatusBadRequest {
+			t.Fatalf("%s %s: status %d: %s", method, target, res.StatusCode, data)
+		}
+		exchanges = append(exchanges, exchange{name: method + " " + target, body: data})
+		return data
+	}
+
+	// Create a record of every kind that stores a hash.
+	call(http.MethodPost, "/api/refresh", refreshToken, nil)
+	call(http.MethodPost, "/api/tokens", token, map[string]any{"name": "ci", "scopes": []string{scopeChirpsRead}})
+	call(http.MethodPost, "/api/password/forgot", "", map[string]string{"email": testAdminEmail})
+	call(http.MethodPost, "/api/oauth/clients", token, map[string]any{"name": "app", "redirect_uris": []string{"https://app.example.com/callback"}})
+	doJSON(t, h, http.MethodPost, "/api/login", "", map[string]string{"email": testAdminEmail, "password": "wrong password"})
+
+	call(http.MethodPost, "/api/login", "", map[string]string{"email": testAdminEmail, "password": "correct horse battery"})
+	call(http.MethodPut, "/api/users", token, map[string]string{"email": testAdminEmail, "password": "correct horse battery"})
+	call(http.MethodGet, "/api/users/me", token, nil)
+	call(http.MethodGet, "/api/users/1", "", nil)
+	call(http.MethodGet, "/api/users/me/export", token, nil)
+	call(http.MethodGet, "/api/sessions", token, nil)
+	call(http.MethodGet, "/api/tokens", token, nil)
+	call(http.MethodGet, "/api/oauth/clients", token, nil)
+	call(http.MethodGet, "/admin/stats", token, nil)
+	call(http.MethodGet, "/admin/audit", token, nil)
+	call(http.MethodGet, "/admin/lockouts", token, nil)
+	call(http.MethodGet, "/admin/webhooks", token, nil)
+	call(http.MethodGet, "/admin/webhook-deliveries", token, nil)
+
+	hashes := storedHashes(t, cfg.DB)
+	if len(hashes) < 6 {
+		t.Fatalf("expected hashes of every kind to be stored, got %d", len(hashes))
+	}
+
+	for _, e := range exchanges {
+		body := string(e.body)
+		if bcryptHash.MatchString(body) {
+			t.Errorf("%s: response contains a bcrypt hash: %s", e.name, body)
+		}
+		for _, hash := range hashes {
+			if hash != "" && strings.Contains(body, hash) {
+				t.Errorf("%s: response contains stored hash %q", e.name, hash)
+			}
+		}
+	}
+}
+
+func TestAppServesOnlyItsFiles(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"index.html", "assets/logo.png", "database.json", ".env", "main.go"} {
+		path := filepath.Join(root, name)
+		err := os.MkdirAll(filepath.Dir(path), 0o755)
+		if err == nil {
+			err = os.WriteFile(path, []byte("contents of "+name), 0o644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := newTestConfig(t).routes(root)
+
+	tests := []struct {
+		target string
+		served bool
+	}{
+		{"/app/", true},
+		{"/app/assets/logo.png", true},
+		{"/app/database.json", false},
+		{"/app/.env", false},
+		{"/app/main.go", false},
+		{"/app/assets/../database.json", false},
+	}
+	for _, tt := range tests {
+		res, body := doJSON(t, h, http.MethodGet, tt.target, "", nil)
+		if served := res.StatusCode == http.StatusOK; served != tt.served {
+			t.Errorf("GET %s: status %d, want served = %v", tt.target, res.StatusCode, tt.served)
+		}
+		if strings.Contains(string(body), "contents of database.json") {
+			t.Errorf("GET %s served the database", tt.target)
+		}
+	}
+}
+
+func TestTOTPSecretsAreEncrypted(t *testing.T) {
+	cfg := newTestConfig(t)
+	h := cfg.routes(t.TempDir())
+
+	token, _ := signUpAndLogin(t, h, "totp@example.com", "correct horse battery")
+	res, body := doJSON(t, h, http.MethodPost, "/api/users/me/2fa", token, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("enroll: status %d: %s", res.StatusCode, body)
+	}
+	enrollment := struct {
+		Secret string `json:"secret"`
+	}{}
+	err := json.Unmarshal(body, &enrollment)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := cfg.DB.GetUserByEmail("totp@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(user.EncryptedTOTPPendingSecret, enrollment.Secret) {
+		t.Errorf("pending TOTP secret is stored in plaintext")
+	}
+	secret, err := cfg.DB.PendingTOTPSecret(user)
+	if err != nil || secret != enrollment.Secret {
+		t.Errorf("PendingTOTPSecret() = %q, %v, want %q", secret, err, enrollment.Secret)
+	}
+}
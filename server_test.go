@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Raihanki/Chirpy/internal/database"
+	"github.com/Raihanki/Chirpy/internal/events"
+	"github.com/Raihanki/Chirpy/internal/mail"
+)
+
+const testAdminEmail = "admin@example.com"
+
+// newTestConfig returns a configuration backed by a fresh database in a
+// temporary directory. testAdminEmail is granted the admin role.
+func newTestConfig(t *testing.T) *apiConfig {
+	t.Helper()
+
+	dir := t.TempDir()
+	db, err := database.NewDB(filepath.Join(dir, "database.json"), []byte("test-hash-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewKeyring(db, "HS256", time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entitlements, err := loadPlanEntitlements()
+	if err != nil {
+		t.Fatal(err)
+	}
+	consentTemplate, err := template.ParseFiles("consent.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	passwordResetTemplate, err := template.ParseFiles("reset_password.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &apiConfig{
+		DB:      db,
+		Metrics: newMetrics(db, ""),
+		Events:  events.NewBus(db),
+		Keys:    keys,
+		TokenPolicy: TokenPolicy{
+			DefaultTTL: time.Hour,
+			MinTTL:     time.Minute,
+			MaxTTL:     24 * time.Hour,
+			RefreshTTL: 24 * time.Hour,
+		},
+		PasswordPolicy: PasswordPolicy{MinLength: 8, Breached: map[string]struct{}{}},
+		LoginProtection: LoginProtection{
+			Account: database.LockoutPolicy{MaxFailures: 5, BaseDelay: time.Second, MaxDelay: time.Minute},
+			IP:      database.LockoutPolicy{MaxFailures: 20, BaseDelay: time.Second, MaxDelay: time.Minute},
+		},
+		AdminEmails: map[string]struct{}{testAdminEmail: {}},
+		Mailer:      &mail.LogMailer{Path: filepath.Join(dir, "mail.log")},
+		Subscriptions: SubscriptionPolicy{
+			Period: 30 * 24 * time.Hour,
+			Grace:  72 * time.Hour,
+		},
+		Entitlements:               entitlements,
+		BaseURL:                    "http://chirpy.test",
+		ConsentTemplate:            consentTemplate,
+		PasswordResetTemplate:      passwordResetTemplate,
+		PasswordResetTTL:           time.Hour,
+		EmailVerificationTTL:       time.Hour,
+		VerificationResendInterval: time.Minute,
+		AccountDeletionGracePeriod: time.Hour,
+	}
+}
+
+// doJSON sends a request with body encoded as JSON, if it isn't nil, and
+// the bearer token, if it isn't empty. It returns the response and its body.
+func doJSON(t *testing.T, h http.Handler, method, target, token string, body any) (*http.Response, []byte) {
+	t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req := httptest.NewRequest(method, target, reader)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	res := rec.Result()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, data
+}
+
+// doForm posts form to target and returns the response and its body.
+func doForm(t *testing.T, h http.Handler, target string, form url.Values) (*http.Response, []byte) {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	res := rec.Result()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, data
+}
+
+// waitForMail waits for the test mailer to write a message matching
+// pattern, and returns the pattern's submatches.
+func waitForMail(t *testing.T, cfg *apiConfig, pattern *regexp.Regexp) []string {
+	t.Helper()
+
+	path := cfg.Mailer.(*mail.LogMailer).Path
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		data, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			t.Fatal(err)
+		}
+		if match := pattern.FindStringSubmatch(string(data)); match != nil {
+			return match
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no mail matching %s was sent", pattern)
+	return nil
+}
+
+// signUpAndLogin creates an account and logs into it, returning the access
+// and refresh tokens.
+func signUpAndLogin(t *testing.T, h http.Handler, email, password string) (string, string) {
+	t.Helper()
+
+	res, body := doJSON(t, h, http.MethodPost, "/api/users", "", map[string]string{"email": email, "password": password})
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("sign up: status %d: %s", res.StatusCode, body)
+	}
+	return login(t, h, email, password)
+}
+
+// login logs into an existing account and returns the access and refresh
+// tokens.
+func login(t *testing.T, h http.Handler, email, password string) (string, string) {
+	t.Helper()
+
+	res, body := doJSON(t, h, http.MethodPost, "/api/login", "", map[string]string{"email": email, "password": password})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("login: status %d: %s", res.StatusCode, body)
+	}
+	tokens := struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}{}
+	err := json.Unmarshal(body, &tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokens.Token, tokens.RefreshToken
+}
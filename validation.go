@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	maxEmailLength      = 254
+	maxEmailLocalLength = 64
+	// bcrypt ignores everything after the first 72 bytes.
+	maxPasswordBytes = 72
+)
+
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// errMalformedBody is reported when a request body isn't valid JSON for
+// the endpoint.
+var errMalformedBody = fieldError{Field: "body", Message: "Request body must be a valid JSON object"}
+
+// normalizeEmail checks that raw is a bare RFC 5322 address, without a
+// display name, and returns it with the domain lowercased.
+func normalizeEmail(raw string) (string, *fieldError) {
+	email := strings.TrimSpace(raw)
+	if email == "" {
+		return "", &fieldError{Field: "email", Message: "Email is required"}
+	}
+
+	invalid := &fieldError{Field: "email", Message: "Email is not a valid address"}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Name != "" || addr.Address != email {
+		return "", invalid
+	}
+
+	at := strings.LastIndex(email, "@")
+	local, domain := email[:at], email[at+1:]
+	if len(email) > maxEmailLength || len(local) > maxEmailLocalLength || !strings.Contains(domain, ".") {
+		return "", invalid
+	}
+
+	return local + "@" + strings.ToLower(domain), nil
+}
+
+// PasswordPolicy is the set of rules new passwords must satisfy.
+type PasswordPolicy struct {
+	MinLength int
+	// Breached holds lowercased passwords known from public breaches.
+	Breached map[string]struct{}
+}
+
+func (p PasswordPolicy) Validate(password string) *fieldError {
+	if password == "" {
+		return &fieldError{Field: "password", Message: "Password is required"}
+	}
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return &fieldError{Field: "password", Message: fmt.Sprintf("Password must be at least %d characters long", p.MinLength)}
+	}
+	if len(password) > maxPasswordBytes {
+		return &fieldError{Field: "password", Message: fmt.Sprintf("Password must be at most %d bytes long", maxPasswordBytes)}
+	}
+	if _, ok := p.Breached[strings.ToLower(password)]; ok {
+		return &fieldError{Field: "password", Message: "Password has appeared in a data breach, choose a different one"}
+	}
+	return nil
+}
+
+// loadPasswordPolicy reads PASSWORD_MIN_LENGTH and PASSWORD_BREACHED_LIST,
+// a file with one breached password per line.
+func loadPasswordPolicy() (PasswordPolicy, error) {
+	policy := PasswordPolicy{
+		MinLength: 8,
+		Breached:  map[string]struct{}{},
+	}
+
+	if val := os.Getenv("PASSWORD_MIN_LENGTH"); val != "" {
+		minLength, err := strconv.Atoi(val)
+		if err != nil || minLength < 1 {
+			return PasswordPolicy{}, fmt.Errorf("invalid PASSWORD_MIN_LENGTH %q", val)
+		}
+		policy.MinLength = minLength
+	}
+
+	path := os.Getenv("PASSWORD_BREACHED_LIST")
+	if path == "" {
+		return policy, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return PasswordPolicy{}, fmt.Errorf("opening breached password list: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" {
+			policy.Breached[strings.ToLower(line)] = struct{}{}
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return PasswordPolicy{}, fmt.Errorf("reading breached password list: %w", err)
+	}
+
+	return policy, nil
+}
+
+// validateCredentials normalizes the email and checks the password against
+// the policy, collecting every violation.
+func (cfg *apiConfig) validateCredentials(email, password string) (string, []fieldError) {
+	errs := []fieldError{}
+
+	normalized, fieldErr := normalizeEmail(email)
+	if fieldErr != nil {
+		errs = append(errs, *fieldErr)
+	}
+
+	fieldErr = cfg.PasswordPolicy.Validate(password)
+	if fieldErr != nil {
+		errs = append(errs, *fieldErr)
+	}
+
+	return normalized, errs
+}